@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// The raw source is uploaded next to the output as input.wav. With
+// archive_format=flac it is transcoded to lossless FLAC and that is
+// uploaded as original.flac instead, so the archive is in one format
+// whatever was sent.
+const (
+	archiveRaw  = "raw"
+	archiveFLAC = "flac"
+
+	archiveName = "original.flac"
+)
+
+func parseArchiveFormat(q url.Values) (string, error) {
+	switch format := q.Get("archive_format"); format {
+	case "", archiveRaw:
+		return archiveRaw, nil
+	case archiveFLAC:
+		return format, nil
+	default:
+		return "", fmt.Errorf("Unsupported archive_format %q. Only raw and flac are allowed", format)
+	}
+}
+
+// archiveOriginal replaces the source at inputPath with its FLAC
+// transcode in workingDir. Only the first audio stream is kept; FLAC can't
+// carry cover art or other streams the upload might have had.
+func archiveOriginal(ctx context.Context, inputPath string, workingDir string) error {
+	cmd := ffmpegCommand(
+		"-i", inputPath,
+		"-map", "0:a:0",
+		"-c:a", "flac",
+		filepath.Join(workingDir, archiveName),
+	)
+	if err := runFFmpeg(ctx, cmd); err != nil {
+		return fmt.Errorf("FFmpeg archive transcode failed: %w", err)
+	}
+	return os.Remove(inputPath)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// apiKey is one API_KEYS entry, written either as the bare key or as
+// tenant:key to name who it belongs to.
+type apiKey struct {
+	Tenant string
+	Key    string
+}
+
+var apiKeys []apiKey
+
+// adminAPIKey is ADMIN_API_KEY, the only key /admin endpoints accept. They
+// are disabled without one; tenant keys never reach them.
+var adminAPIKey string
+
+func parseAPIKeys(entries []string) []apiKey {
+	keys := make([]apiKey, 0, len(entries))
+	for _, entry := range entries {
+		if tenant, key, ok := strings.Cut(entry, ":"); ok && tenant != "" && key != "" {
+			keys = append(keys, apiKey{Tenant: tenant, Key: key})
+			continue
+		}
+		keys = append(keys, apiKey{Key: entry})
+	}
+	return keys
+}
+
+func requestAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+	return ""
+}
+
+// matchAPIKey returns the configured key the request presents, if any.
+func matchAPIKey(r *http.Request) (apiKey, bool) {
+	provided := requestAPIKey(r)
+	if provided == "" {
+		return apiKey{}, false
+	}
+	for _, key := range apiKeys {
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(key.Key)) == 1 {
+			return key, true
+		}
+	}
+	return apiKey{}, false
+}
+
+// tenantKey carries the tenant of a request rebuilt without its API key,
+// see withTenant.
+type tenantKey struct{}
+
+// withTenant attributes r to tenant, as if it had sent that tenant's key.
+func withTenant(r *http.Request, tenant string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), tenantKey{}, tenant))
+}
+
+// requestTenant is the tenant of the request's API key, or "" when it has
+// none or no valid key was sent.
+func requestTenant(r *http.Request) string {
+	if tenant, ok := r.Context().Value(tenantKey{}).(string); ok {
+		return tenant
+	}
+	key, _ := matchAPIKey(r)
+	return key.Tenant
+}
+
+// requireAPIKey rejects requests without a valid API key. When no API_KEYS
+// are configured the handler is left open.
+func requireAPIKey(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(apiKeys) == 0 {
+			next(w, r)
+			return
+		}
+
+		if _, ok := matchAPIKey(r); ok {
+			next(w, r)
+			return
+		}
+
+		writeError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+	}
+}
+
+// requireAdminKey guards the /admin endpoints with ADMIN_API_KEY. Unlike
+// requireAPIKey it never leaves the handler open.
+func requireAdminKey(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminAPIKey == "" {
+			writeError(w, http.StatusForbidden, codeForbidden, "Admin endpoints are disabled, set ADMIN_API_KEY")
+			return
+		}
+		provided := requestAPIKey(r)
+		if provided == "" || subtle.ConstantTimeCompare([]byte(provided), []byte(adminAPIKey)) != 1 {
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// BATCH_CONCURRENCY is how many items of one batch may hold or wait for a
+// conversion slot at once, unless the batch asks for fewer or more (up to
+// BATCH_MAX_CONCURRENCY). Because each batch only ever has that many items
+// in the global FIFO queue, concurrent batches and single conversions
+// interleave instead of one large batch filling every slot.
+var (
+	batchConcurrency    = 2
+	batchMaxConcurrency = 8
+	batchMaxItems       = 100
+)
+
+type batchRequest struct {
+	Concurrency int         `json:"concurrency"`
+	Items       []batchItem `json:"items"`
+}
+
+// batchItem is one conversion: the source URL plus any /convert query
+// parameters, given as strings.
+type batchItem struct {
+	URL    string            `json:"url"`
+	Params map[string]string `json:"params"`
+}
+
+type batchItemStatus struct {
+	Index     int       `json:"index"`
+	JobID     string    `json:"jobId,omitempty"`
+	Status    jobStatus `json:"status,omitempty"`
+	StatusURL string    `json:"statusUrl,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Code      string    `json:"code,omitempty"`
+}
+
+// handleBatch accepts several conversions at once. Every item runs as an
+// async job and the response lists their job IDs for polling /status;
+// items that fail validation are reported inline and the rest still run.
+func handleBatch(w http.ResponseWriter, r *http.Request) {
+	var batch batchRequest
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		writeBodyError(w, "batch", err)
+		return
+	}
+	if len(batch.Items) == 0 || len(batch.Items) > batchMaxItems {
+		writeError(w, http.StatusBadRequest, codeBadInput, fmt.Sprintf("A batch needs between 1 and %d items", batchMaxItems))
+		return
+	}
+
+	concurrency := batchConcurrency
+	if batch.Concurrency != 0 {
+		if batch.Concurrency < 1 || batch.Concurrency > batchMaxConcurrency {
+			writeError(w, http.StatusBadRequest, codeBadInput, fmt.Sprintf("Invalid 'concurrency', expected 1-%d", batchMaxConcurrency))
+			return
+		}
+		concurrency = batch.Concurrency
+	}
+	if conversions.limit > 0 {
+		concurrency = min(concurrency, conversions.limit)
+	}
+
+	if err := minioUnavailable(r.Context()); err != nil {
+		log.Println("MinIO unavailable:", err)
+		w.Header().Set("Retry-After", minioRetryAfter)
+		writeError(w, http.StatusServiceUnavailable, codeStorageUnavailable, "Storage temporarily unavailable, retry later")
+		return
+	}
+
+	batchID := uuid.NewString()
+	statuses := make([]batchItemStatus, len(batch.Items))
+	var queued []queuedItem
+	for i, item := range batch.Items {
+		statuses[i].Index = i
+		req, q, err := parseBatchItem(r, item)
+		if err != nil {
+			err = withStatus(http.StatusBadRequest, err)
+			statuses[i].Error = err.Error()
+			statuses[i].Code = errorCode(err)
+			continue
+		}
+
+		j := jobs.create(req.RefID, requestTenant(r))
+		saveJobState(j, r, q, req.ObjectPrefix)
+		statuses[i].JobID = j.ID
+		statuses[i].Status = jobPending
+		statuses[i].StatusURL = "/status?id=" + j.ID
+		queued = append(queued, queuedItem{job: j, req: req})
+	}
+
+	log.Printf("Batch %s: %d of %d items queued, %d at a time", batchID, len(queued), len(batch.Items), concurrency)
+	go runBatch(queued, concurrency)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]any{
+		"batchId": batchID,
+		"items":   statuses,
+	})
+}
+
+type queuedItem struct {
+	job *job
+	req convertRequest
+}
+
+// parseBatchItem validates item exactly as /convert would validate the
+// equivalent query string.
+func parseBatchItem(r *http.Request, item batchItem) (convertRequest, url.Values, error) {
+	q := url.Values{}
+	for key, value := range item.Params {
+		q.Set(key, value)
+	}
+	q.Set("url", item.URL)
+	// Batch items always run in the background
+	q.Set("async", "true")
+	if q.Get("debug") != "" {
+		return convertRequest{}, nil, errors.New("'debug' isn't supported in batches")
+	}
+
+	if err := apiSpec.validateQuery("/convert", http.MethodGet, q); err != nil {
+		return convertRequest{}, nil, err
+	}
+
+	itemRequest := r.Clone(r.Context())
+	itemRequest.URL = &url.URL{Path: "/convert", RawQuery: q.Encode()}
+	req, err := parseConvertRequest(itemRequest)
+	return req, q, err
+}
+
+// runBatch feeds items into the global conversion queue, holding at most
+// concurrency of them in it at a time. An item that finds the queue full
+// waits QUEUE_RETRY_AFTER and tries again rather than failing, until it is
+// cancelled.
+func runBatch(items []queuedItem, concurrency int) {
+	slots := make(chan struct{}, concurrency)
+	for _, item := range items {
+		if item.job.cancelled() {
+			// Cancelled before it ever reached the queue
+			forgetJobState(item.job.ID)
+			finishCancelled(item.job)
+			continue
+		}
+		slots <- struct{}{}
+
+		t, ok := enqueueBatchItem(item.job)
+		if !ok {
+			// Cancelled while waiting for room in the queue
+			<-slots
+			forgetJobState(item.job.ID)
+			finishCancelled(item.job)
+			continue
+		}
+		item.job.setTicket(t)
+
+		go func() {
+			defer func() { <-slots }()
+			runJob(context.Background(), item.job, item.req)
+		}()
+	}
+}
+
+// enqueueBatchItem queues j once the conversion queue has room, reporting
+// false if j is cancelled while it waits.
+func enqueueBatchItem(j *job) (*ticket, bool) {
+	for {
+		if j.cancelled() {
+			return nil, false
+		}
+		if t, err := conversions.enqueue(); err == nil {
+			return t, true
+		}
+		select {
+		case <-j.ctx.Done():
+		case <-time.After(time.Duration(queueRetryAfter) * time.Second):
+		}
+	}
+}
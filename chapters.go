@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxChapters = 100
+
+	// maxChapterTimestamp only bounds parsing; timestamps are checked
+	// against the real duration once the input is probed
+	maxChapterTimestamp = 7 * 24 * 60 * 60
+)
+
+// chapterOptions split one input into several independent HLS streams,
+// either at explicit timestamps or into Count equal chunks.
+type chapterOptions struct {
+	// Splits are the chapter start times after the first, in seconds
+	Splits []float64
+	Count  int
+}
+
+func (o chapterOptions) enabled() bool {
+	return len(o.Splits) > 0 || o.Count > 0
+}
+
+func parseChapterOptions(q url.Values) (chapterOptions, error) {
+	var opts chapterOptions
+
+	rawSplits, rawCount := q.Get("chapters"), q.Get("chapter_count")
+	switch {
+	case rawSplits != "" && rawCount != "":
+		return opts, errors.New("Only one of 'chapters' and 'chapter_count' may be set")
+	case rawSplits != "":
+		for _, raw := range strings.Split(rawSplits, ",") {
+			t, err := parseSeconds(strings.TrimSpace(raw), maxChapterTimestamp)
+			if err != nil {
+				return opts, fmt.Errorf("Invalid 'chapters': %v", err)
+			}
+			if n := len(opts.Splits); n > 0 && t <= opts.Splits[n-1] {
+				return opts, errors.New("Invalid 'chapters': timestamps must be in increasing order")
+			}
+			opts.Splits = append(opts.Splits, t)
+		}
+		if len(opts.Splits)+1 > maxChapters {
+			return opts, fmt.Errorf("Invalid 'chapters': at most %d chapters are allowed", maxChapters)
+		}
+	case rawCount != "":
+		n, err := strconv.Atoi(rawCount)
+		if err != nil || n < 2 || n > maxChapters {
+			return opts, fmt.Errorf("Invalid 'chapter_count', expected 2-%d", maxChapters)
+		}
+		opts.Count = n
+	}
+
+	return opts, nil
+}
+
+type chapterSpan struct {
+	Start float64
+	End   float64
+}
+
+// spans turns the options into [start, end) ranges covering the whole input.
+func (o chapterOptions) spans(duration float64) ([]chapterSpan, error) {
+	if duration <= 0 {
+		return nil, withStatus(http.StatusBadRequest, errors.New("Cannot split into chapters: input duration is unknown"))
+	}
+
+	starts := []float64{0}
+	if o.Count > 0 {
+		for i := 1; i < o.Count; i++ {
+			starts = append(starts, duration*float64(i)/float64(o.Count))
+		}
+	} else {
+		if last := o.Splits[len(o.Splits)-1]; last >= duration {
+			return nil, withStatus(http.StatusBadRequest, fmt.Errorf("Chapter timestamp %gs is beyond the input duration (%.3fs)", last, duration))
+		}
+		starts = append(starts, o.Splits...)
+	}
+
+	spans := make([]chapterSpan, len(starts))
+	for i, start := range starts {
+		end := duration
+		if i+1 < len(starts) {
+			end = starts[i+1]
+		}
+		spans[i] = chapterSpan{Start: start, End: end}
+	}
+	return spans, nil
+}
+
+type chapterResult struct {
+	Index       int      `json:"index"`
+	Start       float64  `json:"start"`
+	End         float64  `json:"end"`
+	URL         string   `json:"url"`
+	MasterURL   string   `json:"masterUrl,omitempty"`
+	ManifestURL string   `json:"manifestUrl,omitempty"`
+	Parts       []string `json:"parts,omitempty"`
+}
+
+// cutChapter copies span out of inputPath without re-encoding; the chapter
+// is encoded once, by the HLS step.
+func cutChapter(ctx context.Context, inputPath string, outputPath string, span chapterSpan) error {
+	cmd := ffmpegCommand(
+		"-i", inputPath,
+		"-ss", formatSeconds(span.Start),
+		"-to", formatSeconds(span.End),
+		"-c", "copy",
+		outputPath,
+	)
+	if err := runFFmpeg(ctx, cmd); err != nil {
+		return fmt.Errorf("FFmpeg chapter cut failed: %w", err)
+	}
+	return nil
+}
+
+// convertChapters packages each chapter of inputPath as its own HLS stream
+// under <prefix>chapter_NN/, each with its own manifest. Chapters aren't
+// spooled: if any upload fails the job fails.
+func convertChapters(ctx context.Context, jobID string, req convertRequest, workingDir string, inputPath string, onProgress func(percent float64, known bool)) (conversionResult, error) {
+	info, err := probeInput(inputPath)
+	if err != nil {
+		return conversionResult{}, fmt.Errorf("Failed to probe input for chapters: %w", err)
+	}
+	spans, err := req.Chapters.spans(info.Duration)
+	if err != nil {
+		return conversionResult{}, err
+	}
+
+	var result conversionResult
+	for i, span := range spans {
+		name := fmt.Sprintf("chapter_%02d", i+1)
+		chapterDir := filepath.Join(workingDir, name)
+		if err := os.Mkdir(chapterDir, 0o755); err != nil {
+			return conversionResult{}, errors.New("Failed to create temp directory")
+		}
+
+		chapterInput := filepath.Join(workingDir, name+req.InputExt)
+		if err := cutChapter(ctx, inputPath, chapterInput, span); err != nil {
+			return conversionResult{}, err
+		}
+
+		chapterProgress := func(percent float64, known bool) {
+			if onProgress != nil {
+				onProgress((float64(i)*100+percent)/float64(len(spans)), known)
+			}
+		}
+		output, err := transcodeHLS(ctx, chapterInput, chapterDir, req.Encode, req.HLS, chapterProgress)
+		os.Remove(chapterInput)
+		if err != nil {
+			return conversionResult{}, fmt.Errorf("Chapter %d: %w", i+1, err)
+		}
+
+		prefix := req.ObjectPrefix + name + "/"
+		m := &manifest{
+			JobID:           jobID,
+			RefID:           req.RefID,
+			CreatedAt:       time.Now().UTC(),
+			Protocol:        req.Protocol,
+			DurationSeconds: output.Duration,
+			Codec:           output.Codec,
+			Codecs:          output.Codecs,
+			Bitrate:         output.Bitrate,
+		}
+		m.Parts = partURLs(prefix, output.Parts)
+		m.PartMasters = partURLs(prefix, output.PartMasters)
+		uploaded, err := uploadOutput(ctx, chapterDir, prefix, filepath.Base(output.Path), m, req.Upload, req.Resume)
+		if err != nil {
+			err = stageError(codeUploadFailed, err)
+			if ctx.Err() != nil {
+				// The chapters already published go too, rather than
+				// leaving part of a cancelled job behind
+				for _, chapter := range result.Chapters {
+					removeObjectsUnder(fmt.Sprintf("%schapter_%02d/", req.ObjectPrefix, chapter.Index))
+				}
+			}
+			return conversionResult{}, fmt.Errorf("Chapter %d: %w", i+1, err)
+		}
+		if req.HLS.ListSize > 0 && !uploaded.Fallback {
+			pruneRolledOffSegments(output.Path, prefix)
+		}
+
+		result.Codec, result.Bitrate = output.Codec, output.Bitrate
+		for _, warning := range output.Warnings {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("Chapter %d: %s", i+1, warning))
+		}
+		result.Chapters = append(result.Chapters, chapterResult{
+			Index:       i + 1,
+			Start:       span.Start,
+			End:         span.End,
+			URL:         uploaded.URL,
+			MasterURL:   uploaded.MasterURL,
+			ManifestURL: uploaded.ManifestURL,
+			Parts:       m.Parts,
+		})
+	}
+
+	log.Printf("✅ %d chapters available under %s", len(result.Chapters), req.ObjectPrefix)
+	return result, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// maxConcatSources bounds how many sources one request may join, counting
+// the 'url' source.
+const maxConcatSources = 20
+
+// concatInputs downloads every source of req, checks that each decodes to
+// audio, and joins them in order into a single input in workingDir.
+//
+// The sources are decoded and joined with ffmpeg's concat filter rather
+// than the concat demuxer: the demuxer needs identical codec parameters in
+// every file, while the filter lets each source be resampled to a common
+// rate and layout first. The joined file is PCM so the HLS step encodes
+// the audio to AAC exactly once.
+func concatInputs(ctx context.Context, workingDir string, req convertRequest) (string, error) {
+	// The sources are kept out of workingDir, whose contents get uploaded
+	sourceDir, err := os.MkdirTemp("", "hls-inputs-")
+	if err != nil {
+		return "", errors.New("Failed to create temp directory")
+	}
+	defer os.RemoveAll(sourceDir)
+
+	sources := append([]string{req.SourceURL}, req.ConcatURLs...)
+	paths := make([]string, len(sources))
+	infos := make([]mediaInfo, len(sources))
+	for i, sourceURL := range sources {
+		ext, _ := detectInputExt(sourceURL)
+		paths[i] = filepath.Join(sourceDir, fmt.Sprintf("source_%02d%s", i+1, ext))
+		if err := fetchSource(ctx, paths[i], sourceURL, nil); err != nil {
+			return "", fmt.Errorf("Failed to download source %d: %w", i+1, err)
+		}
+		if err := checkInputSize(paths[i]); err != nil {
+			return "", fmt.Errorf("Source %d: %w", i+1, err)
+		}
+		if err := sniffInput(paths[i]); err != nil {
+			return "", fmt.Errorf("Source %d: %w", i+1, err)
+		}
+		if paths[i], err = applyInputOptions(ctx, paths[i], req.InputArgs); err != nil {
+			return "", fmt.Errorf("Source %d: %w", i+1, err)
+		}
+
+		infos[i], err = probeInput(paths[i])
+		if err != nil {
+			return "", fmt.Errorf("Failed to probe source %d: %w", i+1, err)
+		}
+		if infos[i].Codec == "" {
+			return "", withCode(codeBadInput, withStatus(http.StatusBadRequest, fmt.Errorf("Source %d has no audio stream", i+1)))
+		}
+	}
+
+	inputPath := filepath.Join(workingDir, "input.wav")
+	args := concatArgs(paths, infos)
+	if err := runFFmpeg(ctx, ffmpegCommand(append(args, "-c:a", "pcm_s16le", inputPath)...)); err != nil {
+		return "", fmt.Errorf("FFmpeg concatenation failed: %w", err)
+	}
+
+	log.Printf("🔗 Joined %d sources", len(sources))
+	return inputPath, nil
+}
+
+// concatArgs builds the ffmpeg inputs and filter graph joining paths. Every
+// source is resampled to the highest sample rate among them and brought to
+// a common layout: mono if all sources are mono, stereo otherwise.
+func concatArgs(paths []string, infos []mediaInfo) []string {
+	rate, layout := 0, "mono"
+	for _, info := range infos {
+		rate = max(rate, info.SampleRate)
+		if outputChannels(info.Channels) != 1 {
+			layout = "stereo"
+		}
+	}
+	if rate == 0 {
+		rate = 48000
+	}
+
+	var args []string
+	var graph, labels strings.Builder
+	for i, path := range paths {
+		args = append(args, "-i", path)
+
+		filters := []string{}
+		if downmix := downmixFilter(infos[i].Channels); downmix != "" {
+			filters = append(filters, downmix)
+		}
+		filters = append(filters,
+			"aresample="+strconv.Itoa(rate),
+			"aformat=sample_fmts=s16:channel_layouts="+layout,
+		)
+		fmt.Fprintf(&graph, "[%d:a:0]%s[a%d];", i, strings.Join(filters, ","), i)
+		fmt.Fprintf(&labels, "[a%d]", i)
+	}
+	fmt.Fprintf(&graph, "%sconcat=n=%d:v=0:a=1[out]", labels.String(), len(paths))
+
+	return append(args, "-filter_complex", graph.String(), "-map", "[out]", "-vn")
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// sourceIndexPrefix holds one record per refId of the source it was last
+// converted from, so a retried request can be answered without redoing it.
+const sourceIndexPrefix = "source-index/"
+
+// sourceValidators identify a version of the source as its origin reports it.
+type sourceValidators struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+}
+
+func (v sourceValidators) known() bool {
+	return v.ETag != "" || v.LastModified != ""
+}
+
+type sourceRecord struct {
+	RefID       string           `json:"refId"`
+	Source      sourceValidators `json:"source"`
+	Options     string           `json:"options"`
+	URL         string           `json:"url"`
+	ManifestURL string           `json:"manifestUrl,omitempty"`
+	ConvertedAt time.Time        `json:"convertedAt"`
+}
+
+// conversionOptions canonicalizes the query parameters that shape the
+// output, so a repeat with different options isn't mistaken for a retry.
+func conversionOptions(q url.Values) string {
+	options := url.Values{}
+	for name, values := range q {
+		switch name {
+		case "url", "refId", "async", "force", "stream_progress", "inline_playlist":
+			continue
+		}
+		options[name] = values
+	}
+	return options.Encode()
+}
+
+// headSource fetches the source's validators. Presigned URLs are only
+// signed for GET, so a refused HEAD is retried as a one-byte ranged GET.
+func headSource(sourceURL string) (sourceValidators, error) {
+	if bucket, key, ok := s3Source(sourceURL); ok {
+		client, err := newMinioClient()
+		if err != nil {
+			return sourceValidators{}, err
+		}
+		info, err := client.StatObject(context.Background(), bucket, key, minio.StatObjectOptions{})
+		if err != nil {
+			return sourceValidators{}, err
+		}
+		return sourceValidators{ETag: info.ETag, LastModified: info.LastModified.UTC().Format(http.TimeFormat)}, nil
+	}
+
+	resp, err := sourceRequest(http.MethodHead, sourceURL, nil)
+	if err == nil && (resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusMethodNotAllowed) {
+		resp.Body.Close()
+		resp, err = sourceRequest(http.MethodGet, sourceURL, http.Header{"Range": {"bytes=0-0"}})
+	}
+	if err != nil {
+		return sourceValidators{}, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return sourceValidators{}, errors.New("source URL responded with " + resp.Status)
+	}
+	return sourceValidators{ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}, nil
+}
+
+func sourceRequest(method string, sourceURL string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, sourceURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if downloadUserAgent != "" {
+		req.Header.Set("User-Agent", downloadUserAgent)
+	}
+	for name, value := range downloadHeaders {
+		req.Header.Set(name, value)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	return downloadClient.Do(req)
+}
+
+func sourceRecordName(refID string) string {
+	return sourceIndexPrefix + url.PathEscape(refID) + ".json"
+}
+
+func loadSourceRecord(refID string) (*sourceRecord, error) {
+	raw, err := getObjectBytes(sourceRecordName(refID))
+	if err != nil {
+		return nil, err
+	}
+	var record sourceRecord
+	if err := json.Unmarshal(raw, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func saveSourceRecord(record sourceRecord) {
+	body, err := json.Marshal(record)
+	if err == nil {
+		err = putObjectBytes(sourceRecordName(record.RefID), body, objectOptions{})
+	}
+	if err != nil {
+		log.Println("Failed to record source for refId", record.RefID, err)
+	}
+}
+
+// unchangedSource returns the earlier result for req's refId when the
+// source and options are the same as last time. Any lookup failure just
+// means the conversion runs.
+func unchangedSource(req convertRequest, validators sourceValidators) (conversionResult, bool) {
+	if req.RefID == "" || req.Force || !validators.known() {
+		return conversionResult{}, false
+	}
+
+	record, err := loadSourceRecord(req.RefID)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+			log.Println("Failed to read source record for refId", req.RefID, err)
+		}
+		return conversionResult{}, false
+	}
+	if record.Source != validators || record.Options != req.Options {
+		return conversionResult{}, false
+	}
+
+	return conversionResult{URL: record.URL, ManifestURL: record.ManifestURL, Skipped: true}, true
+}
+
+// contentPrefixRoot is where prefix_mode=content outputs live, one prefix
+// per distinct input and options, so identical uploads under different
+// refIds share a single output.
+const contentPrefixRoot = "by-content/"
+
+// contentObjectPrefix names the output of the input whose SHA-256 is sum
+// when converted with options. The options are part of the key since the
+// same input converted differently is a different output.
+func contentObjectPrefix(base string, sum []byte, options string) string {
+	optionsSum := sha256.Sum256([]byte(options))
+	return base + hex.EncodeToString(sum) + "-" + hex.EncodeToString(optionsSum[:6]) + "/"
+}
+
+// existingOutput returns the result already published under prefix, read
+// from its manifest. Any lookup failure just means the conversion runs.
+func existingOutput(prefix string) (conversionResult, bool) {
+	raw, err := getObjectBytes(prefix + manifestName)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+			log.Println("Failed to read manifest under", prefix, err)
+		}
+		return conversionResult{}, false
+	}
+	var m manifest
+	if err := json.Unmarshal(raw, &m); err != nil {
+		log.Println("Ignoring unreadable manifest under", prefix, err)
+		return conversionResult{}, false
+	}
+
+	result := conversionResult{
+		URL:         m.PlaylistURL,
+		MasterURL:   m.MasterURL,
+		ManifestURL: publicObjectURL(prefix + manifestName),
+		Loudness:    m.Loudness,
+		Skipped:     true,
+	}
+	if m.FileURL != "" {
+		result.URL = m.FileURL
+	}
+	result.Parts = m.Parts
+	return result, result.URL != ""
+}
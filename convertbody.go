@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+)
+
+// jobParams are the /convert parameters that describe the job itself and
+// sit at the top level of a POST body; encodeParams go under "encode" and
+// every other parameter under "output".
+var (
+	jobParams    = []string{"url", "refId", "async", "force", "stream_progress", "inline_playlist", "concat_url", "input_options", "delete_source", "debug"}
+	encodeParams = []string{"bitrate", "fade_in", "fade_out", "copy_if_aac", "mode", "replaygain"}
+)
+
+// handleConvertBody accepts POST /convert with the options as a JSON
+// object, {"url": ..., "refId": ..., "encode": {...}, "output": {...}}.
+// The body is flattened into the equivalent query parameters, with any
+// actual query parameters overriding it, validated exactly like GET
+// /convert and then handled as that request. A POST without a body
+// carries its options in the query alone, as it did before bodies were
+// accepted.
+func handleConvertBody(w http.ResponseWriter, r *http.Request) {
+	var body map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+		writeBodyError(w, "options", err)
+		return
+	}
+
+	q, err := bodyParams(body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeBadInput, err.Error())
+		return
+	}
+	for name, values := range r.URL.Query() {
+		q[name] = values
+	}
+
+	if err := apiSpec.validateQuery("/convert", http.MethodGet, q); err != nil {
+		writeError(w, http.StatusBadRequest, codeBadInput, err.Error())
+		return
+	}
+
+	r.URL.RawQuery = q.Encode()
+	handleConvert(w, r)
+}
+
+// bodyParams flattens a POST /convert body into query parameters.
+func bodyParams(body map[string]json.RawMessage) (url.Values, error) {
+	q := url.Values{}
+	for name, raw := range body {
+		switch {
+		case name == "encode" || name == "output":
+			var group map[string]json.RawMessage
+			if err := json.Unmarshal(raw, &group); err != nil {
+				return nil, fmt.Errorf("'%s' must be an object", name)
+			}
+			for option, raw := range group {
+				if slices.Contains(jobParams, option) || slices.Contains(encodeParams, option) != (name == "encode") {
+					return nil, fmt.Errorf("Unknown %s option '%s'", name, option)
+				}
+				if err := addBodyParam(q, option, raw); err != nil {
+					return nil, err
+				}
+			}
+		case slices.Contains(jobParams, name):
+			if err := addBodyParam(q, name, raw); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("Unknown field '%s'; encoding options go under 'encode' and the rest under 'output'", name)
+		}
+	}
+	return q, nil
+}
+
+// addBodyParam sets name to raw's value as the query string would carry
+// it. Arrays become repeated parameters and objects, like metadata, are
+// passed on as JSON.
+func addBodyParam(q url.Values, name string, raw json.RawMessage) error {
+	var value any
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return fmt.Errorf("Invalid '%s': %v", name, err)
+	}
+
+	values, ok := value.([]any)
+	if !ok {
+		values = []any{value}
+	}
+	for _, v := range values {
+		switch v := v.(type) {
+		case nil:
+		case string:
+			q.Add(name, v)
+		case bool:
+			q.Add(name, strconv.FormatBool(v))
+		case float64:
+			q.Add(name, strconv.FormatFloat(v, 'f', -1, 64))
+		case map[string]any:
+			if _, isArray := value.([]any); isArray {
+				return fmt.Errorf("Invalid '%s': expected an array of strings or numbers", name)
+			}
+			q.Add(name, string(raw))
+		default:
+			return fmt.Errorf("Invalid '%s': expected a string, number or boolean", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// A POST with its options in the query and no body is handled like the
+// query-only POSTs /convert took before it accepted bodies.
+func TestConvertBodyFallsBackToQuery(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		body    string
+		chunked bool
+		want    string
+	}{
+		{name: "empty body", query: "url=https://cdn.example/a.wav&bitrates=128k", want: "Unknown query parameter 'bitrates'"},
+		{name: "chunked empty body", query: "url=https://cdn.example/a.wav&bitrates=128k", chunked: true, want: "Unknown query parameter 'bitrates'"},
+		{name: "query reaches the handler", query: "url=https://cdn.example/a.wav&async=true&stream_progress=true", want: "'stream_progress' only applies"},
+		{name: "body", query: "stream_progress=true", body: `{"url": "https://cdn.example/a.wav", "async": true}`, want: "'stream_progress' only applies"},
+		{name: "malformed body", query: "url=https://cdn.example/a.wav", body: `{"url":`, want: "Invalid options body"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/convert?"+tt.query, strings.NewReader(tt.body))
+		if tt.chunked {
+			r.ContentLength = -1
+		}
+		w := httptest.NewRecorder()
+		handleConvertBody(w, r)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), tt.want) {
+			t.Errorf("%s: %d %s, want 400 %q", tt.name, w.Code, strings.TrimSpace(w.Body.String()), tt.want)
+		}
+	}
+}
@@ -0,0 +1,541 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+var (
+	downloadClient    *http.Client
+	downloadUserAgent string
+	downloadHeaders   map[string]string
+
+	downloadTimeout         time.Duration
+	downloadMaxIdlePerHost  int
+	downloadMaxConnsPerHost int
+
+	// downloadBufferSize is DOWNLOAD_BUFFER_KB in bytes; zero keeps io.Copy's
+	// default buffer
+	downloadBufferSize int
+
+	// sniffInputs is INPUT_SNIFF: check that downloaded bytes look like
+	// audio before ffmpeg sees them
+	sniffInputs bool
+
+	// minInputSize is MIN_INPUT_BYTES: a download smaller than this can't be
+	// playable audio, whatever its extension says
+	minInputSize int64
+
+	// maxInputSize is MAX_INPUT_BYTES, the largest source accepted; zero
+	// means no limit
+	maxInputSize int64
+
+	// downloadRetries is DOWNLOAD_RETRIES: how many more times a download
+	// cut off by the network is started over, waiting DOWNLOAD_RETRY_BACKOFF
+	// and then twice as long each time
+	downloadRetries      int
+	downloadRetryBackoff time.Duration
+
+	// downloadMaxRedirects is DOWNLOAD_MAX_REDIRECTS: how many redirects a
+	// source fetch follows; zero refuses them all
+	downloadMaxRedirects int
+
+	// downloadBlockPrivate is DOWNLOAD_BLOCK_PRIVATE_NETWORKS: whether
+	// source fetches are kept off non-public addresses, see guardSourceDial.
+	// It is off by default since presigned URLs usually point at a MinIO on
+	// the same network.
+	downloadBlockPrivate bool
+
+	// downloadAllowedNetworks is DOWNLOAD_ALLOWED_NETWORKS, the non-public
+	// ranges source fetches may still connect to when downloadBlockPrivate
+	// is set, such as MinIO or an internal origin. Through a proxy the dial
+	// is to the proxy, so an internal one has to be listed, and the
+	// origin's address is the proxy's to vet.
+	downloadAllowedNetworks []*net.IPNet
+)
+
+// errBlockedAddress is a source connection refused by guardSourceDial.
+var errBlockedAddress = errors.New("source address is not publicly routable")
+
+// errInputTooLarge is returned for a source over MAX_INPUT_BYTES. read is
+// its Content-Length when the origin sent one, or -1 when the limit was
+// only hit while copying.
+func errInputTooLarge(read int64) error {
+	msg := fmt.Sprintf("Source is larger than the %d byte limit", maxInputSize)
+	if read >= 0 {
+		msg = fmt.Sprintf("Source is %d bytes, over the %d byte limit", read, maxInputSize)
+	}
+	return withCode(codeBadInput, withStatus(http.StatusBadRequest, errors.New(msg)))
+}
+
+// checkInputSize rejects an empty or implausibly small download, typically
+// an origin answering 200 with no body, before ffmpeg fails on it with a
+// decode error.
+func checkInputSize(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return withCode(codeBadInput, withStatus(http.StatusBadRequest, errors.New("Source is empty (0 bytes downloaded)")))
+	}
+	if info.Size() < minInputSize {
+		return withCode(codeBadInput, withStatus(http.StatusBadRequest, fmt.Errorf("Source is too small to be audio: %d bytes downloaded, at least %d expected", info.Size(), minInputSize)))
+	}
+	return nil
+}
+
+// sniffInput rejects a downloaded file whose leading bytes identify it as
+// something other than audio, e.g. an image or an HTML error page saved
+// under a .wav name. http.DetectContentType doesn't recognise every audio
+// format: raw ADTS and ID3-less MP3 frames come back as octet-stream, or as
+// text/plain when the first bytes happen to contain no control characters.
+// So only types that are positively not audio are refused.
+func sniffInput(path string) error {
+	if !sniffInputs {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			return withCode(codeBadInput, withStatus(http.StatusBadRequest, errors.New("Source is empty")))
+		}
+		return err
+	}
+
+	contentType := http.DetectContentType(head[:n])
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	switch {
+	case strings.HasPrefix(mediaType, "audio/"),
+		strings.HasPrefix(mediaType, "video/"),
+		mediaType == "application/ogg",
+		mediaType == "application/octet-stream",
+		mediaType == "text/plain":
+		return nil
+	}
+	return withCode(codeUnsupportedFormat, withStatus(http.StatusBadRequest, fmt.Errorf("Source doesn't look like audio (detected %s)", mediaType)))
+}
+
+// parseDownloadHeaders reads DOWNLOAD_HEADERS, a JSON object of extra
+// headers to send with every source fetch.
+func parseDownloadHeaders(raw string) (map[string]string, error) {
+	if raw == "" {
+		return nil, nil
+	}
+
+	var headers map[string]string
+	if err := json.Unmarshal([]byte(raw), &headers); err != nil {
+		return nil, err
+	}
+	return headers, nil
+}
+
+// newDownloadClient builds the client shared by every source fetch. Outbound
+// requests honor HTTP_PROXY/HTTPS_PROXY/NO_PROXY unless proxyOverride is set,
+// in which case every fetch goes through that proxy. Batches usually pull
+// from one origin, so more idle connections are kept per host than the
+// default transport's two.
+func newDownloadClient(proxyOverride string) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	transport.MaxIdleConns = 100
+	transport.MaxIdleConnsPerHost = downloadMaxIdlePerHost
+	transport.MaxConnsPerHost = downloadMaxConnsPerHost
+	transport.IdleConnTimeout = 90 * time.Second
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: guardSourceDial}
+	transport.DialContext = dialer.DialContext
+
+	if proxyOverride != "" {
+		proxyURL, err := url.Parse(proxyOverride)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	return &http.Client{Transport: transport, Timeout: downloadTimeout, CheckRedirect: checkSourceRedirect}, nil
+}
+
+// guardSourceDial refuses connections to loopback, private, link-local,
+// unspecified and multicast addresses outside DOWNLOAD_ALLOWED_NETWORKS,
+// when DOWNLOAD_BLOCK_PRIVATE_NETWORKS is set. It runs on the resolved address of every dial, redirect hops included,
+// so a name that resolves, or is rebound, to an internal host is caught
+// too.
+func guardSourceDial(network string, address string, _ syscall.RawConn) error {
+	if !downloadBlockPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("unexpected dial address %q", address)
+	}
+	if !isPublicIP(ip) && !slices.ContainsFunc(downloadAllowedNetworks, func(n *net.IPNet) bool { return n.Contains(ip) }) {
+		return withStatus(http.StatusBadRequest, fmt.Errorf("%w: %s", errBlockedAddress, ip))
+	}
+	return nil
+}
+
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+// parseAllowedNetworks reads DOWNLOAD_ALLOWED_NETWORKS entries, CIDRs or
+// single addresses.
+func parseAllowedNetworks(entries []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("%q isn't an address or CIDR", entry)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q isn't an address or CIDR", entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// checkSourceRedirect vets every redirect hop of a source fetch like the
+// source URL itself, so a redirect can't take the download somewhere the
+// url parameter wouldn't be accepted for, nor from https down to http.
+func checkSourceRedirect(req *http.Request, via []*http.Request) error {
+	if downloadMaxRedirects == 0 {
+		return withStatus(http.StatusBadGateway, fmt.Errorf("source URL redirects to %s and DOWNLOAD_MAX_REDIRECTS is 0", req.URL.Redacted()))
+	}
+	if len(via) > downloadMaxRedirects {
+		return withStatus(http.StatusBadGateway, fmt.Errorf("source URL redirected more than %d times", downloadMaxRedirects))
+	}
+
+	prev := via[len(via)-1].URL
+	if _, err := normalizeSourceURL(req.URL.String()); err != nil || req.URL.Scheme == "s3" {
+		return withStatus(http.StatusBadGateway, fmt.Errorf("source URL redirects to an unacceptable URL %s", req.URL.Redacted()))
+	}
+	if prev.Scheme == "https" && req.URL.Scheme != "https" {
+		return withStatus(http.StatusBadGateway, fmt.Errorf("source URL redirects from https to %s", req.URL.Redacted()))
+	}
+	log.Printf("Source %s redirects to %s", prev.Redacted(), req.URL.Redacted())
+	return nil
+}
+
+// downloadFile saves url to filepath, also writing the body to sum when it
+// is set. A connection reset or similar network failure starts the download
+// over with a fresh request, see isConnectionError; a response with an
+// error status is final.
+func downloadFile(ctx context.Context, filepath string, url string, sum hash.Hash) error {
+	backoff := downloadRetryBackoff
+	for attempt := 0; ; attempt++ {
+		if sum != nil {
+			sum.Reset()
+		}
+		err := fetchURL(ctx, filepath, url, sum)
+		if err == nil || attempt >= downloadRetries || !isConnectionError(err) {
+			return err
+		}
+
+		log.Printf("Download of %s failed (%v), retrying in %s", url, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+// isConnectionError reports whether err is the network giving out mid
+// request or mid body rather than the origin answering. Timeouts aren't
+// included: DOWNLOAD_TIMEOUT bounds the whole transfer, so one means it's
+// already spent.
+func isConnectionError(err error) bool {
+	if errors.Is(err, errBlockedAddress) {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return false
+	}
+	var opErr *net.OpError
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.As(err, &opErr)
+}
+
+// fetchURL makes a single attempt at downloading url to filepath,
+// truncating whatever an earlier attempt left there.
+func fetchURL(ctx context.Context, filepath string, url string, sum io.Writer) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if downloadUserAgent != "" {
+		req.Header.Set("User-Agent", downloadUserAgent)
+	}
+	for name, value := range downloadHeaders {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := downloadClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Don't write an error page to disk as if it were the audio. Draining a
+	// little of it lets the connection go back to the pool.
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		return withStatus(originErrorStatus(resp.StatusCode), fmt.Errorf("source URL responded with %s", resp.Status))
+	}
+	// A chunked response has no Content-Length (-1), so the limit can only
+	// be enforced by the copy below
+	if maxInputSize > 0 && resp.ContentLength > maxInputSize {
+		return errInputTooLarge(resp.ContentLength)
+	}
+
+	out, err := os.Create(filepath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	body := io.Reader(resp.Body)
+	if maxInputSize > 0 {
+		// One byte over is enough to tell the source is too large
+		body = io.LimitReader(body, maxInputSize+1)
+	}
+	if sum != nil {
+		body = io.TeeReader(body, sum)
+	}
+	var written int64
+	if downloadBufferSize <= 0 {
+		written, err = io.Copy(out, body)
+	} else {
+		// *os.File's ReadFrom would fall back to io.Copy's own 32KB buffer
+		// for a response body, so hide it to make the configured buffer
+		// take effect
+		written, err = io.CopyBuffer(struct{ io.Writer }{out}, body, make([]byte, downloadBufferSize))
+	}
+	if err == nil && maxInputSize > 0 && written > maxInputSize {
+		return errInputTooLarge(-1)
+	}
+	return err
+}
+
+func copyFileTo(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// sourceSchemes are the source URL schemes a conversion can read from.
+var sourceSchemes = []string{"http", "https", "s3"}
+
+// normalizeSourceURL checks that raw is an absolute http(s) or s3:// URL
+// with a host and returns it in canonical form: surrounding whitespace
+// trimmed, scheme and host lowercased, the fragment (never sent to the
+// origin) dropped and anything unescaped, like a space, percent-encoded.
+func normalizeSourceURL(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if strings.ContainsAny(raw, "\r\n\t") {
+		return "", errors.New("must not contain control characters")
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", errors.New("not a valid URL")
+	}
+	if u.Scheme == "" {
+		return "", errors.New("missing scheme, expected http://, https:// or s3://")
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	if !slices.Contains(sourceSchemes, u.Scheme) {
+		return "", fmt.Errorf("unsupported scheme %q, expected http, https or s3", u.Scheme)
+	}
+	if u.Opaque != "" || u.Hostname() == "" {
+		return "", errors.New("missing host")
+	}
+	if port := u.Port(); port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return "", fmt.Errorf("invalid port %q", port)
+		}
+	}
+	u.Host = strings.ToLower(u.Host)
+	u.Fragment, u.RawFragment = "", ""
+	return u.String(), nil
+}
+
+// s3Source splits an s3://bucket/key source into its parts. Such sources
+// are read from the configured MinIO with its credentials.
+func s3Source(raw string) (bucket string, key string, ok bool) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
+		return "", "", false
+	}
+	key = strings.TrimPrefix(u.Path, "/")
+	if key == "" {
+		return "", "", false
+	}
+	return u.Host, key, true
+}
+
+// s3SourcePrefix is one SOURCE_S3_PREFIXES entry, bucket/prefix for every
+// caller or tenant:bucket/prefix for one tenant only.
+type s3SourcePrefix struct {
+	Tenant string
+	Bucket string
+	Prefix string
+}
+
+// sourceS3Prefixes are the only places s3:// sources may be read from.
+// They are read, and deleted with delete_source, using the service's own
+// credentials, so without any configured s3:// sources are refused.
+var sourceS3Prefixes []s3SourcePrefix
+
+func parseS3SourcePrefixes(entries []string) ([]s3SourcePrefix, error) {
+	prefixes := make([]s3SourcePrefix, 0, len(entries))
+	for _, entry := range entries {
+		var prefix s3SourcePrefix
+		location := entry
+		if tenant, rest, ok := strings.Cut(entry, ":"); ok {
+			if tenant == "" {
+				return nil, fmt.Errorf("%q names no tenant", entry)
+			}
+			prefix.Tenant, location = tenant, rest
+		}
+		prefix.Bucket, prefix.Prefix, _ = strings.Cut(location, "/")
+		if prefix.Bucket == "" {
+			return nil, fmt.Errorf("%q isn't bucket/prefix or tenant:bucket/prefix", entry)
+		}
+		if strings.Contains(prefix.Prefix, "..") {
+			return nil, fmt.Errorf("%q can't contain ..", entry)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// s3SourceAllowed reports whether tenant may read bucket/key as a source.
+func s3SourceAllowed(tenant string, bucket string, key string) bool {
+	if slices.Contains(strings.Split(key, "/"), "..") {
+		return false
+	}
+	for _, allowed := range sourceS3Prefixes {
+		if allowed.Tenant != "" && allowed.Tenant != tenant {
+			continue
+		}
+		if allowed.Bucket == bucket && strings.HasPrefix(key, allowed.Prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkS3Source rejects an s3:// source the request's tenant may not read.
+// Other sources pass.
+func checkS3Source(r *http.Request, sourceURL string) error {
+	bucket, key, ok := s3Source(sourceURL)
+	if !ok || s3SourceAllowed(requestTenant(r), bucket, key) {
+		return nil
+	}
+	return fmt.Errorf("s3:// source %s/%s is outside the allowed SOURCE_S3_PREFIXES", bucket, key)
+}
+
+func downloadObject(ctx context.Context, filepath string, bucket string, key string) error {
+	client, err := newMinioClient()
+	if err != nil {
+		return err
+	}
+
+	if maxInputSize > 0 {
+		// A failed stat is left for FGetObject to report
+		if info, err := client.StatObject(ctx, bucket, key, minio.StatObjectOptions{}); err == nil && info.Size > maxInputSize {
+			return errInputTooLarge(info.Size)
+		}
+	}
+
+	err = client.FGetObject(ctx, bucket, key, filepath, minio.GetObjectOptions{})
+	if err != nil {
+		resp := minio.ToErrorResponse(err)
+		if resp.StatusCode != 0 {
+			return withStatus(originErrorStatus(resp.StatusCode), fmt.Errorf("source object %s/%s: %s", bucket, key, resp.Code))
+		}
+		return err
+	}
+	return nil
+}
+
+// deleteSourceObject removes an s3:// source after its conversion was
+// uploaded. Failing to delete is logged but doesn't fail the job.
+func deleteSourceObject(sourceURL string) {
+	bucket, key, ok := s3Source(sourceURL)
+	if !ok {
+		return
+	}
+
+	client, err := newMinioClient()
+	if err == nil {
+		err = client.RemoveObject(context.Background(), bucket, key, minio.RemoveObjectOptions{})
+	}
+	if err != nil {
+		log.Println("Failed to delete source object", sourceURL, err)
+		return
+	}
+	log.Println("Deleted source object:", sourceURL)
+}
+
+// originErrorStatus maps a failed source fetch to the status reported to the
+// caller, so a missing or forbidden source isn't mistaken for a service error.
+func originErrorStatus(status int) int {
+	switch status {
+	case http.StatusNotFound:
+		return http.StatusNotFound
+	case http.StatusForbidden:
+		return http.StatusBadRequest
+	default:
+		return http.StatusBadGateway
+	}
+}
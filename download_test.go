@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// sourceProxy is an HTTP proxy answering every request itself, recording
+// the URLs it was asked for.
+type sourceProxy struct {
+	*httptest.Server
+	mu   sync.Mutex
+	urls []string
+}
+
+func newSourceProxy(t *testing.T, body string) *sourceProxy {
+	t.Helper()
+	p := &sourceProxy{}
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		p.urls = append(p.urls, r.URL.String())
+		p.mu.Unlock()
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(p.Close)
+	return p
+}
+
+func (p *sourceProxy) requested() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.urls...)
+}
+
+// useDownloadClient points source fetches at a client built for
+// proxyOverride, allowing loopback connections to test servers, until the
+// test ends.
+func useDownloadClient(t *testing.T, proxyOverride string) {
+	t.Helper()
+	client, err := newDownloadClient(proxyOverride)
+	if err != nil {
+		t.Fatal(err)
+	}
+	networks, err := parseAllowedNetworks([]string{"127.0.0.1", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	previousClient, previousNetworks := downloadClient, downloadAllowedNetworks
+	downloadClient, downloadAllowedNetworks = client, networks
+	t.Cleanup(func() {
+		downloadClient, downloadAllowedNetworks = previousClient, previousNetworks
+	})
+}
+
+func TestDownloadThroughProxyOverride(t *testing.T) {
+	proxy := newSourceProxy(t, "proxied audio")
+	useDownloadClient(t, proxy.URL)
+
+	path := filepath.Join(t.TempDir(), "input.wav")
+	if err := downloadFile(context.Background(), path, "http://origin.example/audio/track.wav", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, path); got != "proxied audio" {
+		t.Errorf("downloaded %q, want the proxy's response", got)
+	}
+	if got := proxy.requested(); len(got) != 1 || got[0] != "http://origin.example/audio/track.wav" {
+		t.Errorf("proxy was asked for %v, want the source URL", got)
+	}
+}
+
+// http.ProxyFromEnvironment reads the environment once per process, so
+// HTTP_PROXY is checked in a fresh one running this test again.
+func TestDownloadThroughEnvironmentProxy(t *testing.T) {
+	if source := os.Getenv("PROXY_TEST_SOURCE"); source != "" {
+		useDownloadClient(t, "")
+		path := filepath.Join(t.TempDir(), "input.wav")
+		if err := downloadFile(context.Background(), path, source, nil); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	proxy := newSourceProxy(t, "proxied audio")
+	cmd := exec.Command(os.Args[0], "-test.run=^TestDownloadThroughEnvironmentProxy$")
+	cmd.Env = append(os.Environ(), "HTTP_PROXY="+proxy.URL, "NO_PROXY=", "DOWNLOAD_RETRIES=0", "PROXY_TEST_SOURCE=http://origin.example/track.wav")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("download with HTTP_PROXY set failed: %v\n%s", err, out)
+	}
+	if got := proxy.requested(); len(got) != 1 || got[0] != "http://origin.example/track.wav" {
+		t.Errorf("proxy was asked for %v, want the source URL", got)
+	}
+
+	cmd = exec.Command(os.Args[0], "-test.run=^TestDownloadThroughEnvironmentProxy$")
+	cmd.Env = append(os.Environ(), "HTTP_PROXY="+proxy.URL, "NO_PROXY=origin.example", "DOWNLOAD_RETRIES=0", "PROXY_TEST_SOURCE=http://origin.example/track.wav")
+	if err := cmd.Run(); err == nil {
+		t.Error("download listed in NO_PROXY succeeded, want it to bypass the proxy and fail to resolve")
+	}
+	if got := proxy.requested(); len(got) != 1 {
+		t.Errorf("proxy was asked for %v, want NO_PROXY to bypass it", got)
+	}
+}
+
+// BenchmarkFetchURL downloads a large source to disk with io.Copy's default
+// buffer and with DOWNLOAD_BUFFER_KB set, to compare copy throughput.
+func BenchmarkFetchURL(b *testing.B) {
+	source := make([]byte, 64<<20)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(source)))
+		w.Write(source)
+	}))
+	defer origin.Close()
+
+	client, err := newDownloadClient("")
+	if err != nil {
+		b.Fatal(err)
+	}
+	networks, err := parseAllowedNetworks([]string{"127.0.0.1"})
+	if err != nil {
+		b.Fatal(err)
+	}
+	previousClient, previousNetworks, previousBuffer := downloadClient, downloadAllowedNetworks, downloadBufferSize
+	downloadClient, downloadAllowedNetworks = client, networks
+	defer func() {
+		downloadClient, downloadAllowedNetworks, downloadBufferSize = previousClient, previousNetworks, previousBuffer
+	}()
+
+	path := filepath.Join(b.TempDir(), "input.wav")
+	for _, kb := range []int{0, 256, 1024} {
+		b.Run("buffer="+strconv.Itoa(kb)+"KB", func(b *testing.B) {
+			downloadBufferSize = kb << 10
+			b.SetBytes(int64(len(source)))
+			for b.Loop() {
+				if err := fetchURL(context.Background(), path, origin.URL+"/input.wav", nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestNormalizeSourceURL(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    string
+		wantErr string
+	}{
+		{raw: "https://cdn.example/audio/track.wav", want: "https://cdn.example/audio/track.wav"},
+		{raw: "  https://cdn.example/track.wav\n", want: "https://cdn.example/track.wav"},
+		{raw: "HTTPS://CDN.Example/Track.wav", want: "https://cdn.example/Track.wav"},
+		{raw: "https://cdn.example/my track.wav", want: "https://cdn.example/my%20track.wav"},
+		{raw: "https://cdn.example/track.wav?sig=a%2Fb&x=1#t=10", want: "https://cdn.example/track.wav?sig=a%2Fb&x=1"},
+		{raw: "http://cdn.example:8080/track.wav", want: "http://cdn.example:8080/track.wav"},
+		{raw: "http://[2001:db8::1]/track.wav", want: "http://[2001:db8::1]/track.wav"},
+		{raw: "s3://bucket/in/track.wav", want: "s3://bucket/in/track.wav"},
+		{raw: "cdn.example/track.wav", wantErr: "missing scheme"},
+		{raw: "//cdn.example/track.wav", wantErr: "missing scheme"},
+		{raw: "ftp://cdn.example/track.wav", wantErr: "unsupported scheme"},
+		{raw: "file:///etc/passwd", wantErr: "unsupported scheme"},
+		{raw: "javascript:alert(1)", wantErr: "unsupported scheme"},
+		{raw: "https:cdn.example/track.wav", wantErr: "missing host"},
+		{raw: "https:///track.wav", wantErr: "missing host"},
+		{raw: "https://:443/track.wav", wantErr: "missing host"},
+		{raw: "https://cdn.example:0/track.wav", wantErr: "invalid port"},
+		{raw: "https://cdn.example:70000/track.wav", wantErr: "invalid port"},
+		{raw: "https://cdn.example:http/track.wav", wantErr: "not a valid URL"},
+		{raw: "https://cdn.example/a\r\nHost: internal", wantErr: "control characters"},
+		{raw: "https://cdn.example/a\tb.wav", wantErr: "control characters"},
+		{raw: "https://cdn.example/%zz.wav", wantErr: "not a valid URL"},
+		{raw: "https://[::1/track.wav", wantErr: "not a valid URL"},
+	}
+	for _, tt := range tests {
+		got, err := normalizeSourceURL(tt.raw)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("normalizeSourceURL(%q) = %q, %v, want an error mentioning %q", tt.raw, got, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("normalizeSourceURL(%q) = %q, %v, want %q", tt.raw, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseConvertRequestURL(t *testing.T) {
+	tests := []struct {
+		query   string
+		wantErr string
+	}{
+		{query: "url=https://cdn.example/track.wav"},
+		{query: "", wantErr: "Missing 'url'"},
+		{query: "url=", wantErr: "Missing 'url'"},
+		{query: "url=https://cdn.example/a.wav&url=https://cdn.example/b.wav", wantErr: "Only one 'url'"},
+		{query: "url=cdn.example/track.wav", wantErr: "Invalid 'url': missing scheme"},
+		{query: "url=ftp://cdn.example/track.wav", wantErr: "Invalid 'url': unsupported scheme"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/convert?"+tt.query, nil)
+		_, err := parseConvertRequest(r)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%q: %v", tt.query, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%q: got %v, want %q", tt.query, err, tt.wantErr)
+		}
+	}
+}
+
+// chunkedOrigin serves body in 1KB chunks, flushing each so the response
+// is chunked and carries no Content-Length.
+func chunkedOrigin(t *testing.T, body []byte) *httptest.Server {
+	t.Helper()
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for chunk := range slices.Chunk(body, 1024) {
+			w.Write(chunk)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	t.Cleanup(origin.Close)
+	return origin
+}
+
+func TestFetchURLChunkedWithoutContentLength(t *testing.T) {
+	body := []byte(strings.Repeat("audio", 2000))
+	origin := chunkedOrigin(t, body)
+	useDownloadClient(t, "")
+	previous := maxInputSize
+	t.Cleanup(func() { maxInputSize = previous })
+
+	resp, err := http.Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ContentLength != -1 || !slices.Equal(resp.TransferEncoding, []string{"chunked"}) {
+		t.Fatalf("origin sent Content-Length %d, Transfer-Encoding %v, want a chunked response", resp.ContentLength, resp.TransferEncoding)
+	}
+
+	tests := []struct {
+		limit   int64
+		wantErr bool
+	}{
+		{limit: 0},
+		{limit: int64(len(body))},
+		{limit: int64(len(body)) - 1, wantErr: true},
+		{limit: 1024, wantErr: true},
+	}
+	for _, tt := range tests {
+		maxInputSize = tt.limit
+		path := filepath.Join(t.TempDir(), "input.wav")
+		err := fetchURL(context.Background(), path, origin.URL+"/track.wav", nil)
+		if !tt.wantErr {
+			if err != nil {
+				t.Errorf("limit %d: %v", tt.limit, err)
+			} else if got := readFile(t, path); got != string(body) {
+				t.Errorf("limit %d: downloaded %d bytes, want all %d", tt.limit, len(got), len(body))
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("limit %d: downloaded a %d byte source, want it refused", tt.limit, len(body))
+			continue
+		}
+		if status, code := errorStatus(err), errorCode(err); status != http.StatusBadRequest || code != codeBadInput {
+			t.Errorf("limit %d: %d %s (%v), want 400 %s", tt.limit, status, code, err, codeBadInput)
+		}
+		if want := fmt.Sprintf("larger than the %d byte limit", tt.limit); !strings.Contains(err.Error(), want) {
+			t.Errorf("limit %d: %v, want %q", tt.limit, err, want)
+		}
+	}
+}
+
+func TestParseConvertRequestS3Source(t *testing.T) {
+	prefixes, err := parseS3SourcePrefixes([]string{"uploads/shared/", "acme:uploads/acme/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	previousPrefixes, previousKeys := sourceS3Prefixes, apiKeys
+	sourceS3Prefixes, apiKeys = prefixes, parseAPIKeys([]string{"acme:acme-key", "globex:globex-key", "bare-key"})
+	t.Cleanup(func() { sourceS3Prefixes, apiKeys = previousPrefixes, previousKeys })
+
+	tests := []struct {
+		key     string
+		query   string
+		wantErr string
+	}{
+		{query: "url=s3://uploads/shared/track.wav"},
+		{key: "acme-key", query: "url=s3://uploads/acme/track.wav"},
+		{query: "url=s3://uploads/acme/track.wav", wantErr: "outside the allowed SOURCE_S3_PREFIXES"},
+		{key: "globex-key", query: "url=s3://uploads/acme/track.wav", wantErr: "outside the allowed SOURCE_S3_PREFIXES"},
+		{key: "acme-key", query: "url=s3://converted/acme/track.wav", wantErr: "outside the allowed SOURCE_S3_PREFIXES"},
+		{key: "acme-key", query: "url=s3://uploads/shared/../acme/track.wav", wantErr: "outside the allowed SOURCE_S3_PREFIXES"},
+		{key: "acme-key", query: "url=https://cdn.example/a.wav&concat_url=s3://uploads/globex/b.wav", wantErr: "Invalid 'concat_url'"},
+		{key: "acme-key", query: "url=s3://uploads/acme/track.wav&delete_source=true"},
+		{query: "url=s3://uploads/shared/track.wav&delete_source=true", wantErr: "requires an API key with a tenant"},
+		{key: "bare-key", query: "url=s3://uploads/shared/track.wav&delete_source=true", wantErr: "requires an API key with a tenant"},
+		{key: "wrong-key", query: "url=s3://uploads/shared/track.wav&delete_source=true", wantErr: "requires an API key with a tenant"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/convert?"+tt.query, nil)
+		if tt.key != "" {
+			r.Header.Set("X-API-Key", tt.key)
+		}
+		_, err := parseConvertRequest(r)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s with %q: %v", tt.query, tt.key, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s with %q: got %v, want %q", tt.query, tt.key, err, tt.wantErr)
+		}
+	}
+}
+
+func TestParseS3SourcePrefixes(t *testing.T) {
+	got, err := parseS3SourcePrefixes([]string{"uploads", "uploads/in/", "acme:uploads/acme/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []s3SourcePrefix{{Bucket: "uploads"}, {Bucket: "uploads", Prefix: "in/"}, {Tenant: "acme", Bucket: "uploads", Prefix: "acme/"}}
+	if !slices.Equal(got, want) {
+		t.Errorf("parseS3SourcePrefixes = %+v, want %+v", got, want)
+	}
+	for _, bad := range []string{":uploads/in/", "/in/", "acme:", "uploads/../in/"} {
+		if _, err := parseS3SourcePrefixes([]string{bad}); err == nil {
+			t.Errorf("parseS3SourcePrefixes(%q) succeeded, want an error", bad)
+		}
+	}
+}
+
+func TestGuardSourceDial(t *testing.T) {
+	networks, err := parseAllowedNetworks([]string{"10.1.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	previousBlock, previousNetworks := downloadBlockPrivate, downloadAllowedNetworks
+	downloadAllowedNetworks = networks
+	t.Cleanup(func() { downloadBlockPrivate, downloadAllowedNetworks = previousBlock, previousNetworks })
+
+	tests := []struct {
+		block   bool
+		address string
+		blocked bool
+	}{
+		{address: "127.0.0.1:9000"},
+		{address: "192.168.1.10:443"},
+		{block: true, address: "203.0.113.7:443"},
+		{block: true, address: "10.1.2.3:9000"},
+		{block: true, address: "127.0.0.1:9000", blocked: true},
+		{block: true, address: "[::1]:9000", blocked: true},
+		{block: true, address: "10.2.0.1:443", blocked: true},
+		{block: true, address: "169.254.169.254:80", blocked: true},
+	}
+	for _, tt := range tests {
+		downloadBlockPrivate = tt.block
+		err := guardSourceDial("tcp", tt.address, nil)
+		if blocked := errors.Is(err, errBlockedAddress); blocked != tt.blocked || (err != nil && !blocked) {
+			t.Errorf("block=%t: dial to %s returned %v, want blocked=%t", tt.block, tt.address, err, tt.blocked)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const defaultBitrate = "192k"
+
+// maxFadeDuration bounds fade_in/fade_out before the input is even probed
+const maxFadeDuration = 600
+
+// encodeOptions control how the audio itself is encoded, independent of
+// whether it is packaged as HLS or a single file.
+type encodeOptions struct {
+	// Bitrate is an explicit AAC/MP3 bitrate like "128k", or "auto" to
+	// pick one from the source's channel count and sample rate.
+	Bitrate string
+
+	FadeIn  float64
+	FadeOut float64
+
+	// CopyIfAAC passes AAC sources through untouched when nothing needs
+	// re-encoding, see canCopy.
+	CopyIfAAC bool
+
+	// Remux is mode=remux: copy the source's audio into the segments as is
+	// whenever it can be carried in TS, see remuxBlocker.
+	Remux bool
+
+	// Tags are written as metadata into single-file outputs; HLS segments
+	// can't carry them
+	Tags map[string]string
+}
+
+var bitratePattern = regexp.MustCompile(`^([0-9]+)k$`)
+
+const (
+	minBitrateKbps = 32
+	maxBitrateKbps = 320
+)
+
+// bitrateKbps reads an explicit bitrate like "128k", reporting false for
+// anything else or one outside minBitrateKbps-maxBitrateKbps.
+func bitrateKbps(raw string) (int, bool) {
+	m := bitratePattern.FindStringSubmatch(raw)
+	if m == nil {
+		return 0, false
+	}
+	kbps, err := strconv.Atoi(m[1])
+	return kbps, err == nil && kbps >= minBitrateKbps && kbps <= maxBitrateKbps
+}
+
+// Surround sources are downmixed to stereo with an explicit pan matrix.
+// ffmpeg's own rematrixing normalizes the sum and can come out noticeably
+// quiet. The defaults are the ITU-R BS.775 coefficients with the LFE dropped;
+// DOWNMIX_CENTER, DOWNMIX_SURROUND_LEVEL and DOWNMIX_LFE override them, and
+// DOWNMIX_SURROUND=false turns the downmix off.
+var (
+	surroundDownmix = true
+	downmixCenter   = 0.707
+	downmixSurround = 0.707
+	downmixLFE      = 0.0
+)
+
+// downmixFilter returns the pan filter folding a channels-wide source down
+// to stereo, or "" when none is needed. 5.1 and 7.1 are mapped by channel
+// index (FL FR FC LFE, then back/side pairs), which holds for both the
+// back and side variants of those layouts. Other surround counts fall back
+// to ffmpeg's default downmix.
+func downmixFilter(channels int) string {
+	if !surroundDownmix || channels <= 2 {
+		return ""
+	}
+
+	center := strconv.FormatFloat(downmixCenter, 'f', -1, 64)
+	surround := strconv.FormatFloat(downmixSurround, 'f', -1, 64)
+	lfe := strconv.FormatFloat(downmixLFE, 'f', -1, 64)
+	switch channels {
+	case 6:
+		return "pan=stereo" +
+			"|FL=c0+" + center + "*c2+" + lfe + "*c3+" + surround + "*c4" +
+			"|FR=c1+" + center + "*c2+" + lfe + "*c3+" + surround + "*c5"
+	case 8:
+		return "pan=stereo" +
+			"|FL=c0+" + center + "*c2+" + lfe + "*c3+" + surround + "*c4+" + surround + "*c6" +
+			"|FR=c1+" + center + "*c2+" + lfe + "*c3+" + surround + "*c5+" + surround + "*c7"
+	default:
+		return "aformat=channel_layouts=stereo"
+	}
+}
+
+// outputChannels is how many channels the encoded output will have.
+func outputChannels(channels int) int {
+	if downmixFilter(channels) != "" {
+		return 2
+	}
+	return channels
+}
+
+// copyBitrateTolerance is how far above the target bitrate an AAC source
+// may be and still be copied rather than re-encoded down.
+const copyBitrateTolerance = 0.1
+
+func parseEncodeOptions(q url.Values) (encodeOptions, error) {
+	var opts encodeOptions
+
+	if raw := q.Get("bitrate"); raw != "" {
+		if _, ok := bitrateKbps(raw); raw != "auto" && !ok {
+			return opts, fmt.Errorf("Invalid 'bitrate' %q, expected \"auto\" or %dk-%dk", raw, minBitrateKbps, maxBitrateKbps)
+		}
+		opts.Bitrate = raw
+	}
+
+	if raw := q.Get("fade_in"); raw != "" {
+		d, err := parseSeconds(raw, maxFadeDuration)
+		if err != nil {
+			return opts, fmt.Errorf("Invalid 'fade_in': %v", err)
+		}
+		opts.FadeIn = d
+	}
+
+	if raw := q.Get("fade_out"); raw != "" {
+		d, err := parseSeconds(raw, maxFadeDuration)
+		if err != nil {
+			return opts, fmt.Errorf("Invalid 'fade_out': %v", err)
+		}
+		opts.FadeOut = d
+	}
+
+	opts.CopyIfAAC = q.Get("copy_if_aac") == "true"
+
+	switch mode := q.Get("mode"); mode {
+	case "", "encode":
+	case "remux":
+		opts.Remux = true
+	default:
+		return opts, fmt.Errorf("Unsupported mode %q. Only encode and remux are allowed", mode)
+	}
+
+	return opts, nil
+}
+
+// resolveBitrate returns the bitrate to encode with. In auto mode mono
+// sources (typically speech) and low sample rates get less than the
+// stereo music default.
+func (o encodeOptions) resolveBitrate(info mediaInfo) string {
+	switch {
+	case o.Bitrate == "":
+		return defaultBitrate
+	case o.Bitrate != "auto":
+		return o.Bitrate
+	}
+
+	channels := outputChannels(info.Channels)
+	lowRate := info.SampleRate > 0 && info.SampleRate <= 24000
+	switch {
+	case channels == 1 && lowRate:
+		return "48k"
+	case channels == 1:
+		return "96k"
+	case channels == 2 && lowRate:
+		return "128k"
+	case channels > 2:
+		return "256k"
+	default:
+		return defaultBitrate
+	}
+}
+
+// canCopy reports whether info's audio can be stream copied: it has to be
+// AAC already, need no filtering, and not be much bigger than the bitrate
+// we would otherwise encode at. A source below the target is copied since
+// re-encoding it can only lose quality.
+func (o encodeOptions) canCopy(info mediaInfo, extraFilters []string) bool {
+	if !o.CopyIfAAC || info.Codec != "aac" || info.BitRate <= 0 {
+		return false
+	}
+	if o.FadeIn > 0 || o.FadeOut > 0 || len(extraFilters) > 0 || downmixFilter(info.Channels) != "" {
+		return false
+	}
+
+	m := bitratePattern.FindStringSubmatch(o.resolveBitrate(info))
+	if m == nil {
+		return false
+	}
+	kbps, _ := strconv.ParseInt(m[1], 10, 64)
+	return float64(info.BitRate) <= float64(kbps*1000)*(1+copyBitrateTolerance)
+}
+
+// remuxCodecs are the codecs HLS allows in MPEG-TS segments, which
+// mode=remux copies without re-encoding. ffmpeg's mpegts muxer adds ADTS
+// headers itself to AAC taken from MP4, so no bitstream filter is needed.
+var remuxCodecs = []string{"aac", "mp3", "ac3", "eac3"}
+
+// remuxBlocker explains why info's audio can't be remuxed as is, or
+// returns "" when it can. Unlike canCopy the bitrate doesn't matter: remux
+// asks for the source's audio unchanged.
+func (o encodeOptions) remuxBlocker(info mediaInfo, extraFilters []string) string {
+	switch {
+	case info.Codec == "":
+		return "the source couldn't be probed"
+	case !slices.Contains(remuxCodecs, info.Codec):
+		return fmt.Sprintf("%s can't be carried in TS segments", info.Codec)
+	case o.FadeIn > 0 || o.FadeOut > 0:
+		return "fades need re-encoding"
+	case len(extraFilters) > 0:
+		return "padding the last segment needs re-encoding"
+	case downmixFilter(info.Channels) != "":
+		return "the surround downmix needs re-encoding"
+	}
+	return ""
+}
+
+// audioFilters returns the -af filter chain for the options. The input
+// duration is needed to place the fade-out and to check fades fit.
+func (o encodeOptions) audioFilters(duration float64) ([]string, error) {
+	var filters []string
+
+	if o.FadeIn > 0 || o.FadeOut > 0 {
+		if duration <= 0 && o.FadeOut > 0 {
+			return nil, withStatus(http.StatusBadRequest, errors.New("Cannot apply fade_out: input duration is unknown"))
+		}
+		if duration > 0 && o.FadeIn+o.FadeOut > duration {
+			return nil, withStatus(http.StatusBadRequest, fmt.Errorf("fade_in and fade_out (%gs) exceed the input duration (%.3fs)", o.FadeIn+o.FadeOut, duration))
+		}
+	}
+
+	if o.FadeIn > 0 {
+		filters = append(filters, "afade=t=in:st=0:d="+formatSeconds(o.FadeIn))
+	}
+	if o.FadeOut > 0 {
+		start := duration - o.FadeOut
+		filters = append(filters, "afade=t=out:st="+formatSeconds(start)+":d="+formatSeconds(o.FadeOut))
+	}
+
+	return filters, nil
+}
+
+// ffmpegArgs returns the filter and codec arguments for encoding info's
+// audio with codec. extraFilters run after the option's own filters.
+func (o encodeOptions) ffmpegArgs(codec string, info mediaInfo, extraFilters ...string) ([]string, error) {
+	fades, err := o.audioFilters(info.Duration)
+	if err != nil {
+		return nil, err
+	}
+
+	var filters []string
+	if downmix := downmixFilter(info.Channels); downmix != "" {
+		filters = append(filters, downmix)
+	}
+	filters = append(filters, fades...)
+	filters = append(filters, extraFilters...)
+
+	var args []string
+	if len(filters) > 0 {
+		args = append(args, "-af", strings.Join(filters, ","))
+	}
+	args = append(args, "-c:a", codec, "-b:a", o.resolveBitrate(info))
+	return args, nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// statusError attaches the HTTP status a pipeline failure should be reported
+// with. Errors without one are treated as internal failures.
+type statusError struct {
+	status int
+	err    error
+}
+
+func (e *statusError) Error() string { return e.err.Error() }
+func (e *statusError) Unwrap() error { return e.err }
+
+func withStatus(status int, err error) error {
+	return &statusError{status: status, err: err}
+}
+
+func errorStatus(err error) int {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.status
+	}
+	return http.StatusInternalServerError
+}
+
+// transientError marks a failure that running the job again may not hit:
+// network trouble fetching the source or talking to storage.
+type transientError struct{ err error }
+
+func (e *transientError) Error() string { return e.err.Error() }
+func (e *transientError) Unwrap() error { return e.err }
+
+func transient(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &transientError{err: err}
+}
+
+// retryableJobError reports whether a failed job is worth running again
+// from scratch. A status set anywhere in the chain decides first, so an
+// origin 404 stays final even though it came from a download; otherwise
+// only errors marked transient are retried, which leaves decode and other
+// ffmpeg failures final.
+func retryableJobError(err error) bool {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.status == http.StatusBadGateway || se.status == http.StatusGatewayTimeout
+	}
+	var te *transientError
+	return errors.As(err, &te)
+}
+
+// Error codes carried in the "code" field of every error response, so
+// clients can branch on them rather than on messages. Each maps to one
+// HTTP status, except where noted.
+const (
+	codeBadInput          = "bad_input"          // 400
+	codeUnsupportedFormat = "unsupported_format" // 400
+	codeUnauthorized      = "unauthorized"       // 401
+	codeForbidden         = "forbidden"          // 403
+	codeNotFound          = "not_found"          // 404
+	codeConflict          = "conflict"           // 409
+	codeJobCancelled      = "job_cancelled"      // 409
+	codeBodyTooLarge      = "body_too_large"     // 413
+	codeRateLimited       = "rate_limited"       // 429
+	codeInternal          = "internal"           // 500
+
+	// The pipeline stages report the status of the underlying failure,
+	// e.g. 404 for a missing source or 502 for an unreachable origin
+	codeDownloadFailed  = "download_failed"
+	codeTranscodeFailed = "transcode_failed"
+	codeUploadFailed    = "upload_failed"
+
+	codeStorageError          = "storage_error"          // 502, reading or listing MinIO failed
+	codeStorageUnavailable    = "storage_unavailable"    // 503
+	codeTranscoderUnavailable = "transcoder_unavailable" // 503
+)
+
+// codedError attaches an error code to a failure, see errorCode.
+type codedError struct {
+	code string
+	err  error
+}
+
+func (e *codedError) Error() string { return e.err.Error() }
+func (e *codedError) Unwrap() error { return e.err }
+
+func withCode(code string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &codedError{code: code, err: err}
+}
+
+// stageError tags err with the pipeline stage it came from, unless a more
+// specific code was already set further down.
+func stageError(code string, err error) error {
+	var ce *codedError
+	if err == nil || errors.As(err, &ce) {
+		return err
+	}
+	return withCode(code, err)
+}
+
+// errorCode returns the code set in err's chain, or the generic one for
+// its status.
+func errorCode(err error) string {
+	var ce *codedError
+	if errors.As(err, &ce) {
+		return ce.code
+	}
+	return statusCode(errorStatus(err))
+}
+
+func statusCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return codeBadInput
+	case http.StatusUnauthorized:
+		return codeUnauthorized
+	case http.StatusForbidden:
+		return codeForbidden
+	case http.StatusNotFound:
+		return codeNotFound
+	case http.StatusConflict:
+		return codeConflict
+	case http.StatusRequestEntityTooLarge:
+		return codeBodyTooLarge
+	case http.StatusTooManyRequests:
+		return codeRateLimited
+	case http.StatusServiceUnavailable:
+		return codeStorageUnavailable
+	default:
+		return codeInternal
+	}
+}
+
+// errorBody is the JSON body of every error response. RetryAfter is only
+// set for 429s.
+type errorBody struct {
+	Status     string `json:"status"`
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	RetryAfter int    `json:"retryAfter,omitempty"`
+
+	// Missing lists the objects an incomplete upload left out
+	Missing []string `json:"missing,omitempty"`
+}
+
+// writeError rejects the request with status and the JSON error body.
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorBody{
+		Status:  "error",
+		Code:    code,
+		Message: message,
+	})
+}
+
+// writeErr reports err with the status and code it carries.
+func writeErr(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(errorStatus(err))
+	json.NewEncoder(w).Encode(errorBody{
+		Status:  "error",
+		Code:    errorCode(err),
+		Message: err.Error(),
+		Missing: missingObjects(err),
+	})
+}
+
+// writeBackpressure rejects the request with 429, a Retry-After header and
+// a machine-readable body naming which limit was hit. Every 429 uses it, so
+// clients can back off the same way for all of them.
+func writeBackpressure(w http.ResponseWriter, code string, message string, retryAfter int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(errorBody{
+		Status:     "error",
+		Code:       code,
+		Message:    message,
+		RetryAfter: retryAfter,
+	})
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"os"
+)
+
+// With inline_playlist the response carries the playlist's text as well as
+// its URL, for clients that parse it straight away: as is with raw, or
+// base64 encoded so it survives JSON and text bodies unchanged.
+const (
+	inlineRaw    = "raw"
+	inlineBase64 = "base64"
+)
+
+// inlinePlaylistMaxBytes is INLINE_PLAYLIST_MAX_BYTES, the largest playlist
+// included in a response; longer ones are only uploaded.
+var inlinePlaylistMaxBytes int64 = 64 << 10
+
+func parseInlinePlaylist(q url.Values) (string, error) {
+	switch encoding := q.Get("inline_playlist"); encoding {
+	case "", inlineRaw, inlineBase64:
+		return encoding, nil
+	default:
+		return "", fmt.Errorf("Unsupported inline_playlist %q. Only raw and base64 are allowed", encoding)
+	}
+}
+
+// inlinePlaylist reads the playlist at path for the response in encoding.
+// A playlist that can't be included is reported as a warning instead; it
+// was uploaded all the same.
+func inlinePlaylist(path string, encoding string) (playlist string, warning string) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Sprintf("Playlist not included in the response: %v", err)
+	}
+	if int64(len(raw)) > inlinePlaylistMaxBytes {
+		return "", fmt.Sprintf("Playlist not included in the response: %d bytes is over the %d byte limit", len(raw), inlinePlaylistMaxBytes)
+	}
+	if encoding == inlineBase64 {
+		return base64.StdEncoding.EncodeToString(raw), ""
+	}
+	return string(raw), ""
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type jobStatus string
+
+const (
+	jobPending   jobStatus = "pending"
+	jobRunning   jobStatus = "running"
+	jobCompleted jobStatus = "completed"
+	jobFailed    jobStatus = "failed"
+	jobSpooled   jobStatus = "spooled"
+	jobCancelled jobStatus = "cancelled"
+)
+
+// errJobCancelled is why a job's context ends when DELETE /jobs/{id} stops it.
+var errJobCancelled = withCode(codeJobCancelled, withStatus(http.StatusConflict, errors.New("Job was cancelled")))
+
+// Finished jobs are kept around this long so clients can still poll them
+const jobRetention = time.Hour
+
+type job struct {
+	mu sync.Mutex
+
+	ID            string
+	RefID         string
+	Tenant        string
+	Status        jobStatus
+	Progress      float64
+	ProgressKnown bool
+	StreamURL     string
+	MasterURL     string
+	ManifestURL   string
+	PreviewURL    string
+	Chapters      []chapterResult
+	Parts         []string
+	Loudness      *loudnessInfo
+	Skipped       bool
+	Attempts      int
+	Warnings      []string
+	Playlist      string
+	PlaylistEnc   string
+	Error         string
+	ErrorCode     string
+	Missing       []string
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+	StartedAt     time.Time
+	FinishedAt    time.Time
+
+	ticket *ticket
+
+	// ctx ends when the job is cancelled; runJob stops the conversion with it
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+}
+
+type jobView struct {
+	JobID         string          `json:"jobId"`
+	RefID         string          `json:"refId,omitempty"`
+	Status        jobStatus       `json:"status"`
+	QueuePosition int             `json:"queuePosition,omitempty"`
+	Progress      *float64        `json:"progress"`
+	Indeterminate bool            `json:"indeterminate,omitempty"`
+	StreamURL     string          `json:"streamUrl,omitempty"`
+	MasterURL     string          `json:"masterUrl,omitempty"`
+	ManifestURL   string          `json:"manifestUrl,omitempty"`
+	PreviewURL    string          `json:"previewUrl,omitempty"`
+	Chapters      []chapterResult `json:"chapters,omitempty"`
+	Parts         []string        `json:"parts,omitempty"`
+	Loudness      *loudnessInfo   `json:"loudness,omitempty"`
+	Skipped       bool            `json:"skipped,omitempty"`
+	Attempts      int             `json:"attempts,omitempty"`
+	Warnings      []string        `json:"warnings,omitempty"`
+	Playlist      string          `json:"playlist,omitempty"`
+	PlaylistEnc   string          `json:"playlistEncoding,omitempty"`
+	Error         string          `json:"error,omitempty"`
+	ErrorCode     string          `json:"errorCode,omitempty"`
+	Missing       []string        `json:"missingObjects,omitempty"`
+	CreatedAt     time.Time       `json:"createdAt"`
+	UpdatedAt     time.Time       `json:"updatedAt"`
+}
+
+func (j *job) setTicket(t *ticket) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.ticket = t
+}
+
+func (j *job) setRunning() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Status = jobRunning
+	j.StartedAt = time.Now()
+	j.UpdatedAt = j.StartedAt
+}
+
+// setAttempt records that attempt n of the conversion is starting.
+func (j *job) setAttempt(n int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Attempts = n
+	j.Progress = 0
+	j.ProgressKnown = false
+	j.UpdatedAt = time.Now()
+}
+
+func (j *job) setProgress(percent float64, known bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Progress = percent
+	j.ProgressKnown = known
+	j.UpdatedAt = time.Now()
+}
+
+func (j *job) complete(result conversionResult) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Status = jobCompleted
+	j.StreamURL = result.URL
+	j.MasterURL = result.MasterURL
+	j.ManifestURL = result.ManifestURL
+	j.PreviewURL = result.PreviewURL
+	j.Chapters = result.Chapters
+	j.Parts = result.Parts
+	j.Loudness = result.Loudness
+	j.Skipped = result.Skipped
+	j.Warnings = result.Warnings
+	j.Playlist, j.PlaylistEnc = result.Playlist, result.PlaylistEncoding
+	j.Missing = nil
+	j.Progress = 100
+	j.ProgressKnown = true
+	j.FinishedAt = time.Now()
+	j.UpdatedAt = j.FinishedAt
+}
+
+// spool marks a job whose output is converted but still waiting to be
+// uploaded, missing being what the last attempt didn't upload
+func (j *job) spool(streamURL string, missing []string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Status = jobSpooled
+	j.StreamURL = streamURL
+	j.Missing = missing
+	j.UpdatedAt = time.Now()
+}
+
+// finished reports whether nothing will update j any more.
+func (j *job) finished() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.Status == jobCompleted || j.Status == jobFailed || j.Status == jobCancelled
+}
+
+func (j *job) updatedAt() time.Time {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.UpdatedAt
+}
+
+// requestCancel cancels a job that hasn't finished yet. It reports the
+// status the job had and whether it was cancelled.
+func (j *job) requestCancel() (jobStatus, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.Status != jobPending && j.Status != jobRunning {
+		return j.Status, false
+	}
+	j.cancel(errJobCancelled)
+	return j.Status, true
+}
+
+func (j *job) cancelled() bool {
+	return j.ctx.Err() != nil
+}
+
+func (j *job) setCancelled() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Status = jobCancelled
+	j.FinishedAt = time.Now()
+	j.UpdatedAt = j.FinishedAt
+}
+
+func (j *job) fail(err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Status = jobFailed
+	j.Error = err.Error()
+	j.ErrorCode = errorCode(err)
+	j.Missing = missingObjects(err)
+	j.FinishedAt = time.Now()
+	j.UpdatedAt = j.FinishedAt
+}
+
+func (j *job) view() jobView {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	v := jobView{
+		JobID:       j.ID,
+		RefID:       j.RefID,
+		Status:      j.Status,
+		StreamURL:   j.StreamURL,
+		MasterURL:   j.MasterURL,
+		ManifestURL: j.ManifestURL,
+		PreviewURL:  j.PreviewURL,
+		Chapters:    j.Chapters,
+		Parts:       j.Parts,
+		Loudness:    j.Loudness,
+		Skipped:     j.Skipped,
+		Attempts:    j.Attempts,
+		Warnings:    j.Warnings,
+		Playlist:    j.Playlist,
+		PlaylistEnc: j.PlaylistEnc,
+		Error:       j.Error,
+		ErrorCode:   j.ErrorCode,
+		Missing:     j.Missing,
+		CreatedAt:   j.CreatedAt,
+		UpdatedAt:   j.UpdatedAt,
+	}
+
+	if j.Status == jobPending && j.ticket != nil {
+		v.QueuePosition = conversions.position(j.ticket)
+	}
+
+	switch {
+	case j.ProgressKnown:
+		progress := j.Progress
+		v.Progress = &progress
+	case j.Status == jobRunning:
+		// No total duration from ffprobe, so a percentage can't be computed
+		v.Indeterminate = true
+	}
+
+	return v
+}
+
+type jobSummary struct {
+	JobID      string    `json:"jobId"`
+	RefID      string    `json:"refId,omitempty"`
+	Status     jobStatus `json:"status"`
+	DurationMs int64     `json:"durationMs"`
+	StreamURL  string    `json:"streamUrl,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+func (j *job) summary() jobSummary {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	s := jobSummary{
+		JobID:     j.ID,
+		RefID:     j.RefID,
+		Status:    j.Status,
+		StreamURL: j.StreamURL,
+		CreatedAt: j.CreatedAt,
+	}
+
+	switch {
+	case !j.FinishedAt.IsZero():
+		s.DurationMs = j.FinishedAt.Sub(j.StartedAt).Milliseconds()
+	case !j.StartedAt.IsZero():
+		s.DurationMs = time.Since(j.StartedAt).Milliseconds()
+	}
+
+	return s
+}
+
+type jobStore struct {
+	mu   sync.RWMutex
+	jobs map[string]*job
+
+	// recent is a ring buffer of the last len(recent) jobs, next is the
+	// slot the following job will be written to.
+	recent []*job
+	next   int
+}
+
+var jobs = newJobStore(100)
+
+func newJobStore(recentLimit int) *jobStore {
+	return &jobStore{
+		jobs:   make(map[string]*job),
+		recent: make([]*job, recentLimit),
+	}
+}
+
+// create registers a new pending job for tenant, the tenant of the API key
+// that requested it.
+func (s *jobStore) create(refID string, tenant string) *job {
+	return s.restore(uuid.NewString(), refID, tenant, time.Now())
+}
+
+// restore registers a pending job under an existing ID, for jobs resumed
+// after a restart.
+func (s *jobStore) restore(id string, refID string, tenant string, createdAt time.Time) *job {
+	now := time.Now()
+	j := &job{
+		ID:        id,
+		RefID:     refID,
+		Tenant:    tenant,
+		Status:    jobPending,
+		CreatedAt: createdAt,
+		UpdatedAt: now,
+	}
+	j.ctx, j.cancel = context.WithCancelCause(context.Background())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneLocked(now)
+	s.jobs[j.ID] = j
+
+	if len(s.recent) > 0 {
+		s.recent[s.next] = j
+		s.next = (s.next + 1) % len(s.recent)
+	}
+	return j
+}
+
+// recentJobs returns up to limit of tenant's most recent jobs, newest
+// first.
+func (s *jobStore) recentJobs(tenant string, limit int) []*job {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var out []*job
+	for i := 1; i <= len(s.recent) && len(out) < limit; i++ {
+		j := s.recent[(s.next-i+len(s.recent))%len(s.recent)]
+		if j == nil {
+			break
+		}
+		if j.Tenant == tenant {
+			out = append(out, j)
+		}
+	}
+	return out
+}
+
+func (s *jobStore) get(id string) (*job, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	j, ok := s.jobs[id]
+	return j, ok
+}
+
+func (s *jobStore) pruneLocked(now time.Time) {
+	for id, j := range s.jobs {
+		if j.finished() && now.Sub(j.updatedAt()) > jobRetention {
+			delete(s.jobs, id)
+		}
+	}
+}
+
+// resetReport is what reset cleared, and what it kept because the jobs
+// were still in flight.
+type resetReport struct {
+	JobsCleared   int `json:"jobsCleared"`
+	JobsKept      int `json:"jobsKept"`
+	RecentCleared int `json:"recentCleared"`
+}
+
+// reset forgets every finished job and drops them from the recent-jobs
+// buffer. Pending, running and spooled jobs stay registered, in their
+// original order, because their goroutines and the spool still report to
+// them.
+func (s *jobStore) reset() resetReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var report resetReport
+	for id, j := range s.jobs {
+		if j.finished() {
+			delete(s.jobs, id)
+			report.JobsCleared++
+		} else {
+			report.JobsKept++
+		}
+	}
+
+	var kept []*job
+	for i := range s.recent {
+		j := s.recent[(s.next+i)%len(s.recent)]
+		switch {
+		case j == nil:
+		case j.finished():
+			report.RecentCleared++
+		default:
+			kept = append(kept, j)
+		}
+	}
+	clear(s.recent)
+	copy(s.recent, kept)
+	if len(s.recent) > 0 {
+		s.next = len(kept) % len(s.recent)
+	}
+	return report
+}
+
+func handleJobs(w http.ResponseWriter, r *http.Request) {
+	limit := len(jobs.recent)
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, codeBadInput, "Invalid 'limit' query parameter")
+			return
+		}
+		limit = n
+	}
+
+	// Like a cancel, a listing only ever shows the caller's own jobs
+	summaries := []jobSummary{}
+	for _, j := range jobs.recentJobs(requestTenant(r), limit) {
+		summaries = append(summaries, j.summary())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summaries)
+}
+
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		writeError(w, http.StatusBadRequest, codeBadInput, "Missing 'id' query parameter")
+		return
+	}
+
+	j, ok := jobs.get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, codeNotFound, "Job not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(j.view())
+}
+
+// handleCancelJob stops a pending or running job: its ffmpeg is killed, its
+// transfers are aborted and whatever it had uploaded and written locally is
+// removed. That happens as the job unwinds, so the response is 202 and
+// /status reports "cancelled" once it is done.
+func handleCancelJob(w http.ResponseWriter, r *http.Request) {
+	j, ok := jobs.get(r.PathValue("id"))
+	// Another tenant's job is reported as missing rather than forbidden, so
+	// job IDs can't be probed
+	if !ok || j.Tenant != requestTenant(r) {
+		writeError(w, http.StatusNotFound, codeNotFound, "Job not found")
+		return
+	}
+
+	if status, ok := j.requestCancel(); !ok {
+		writeError(w, http.StatusConflict, codeConflict, "Job is already "+string(status))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(j.view())
+}
+
+// handleResetJobs clears the finished jobs from the registry and the
+// recent-jobs buffer, for staging and for recovering without a restart.
+// In-flight conversions are untouched.
+func handleResetJobs(w http.ResponseWriter, r *http.Request) {
+	report := jobs.reset()
+	log.Printf("Admin reset: %d jobs cleared, %d in flight kept", report.JobsCleared, report.JobsKept)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestHandleJobsScopedToTenant(t *testing.T) {
+	previousJobs, previousKeys := jobs, apiKeys
+	jobs, apiKeys = newJobStore(10), parseAPIKeys([]string{"acme:acme-key", "globex:globex-key"})
+	t.Cleanup(func() { jobs, apiKeys = previousJobs, previousKeys })
+
+	acme1 := jobs.create("acme-1", "acme")
+	globex := jobs.create("globex-1", "globex")
+	acme2 := jobs.create("acme-2", "acme")
+
+	tests := []struct {
+		key   string
+		query string
+		want  []string
+	}{
+		{key: "acme-key", want: []string{acme2.ID, acme1.ID}},
+		{key: "acme-key", query: "?limit=1", want: []string{acme2.ID}},
+		{key: "globex-key", want: []string{globex.ID}},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/jobs"+tt.query, nil)
+		r.Header.Set("X-API-Key", tt.key)
+		w := httptest.NewRecorder()
+		handleJobs(w, r)
+
+		var summaries []jobSummary
+		if err := json.NewDecoder(w.Body).Decode(&summaries); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, summary := range summaries {
+			got = append(got, summary.JobID)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s%s listed %v, want %v", tt.key, tt.query, got, tt.want)
+		}
+	}
+}
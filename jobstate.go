@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// jobStateDir is JOB_STATE_DIR. When set, every async job is recorded there
+// until it finishes, so jobs cut off by a restart are queued again.
+var jobStateDir string
+
+// persistedJob is enough to rebuild a job: its identity and the query and
+// headers it was requested with, which are parsed again exactly as the
+// original was. The API key is never written to disk; the tenant it
+// belonged to stands in for it. The prefix is kept as resolved, since a
+// template can depend on the date.
+type persistedJob struct {
+	JobID        string      `json:"jobId"`
+	RefID        string      `json:"refId,omitempty"`
+	Tenant       string      `json:"tenant,omitempty"`
+	Query        string      `json:"query"`
+	Header       http.Header `json:"header,omitempty"`
+	ObjectPrefix string      `json:"objectPrefix"`
+	CreatedAt    time.Time   `json:"createdAt"`
+}
+
+// persistedHeaders are the request headers a resumed job is parsed with
+// again; everything else, credentials included, is dropped.
+var persistedHeaders = []string{"traceparent", "X-Request-ID"}
+
+func jobStatePath(jobID string) string {
+	return filepath.Join(jobStateDir, jobID+".json")
+}
+
+// saveJobState records an accepted async job, requested by r with query.
+// Failing to is logged but doesn't reject the job; it just won't survive a
+// restart.
+func saveJobState(j *job, r *http.Request, query url.Values, objectPrefix string) {
+	if jobStateDir == "" {
+		return
+	}
+
+	header := http.Header{}
+	for _, name := range persistedHeaders {
+		if values := r.Header.Values(name); len(values) > 0 {
+			header[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	body, err := json.Marshal(persistedJob{
+		JobID:        j.ID,
+		RefID:        j.RefID,
+		Tenant:       j.Tenant,
+		Query:        query.Encode(),
+		Header:       header,
+		ObjectPrefix: objectPrefix,
+		CreatedAt:    j.CreatedAt,
+	})
+	if err == nil {
+		err = os.MkdirAll(jobStateDir, 0755)
+	}
+	if err == nil {
+		// Write then rename so a crash never leaves a truncated record
+		tmp := jobStatePath(j.ID) + ".tmp"
+		if err = os.WriteFile(tmp, body, 0644); err == nil {
+			err = os.Rename(tmp, jobStatePath(j.ID))
+		}
+	}
+	if err != nil {
+		log.Println("Failed to persist job", j.ID, err)
+	}
+}
+
+// forgetJobState drops a job's record once it has finished, failed, or been
+// handed to the spool, which keeps its own on-disk state.
+func forgetJobState(jobID string) {
+	if jobStateDir == "" {
+		return
+	}
+	if err := os.Remove(jobStatePath(jobID)); err != nil && !os.IsNotExist(err) {
+		log.Println("Failed to remove job state", jobID, err)
+	}
+}
+
+// resumeJobs queues again every async job that was recorded but never
+// finished. Its working directory was temporary, so the job starts over
+// from the download under its original ID, but the upload resumes: objects
+// the interrupted run already stored, and which the new encode reproduces,
+// aren't sent again.
+func resumeJobs() {
+	entries, err := os.ReadDir(jobStateDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("Failed to read job state:", err)
+		}
+		return
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		path := filepath.Join(jobStateDir, entry.Name())
+
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			log.Println("Failed to read job state:", path, err)
+			continue
+		}
+		var saved persistedJob
+		if err := json.Unmarshal(raw, &saved); err != nil {
+			log.Println("Skipping unreadable job state:", path, err)
+			continue
+		}
+
+		r := withTenant(&http.Request{URL: &url.URL{RawQuery: saved.Query}, Header: saved.Header}, saved.Tenant)
+		if r.Header == nil {
+			r.Header = http.Header{}
+		}
+		req, err := parseConvertRequest(r)
+		if err != nil {
+			log.Println("Dropping job", saved.JobID, "that no longer parses:", err)
+			os.Remove(path)
+			continue
+		}
+		if saved.ObjectPrefix != "" {
+			req.ObjectPrefix = saved.ObjectPrefix
+		}
+		req.Trace = traceParent(r)
+		req.Resume = true
+
+		j := jobs.restore(saved.JobID, saved.RefID, saved.Tenant, saved.CreatedAt)
+		t, err := conversions.enqueue()
+		if err != nil {
+			j.fail(err)
+			forgetJobState(j.ID)
+			notifyCompletion(completionEvent{JobID: j.ID, RefID: j.RefID, Status: jobFailed, Error: err.Error(), ErrorCode: codeRateLimited})
+			continue
+		}
+		j.setTicket(t)
+
+		log.Println("Resuming job", j.ID, "interrupted by a restart")
+		go runJob(context.Background(), j, req)
+	}
+}
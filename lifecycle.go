@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/lifecycle"
+)
+
+// Expiry for ephemeral outputs. expire_days=N tags every uploaded object
+// with expiryTagKey=N. Nothing deletes the objects by itself: the bucket
+// needs a lifecycle rule expiring objects carrying that tag after N days,
+// one per allowed N, which ensureExpiryRules creates when
+// EXPIRY_LIFECYCLE_SETUP=true. Only the EXPIRY_DAYS values are accepted so
+// every tag in use has a matching rule.
+var (
+	expiryDays           []int
+	expiryTagKey         = "expire-after-days"
+	expiryLifecycleSetup bool
+)
+
+// expiryRulePrefix marks the lifecycle rules this service manages, so
+// rules set up by anyone else are left alone.
+const expiryRulePrefix = "encoder-expire-"
+
+func parseExpiryDays(entries []string) ([]int, error) {
+	var days []int
+	for _, entry := range entries {
+		n, err := strconv.Atoi(entry)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid day count %q", entry)
+		}
+		if !slices.Contains(days, n) {
+			days = append(days, n)
+		}
+	}
+	return days, nil
+}
+
+// parseExpiry reads the 'expire_days' parameter into the object tags that
+// carry it.
+func parseExpiry(raw string) (map[string]string, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	if len(expiryDays) == 0 {
+		return nil, errors.New("'expire_days' is not enabled on this server")
+	}
+
+	n, err := strconv.Atoi(raw)
+	if err != nil || !slices.Contains(expiryDays, n) {
+		allowed := make([]string, len(expiryDays))
+		for i, d := range expiryDays {
+			allowed[i] = strconv.Itoa(d)
+		}
+		return nil, fmt.Errorf("Invalid 'expire_days' %q, allowed: %s", raw, strings.Join(allowed, ", "))
+	}
+	return map[string]string{expiryTagKey: strconv.Itoa(n)}, nil
+}
+
+// ensureExpiryRules installs one lifecycle rule per EXPIRY_DAYS value,
+// replacing earlier rules of ours and keeping everything else in the
+// bucket's lifecycle configuration.
+func ensureExpiryRules() error {
+	ctx := context.Background()
+
+	client, err := newMinioClient()
+	if err != nil {
+		return err
+	}
+
+	config, err := client.GetBucketLifecycle(ctx, minioBucket)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code != "NoSuchLifecycleConfiguration" {
+			return err
+		}
+		config = lifecycle.NewConfiguration()
+	}
+
+	rules := slices.DeleteFunc(config.Rules, func(rule lifecycle.Rule) bool {
+		return strings.HasPrefix(rule.ID, expiryRulePrefix)
+	})
+	for _, days := range expiryDays {
+		rules = append(rules, lifecycle.Rule{
+			ID:     fmt.Sprintf("%s%dd", expiryRulePrefix, days),
+			Status: "Enabled",
+			RuleFilter: lifecycle.Filter{
+				Tag: lifecycle.Tag{Key: expiryTagKey, Value: strconv.Itoa(days)},
+			},
+			Expiration: lifecycle.Expiration{Days: lifecycle.ExpirationDays(days)},
+		})
+	}
+	config.Rules = rules
+
+	if err := client.SetBucketLifecycle(ctx, minioBucket, config); err != nil {
+		return err
+	}
+	log.Printf("✅ Lifecycle rules set for %d expiry periods (tag %s)", len(expiryDays), expiryTagKey)
+	return nil
+}
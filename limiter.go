@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var errQueueFull = errors.New("conversion queue is full")
+
+// queueWaitError is the failure of a conversion whose wait for a slot
+// ended first.
+func queueWaitError(err error) error {
+	return fmt.Errorf("Conversion cancelled while queued: %w", err)
+}
+
+// conversionLimiter bounds how many conversions run at once. Requests over
+// the limit wait in FIFO order so each can be told its position in line.
+type conversionLimiter struct {
+	mu       sync.Mutex
+	limit    int
+	maxQueue int
+	active   int
+	queue    []*ticket
+}
+
+type ticket struct {
+	ready chan struct{}
+}
+
+var conversions = &conversionLimiter{}
+
+// enqueue reserves a slot, or a place in the queue when none is free. A
+// limit of zero means unlimited, as does a maxQueue of zero.
+func (l *conversionLimiter) enqueue() (*ticket, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	t := &ticket{ready: make(chan struct{})}
+	if l.limit == 0 || (l.active < l.limit && len(l.queue) == 0) {
+		l.active++
+		close(t.ready)
+		return t, nil
+	}
+	if l.maxQueue > 0 && len(l.queue) >= l.maxQueue {
+		return nil, errQueueFull
+	}
+
+	l.queue = append(l.queue, t)
+	return t, nil
+}
+
+// wait blocks until t holds a slot. If ctx ends first t gives up its place.
+func (l *conversionLimiter) wait(ctx context.Context, t *ticket) error {
+	select {
+	case <-t.ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, queued := range l.queue {
+		if queued == t {
+			l.queue = append(l.queue[:i], l.queue[i+1:]...)
+			return ctx.Err()
+		}
+	}
+
+	// The slot was granted while we were giving up, so hand it on
+	l.releaseLocked()
+	return ctx.Err()
+}
+
+// position returns t's 1-based place in the queue, or 0 once it has a slot.
+func (l *conversionLimiter) position(t *ticket) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, queued := range l.queue {
+		if queued == t {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func (l *conversionLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.releaseLocked()
+}
+
+func (l *conversionLimiter) releaseLocked() {
+	if len(l.queue) == 0 {
+		l.active--
+		return
+	}
+
+	next := l.queue[0]
+	l.queue = l.queue[1:]
+	close(next.ready)
+}
+
+// stageLimiter caps how many jobs are in one pipeline stage at a time, so
+// network-bound downloads and CPU-bound ffmpeg runs can be sized separately
+// within the overall conversion limit. A nil limiter is unlimited.
+type stageLimiter chan struct{}
+
+func newStageLimiter(limit int) stageLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	return make(stageLimiter, limit)
+}
+
+func (s stageLimiter) acquire() {
+	if s != nil {
+		s <- struct{}{}
+	}
+}
+
+// acquireContext is acquire for callers that should stop waiting once ctx
+// ends.
+func (s stageLimiter) acquireContext(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+func (s stageLimiter) release() {
+	if s != nil {
+		<-s
+	}
+}
+
+var (
+	downloadSlots  stageLimiter
+	transcodeSlots stageLimiter
+
+	// uploadSlots bounds the object uploads in flight across every job,
+	// rather than a stage per job, so traffic spikes can't open more
+	// connections to MinIO than it is sized for
+	uploadSlots stageLimiter
+)
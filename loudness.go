@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+)
+
+// replayGainReference is the ReplayGain 2.0 reference loudness in LUFS
+const replayGainReference = -18.0
+
+// loudnessInfo is the ebur128 measurement of a source and the ReplayGain
+// values derived from it. The audio itself is never adjusted.
+type loudnessInfo struct {
+	IntegratedLUFS float64 `json:"integratedLufs"`
+	TruePeakDBTP   float64 `json:"truePeakDbtp"`
+	TrackGainDB    float64 `json:"replayGainTrackGain"`
+	TrackPeak      float64 `json:"replayGainTrackPeak"`
+}
+
+var (
+	integratedPattern = regexp.MustCompile(`I:\s+(-?[0-9.]+|-inf) LUFS`)
+	truePeakPattern   = regexp.MustCompile(`Peak:\s+(-?[0-9.]+|-inf) dBFS`)
+)
+
+// measureLoudness runs the ebur128 filter over inputPath and parses the
+// summary it prints once the input ends.
+func measureLoudness(ctx context.Context, inputPath string) (loudnessInfo, error) {
+	var stderr bytes.Buffer
+	// ebur128 prints its summary at info level, whatever FFMPEG_LOGLEVEL is
+	cmd := execCommand(ffmpegPath,
+		"-hide_banner",
+		"-nostats",
+		"-loglevel", "info",
+		"-i", inputPath,
+		"-vn",
+		"-af", "ebur128=peak=true",
+		"-f", "null", "-",
+	)
+	cmd.Stderr = &stderr
+	if err := runFFmpeg(ctx, cmd); err != nil {
+		return loudnessInfo{}, fmt.Errorf("FFmpeg loudness analysis failed: %w", err)
+	}
+	return parseLoudness(stderr.String())
+}
+
+func parseLoudness(summary string) (loudnessInfo, error) {
+	// The per-frame lines also contain "I:", so only the last match is the
+	// final integrated value
+	integrated := integratedPattern.FindAllStringSubmatch(summary, -1)
+	peak := truePeakPattern.FindAllStringSubmatch(summary, -1)
+	if integrated == nil || peak == nil {
+		return loudnessInfo{}, fmt.Errorf("no loudness summary in ffmpeg output")
+	}
+
+	var info loudnessInfo
+	info.IntegratedLUFS = parseDecibels(integrated[len(integrated)-1][1])
+	info.TruePeakDBTP = parseDecibels(peak[len(peak)-1][1])
+
+	info.TrackGainDB = math.Round((replayGainReference-info.IntegratedLUFS)*100) / 100
+	info.TrackPeak = math.Round(math.Pow(10, info.TruePeakDBTP/20)*1e6) / 1e6
+	return info, nil
+}
+
+// parseDecibels reads an ebur128 value, clamping silence's -inf so the
+// result still encodes as JSON.
+func parseDecibels(raw string) float64 {
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil || math.IsInf(v, -1) {
+		return -70
+	}
+	return v
+}
+
+// tags returns the ReplayGain metadata written into single-file outputs.
+func (l loudnessInfo) tags() map[string]string {
+	return map[string]string{
+		"REPLAYGAIN_TRACK_GAIN": strconv.FormatFloat(l.TrackGainDB, 'f', 2, 64) + " dB",
+		"REPLAYGAIN_TRACK_PEAK": strconv.FormatFloat(l.TrackPeak, 'f', 6, 64),
+	}
+}
@@ -1,19 +1,24 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
-	"os/exec"
-	"path/filepath"
+	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
-	"github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/credentials"
 )
 
 var (
@@ -22,10 +27,58 @@ var (
 	minioSecretKey string
 	minioBucket    string
 	useSSL         bool
+
+	// publicScheme is PUBLIC_SCHEME, the scheme of returned URLs when
+	// something in front of MinIO terminates TLS; empty follows useSSL
+	publicScheme string
+
+	minioRetryAfter string
+	queueRetryAfter int
+
+	// jobMaxRetries is how many times a job failing with a retryable error
+	// is run again, waiting jobRetryBackoff (doubling) in between
+	jobMaxRetries   int
+	jobRetryBackoff time.Duration
+
+	spoolDir           string
+	spoolTTL           time.Duration
+	spoolRetryInterval time.Duration
+
+	webhookURL string
+
+	asyncCleanupDelay time.Duration
+
+	minLastSegment float64
+
+	hlsIndependentSegments bool
+
+	// segmentGroupSize is the default segment_group_size; 0 keeps segments
+	// flat next to the playlist
+	segmentGroupSize int64
+
+	maxHeaderBytes int
+	maxBodyBytes   int64
+
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	syncWriteTimeout  time.Duration
+
+	// shutdownTimeout is how long SIGINT/SIGTERM waits for open requests
+	// and the last trace export before exiting
+	shutdownTimeout time.Duration
+
+	// streamProgressInterval is how often stream_progress=true writes a line
+	streamProgressInterval time.Duration
 )
 
 func init() {
 	err := godotenv.Load()
+
+	if err := configureLogging(os.Getenv("LOG_FORMAT")); err != nil {
+		log.Fatalln("Invalid LOG_FORMAT:", err)
+	}
 	if err != nil {
 		log.Println("Warning: .env file not found, using default values")
 	}
@@ -51,171 +104,644 @@ func init() {
 	}
 
 	useSSL = os.Getenv("USE_SSL") == "true"
-}
 
-func main() {
-	http.HandleFunc("/convert", handleConvert)
-	fmt.Println("Server started at 0.0.0.0:8080")
-	http.ListenAndServe("0.0.0.0:8080", nil)
-}
+	primaryStorage = &storageTarget{
+		Name:      "primary",
+		Endpoint:  minioEndpoint,
+		AccessKey: minioAccessKey,
+		SecretKey: minioSecretKey,
+		Bucket:    minioBucket,
+		UseSSL:    useSSL,
+	}
+	// Credentials and bucket default to the primary's, for a second
+	// deployment set up the same way
+	if endpoint := os.Getenv("FALLBACK_MINIO_ENDPOINT"); endpoint != "" {
+		fallbackStorage = &storageTarget{
+			Name:      "fallback",
+			Endpoint:  endpoint,
+			AccessKey: cmp.Or(os.Getenv("FALLBACK_MINIO_ACCESS_KEY"), minioAccessKey),
+			SecretKey: cmp.Or(os.Getenv("FALLBACK_MINIO_SECRET_KEY"), minioSecretKey),
+			Bucket:    cmp.Or(os.Getenv("FALLBACK_MINIO_BUCKET"), minioBucket),
+			UseSSL:    cmp.Or(os.Getenv("FALLBACK_USE_SSL"), os.Getenv("USE_SSL")) == "true",
+		}
+		if port := os.Getenv("FALLBACK_MINIO_PORT"); port != "" {
+			fallbackStorage.Endpoint += ":" + port
+		}
+		if fallbackStorage.Endpoint == minioEndpoint && fallbackStorage.Bucket == minioBucket {
+			log.Fatalln("Invalid FALLBACK_MINIO_ENDPOINT: the fallback is the primary bucket")
+		}
+	}
 
-func uploadToMinio(folder string, objectPrefix string) error {
-	ctx := context.Background()
+	switch publicScheme = os.Getenv("PUBLIC_SCHEME"); publicScheme {
+	case "", "http", "https":
+	default:
+		log.Fatalf("Invalid PUBLIC_SCHEME %q, expected http or https", publicScheme)
+	}
+
+	switch bucketPolicyCheck = os.Getenv("BUCKET_POLICY_CHECK"); bucketPolicyCheck {
+	case "", "warn", "strict":
+	default:
+		log.Fatalf("Invalid BUCKET_POLICY_CHECK %q, expected warn or strict", bucketPolicyCheck)
+	}
+	bucketPublicRead = os.Getenv("BUCKET_PUBLIC_READ") != "false"
+	createBucketIfMissing = os.Getenv("CREATE_BUCKET_IF_MISSING") != "false"
+	selfTest = os.Getenv("SELF_TEST") == "true"
+
+	if expiryDays, err = parseExpiryDays(envList("EXPIRY_DAYS")); err != nil {
+		log.Fatalln("Invalid EXPIRY_DAYS:", err)
+	}
+	if key := os.Getenv("EXPIRY_TAG"); key != "" {
+		expiryTagKey = key
+	}
+	expiryLifecycleSetup = os.Getenv("EXPIRY_LIFECYCLE_SETUP") == "true"
+
+	minioRetryAfter = os.Getenv("MINIO_RETRY_AFTER")
+	if minioRetryAfter == "" {
+		minioRetryAfter = "30"
+	}
+
+	spoolDir = os.Getenv("SPOOL_DIR")
+	spoolTTL = envDuration("SPOOL_TTL", 24*time.Hour)
+	spoolRetryInterval = envDuration("SPOOL_RETRY_INTERVAL", time.Minute)
+
+	webhookURL = os.Getenv("WEBHOOK_URL")
+	eventPrefix = os.Getenv("EVENT_PREFIX")
+
+	jobStateDir = os.Getenv("JOB_STATE_DIR")
+
+	asyncCleanupDelay = envDuration("ASYNC_CLEANUP_DELAY", 0)
+
+	minLastSegment = envDuration("MIN_LAST_SEGMENT", time.Second).Seconds()
+
+	hlsIndependentSegments = os.Getenv("HLS_INDEPENDENT_SEGMENTS") != "false"
+	segmentGroupSize = envInt("SEGMENT_GROUP_SIZE", 0)
+	if mode := os.Getenv("RENDITION_MODE"); mode != "" {
+		if renditionMode, err = parseRenditionMode(mode); err != nil {
+			log.Fatalf("Invalid RENDITION_MODE %q, expected single or parallel", mode)
+		}
+	}
+	renditionParallelism = int(envInt("RENDITION_PARALLELISM", int64(renditionParallelism)))
+	if renditionParallelism < 1 {
+		log.Fatalln("Invalid RENDITION_PARALLELISM: must be positive")
+	}
+	if ladder := envList("AUTO_LADDER_BITRATES"); ladder != nil {
+		if autoLadder, err = parseLadder(ladder); err != nil {
+			log.Fatalln("Invalid AUTO_LADDER_BITRATES:", err)
+		}
+	}
+
+	conversions.limit = int(envInt("MAX_CONCURRENT_CONVERSIONS", 0))
+	conversions.maxQueue = int(envInt("MAX_QUEUE_LENGTH", 0))
+	queueRetryAfter = int(envInt("QUEUE_RETRY_AFTER", 10))
+	batchConcurrency = int(envInt("BATCH_CONCURRENCY", int64(batchConcurrency)))
+	batchMaxConcurrency = int(envInt("BATCH_MAX_CONCURRENCY", int64(batchMaxConcurrency)))
+	batchMaxItems = int(envInt("BATCH_MAX_ITEMS", int64(batchMaxItems)))
+	if batchConcurrency < 1 || batchConcurrency > batchMaxConcurrency {
+		log.Fatalf("Invalid BATCH_CONCURRENCY %d, expected 1-%d (BATCH_MAX_CONCURRENCY)", batchConcurrency, batchMaxConcurrency)
+	}
+	jobMaxRetries = int(envInt("JOB_MAX_RETRIES", 0))
+	jobRetryBackoff = envDuration("JOB_RETRY_BACKOFF", 5*time.Second)
+	// Within the conversions running at once, cap each stage separately
+	downloadSlots = newStageLimiter(int(envInt("MAX_CONCURRENT_DOWNLOADS", 0)))
+	transcodeSlots = newStageLimiter(int(envInt("MAX_CONCURRENT_TRANSCODES", 0)))
+	uploadSlots = newStageLimiter(int(envInt("MAX_CONCURRENT_UPLOADS", 0)))
+
+	maxHeaderBytes = int(envInt("MAX_HEADER_BYTES", 1<<20))
+	maxBodyBytes = envInt("MAX_BODY_BYTES", 10<<20)
+
+	readHeaderTimeout = envDuration("READ_HEADER_TIMEOUT", 10*time.Second)
+	readTimeout = envDuration("READ_TIMEOUT", time.Minute)
+	writeTimeout = envDuration("WRITE_TIMEOUT", time.Minute)
+	idleTimeout = envDuration("IDLE_TIMEOUT", 2*time.Minute)
+	// Sync conversions hold the response open for the whole download,
+	// transcode and upload, so they get their own, much longer deadline
+	syncWriteTimeout = envDuration("SYNC_WRITE_TIMEOUT", 30*time.Minute)
+	shutdownTimeout = envDuration("SHUTDOWN_TIMEOUT", 30*time.Second)
+	streamProgressInterval = envDuration("STREAM_PROGRESS_INTERVAL", 10*time.Second)
+	if streamProgressInterval <= 0 {
+		log.Fatalln("Invalid STREAM_PROGRESS_INTERVAL: must be positive")
+	}
+	inlinePlaylistMaxBytes = envInt("INLINE_PLAYLIST_MAX_BYTES", inlinePlaylistMaxBytes)
 
-	client, err := minio.New(minioEndpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(minioAccessKey, minioSecretKey, ""),
-		Secure: useSSL,
-	})
+	tlsCertFile = os.Getenv("TLS_CERT_FILE")
+	tlsKeyFile = os.Getenv("TLS_KEY_FILE")
+	if err := validateTLSFiles(); err != nil {
+		log.Fatalln("Invalid server TLS configuration:", err)
+	}
+	if serverTLSConfig, err = newServerTLSConfig(os.Getenv("TLS_MIN_VERSION"), envList("TLS_CIPHER_SUITES")); err != nil {
+		log.Fatalln("Invalid server TLS configuration:", err)
+	}
+
+	pprofEnabled = os.Getenv("ENABLE_PPROF") == "true"
+	pprofAddr = os.Getenv("PPROF_ADDR")
+	if pprofAddr == "" {
+		pprofAddr = "127.0.0.1:6060"
+	}
+	if _, port, err := net.SplitHostPort(pprofAddr); err != nil {
+		log.Fatalf("Invalid PPROF_ADDR %q: %v", pprofAddr, err)
+	} else if port == "8080" {
+		log.Fatalln("PPROF_ADDR must not share the public port 8080")
+	}
+
+	if path := os.Getenv("FFMPEG_PATH"); path != "" {
+		ffmpegPath = path
+	}
+	if path := os.Getenv("FFPROBE_PATH"); path != "" {
+		ffprobePath = path
+	}
+
+	if level := os.Getenv("FFMPEG_LOGLEVEL"); level != "" {
+		if !slices.Contains(ffmpegLogLevels, level) {
+			log.Fatalf("Invalid FFMPEG_LOGLEVEL %q, expected one of %s", level, strings.Join(ffmpegLogLevels, ", "))
+		}
+		ffmpegLogLevel = level
+	}
+
+	surroundDownmix = os.Getenv("DOWNMIX_SURROUND") != "false"
+	downmixCenter = envFloat("DOWNMIX_CENTER", downmixCenter)
+	downmixSurround = envFloat("DOWNMIX_SURROUND_LEVEL", downmixSurround)
+	downmixLFE = envFloat("DOWNMIX_LFE", downmixLFE)
+
+	apiKeys = parseAPIKeys(envList("API_KEYS"))
+	adminAPIKey = os.Getenv("ADMIN_API_KEY")
+
+	prefixTemplate = os.Getenv("PREFIX_TEMPLATE")
+	if err := validatePrefixTemplate(prefixTemplate); err != nil {
+		log.Fatalln("Invalid PREFIX_TEMPLATE:", err)
+	}
+
+	usageAllowedPrefixes = envList("USAGE_ALLOWED_PREFIXES")
+	if len(usageAllowedPrefixes) == 0 {
+		usageAllowedPrefixes = []string{defaultObjectPrefix}
+	}
+
+	if limit := envInt("RECENT_JOBS_LIMIT", 100); limit != 100 {
+		jobs = newJobStore(int(limit))
+	}
+
+	minioTransport, err = newMinioTransport(os.Getenv("MINIO_CA_FILE"), os.Getenv("INSECURE_SKIP_VERIFY") == "true")
 	if err != nil {
-		return err
+		log.Fatalln("Failed to configure MinIO TLS:", err)
+	}
+
+	// The timeout covers the whole transfer, so it must allow for large sources
+	downloadTimeout = envDuration("DOWNLOAD_TIMEOUT", 10*time.Minute)
+	downloadMaxIdlePerHost = int(envInt("DOWNLOAD_MAX_IDLE_CONNS_PER_HOST", 16))
+	downloadMaxConnsPerHost = int(envInt("DOWNLOAD_MAX_CONNS_PER_HOST", 0))
+	downloadBufferSize = int(envInt("DOWNLOAD_BUFFER_KB", 0)) << 10
+	sniffInputs = os.Getenv("INPUT_SNIFF") != "false"
+	minInputSize = envInt("MIN_INPUT_BYTES", 64)
+	maxInputSize = envInt("MAX_INPUT_BYTES", 0)
+	downloadRetries = int(envInt("DOWNLOAD_RETRIES", 2))
+	downloadRetryBackoff = envDuration("DOWNLOAD_RETRY_BACKOFF", time.Second)
+	downloadMaxRedirects = int(envInt("DOWNLOAD_MAX_REDIRECTS", 10))
+	downloadBlockPrivate = os.Getenv("DOWNLOAD_BLOCK_PRIVATE_NETWORKS") == "true"
+	if downloadAllowedNetworks, err = parseAllowedNetworks(envList("DOWNLOAD_ALLOWED_NETWORKS")); err != nil {
+		log.Fatalln("Invalid DOWNLOAD_ALLOWED_NETWORKS:", err)
+	}
+	if sourceS3Prefixes, err = parseS3SourcePrefixes(envList("SOURCE_S3_PREFIXES")); err != nil {
+		log.Fatalln("Invalid SOURCE_S3_PREFIXES:", err)
+	}
+	if downloadMaxRedirects < 0 {
+		log.Fatalln("Invalid DOWNLOAD_MAX_REDIRECTS: must not be negative")
 	}
 
-	exists, err := client.BucketExists(ctx, minioBucket)
+	downloadClient, err = newDownloadClient(os.Getenv("DOWNLOAD_PROXY"))
 	if err != nil {
-		return err
+		log.Fatalln("Invalid DOWNLOAD_PROXY:", err)
 	}
-	if !exists {
-		err = client.MakeBucket(ctx, minioBucket, minio.MakeBucketOptions{})
-		if err != nil {
-			return err
-		}
+
+	switch mode := os.Getenv("OBJECT_KEY_MODE"); mode {
+	case "", "ascii":
+	case "unicode":
+		objectKeyMode = mode
+	default:
+		log.Fatalf("Invalid OBJECT_KEY_MODE %q, expected ascii or unicode", mode)
 	}
 
-	// Ensure folder structure
-	if !strings.HasSuffix(objectPrefix, "/") {
-		objectPrefix = objectPrefix + "/"
+	if err := parseContentTypes(os.Getenv("CONTENT_TYPES")); err != nil {
+		log.Fatalln("Invalid CONTENT_TYPES, expected a JSON object of strings:", err)
+	}
+	if err := parseEncodeProfiles(os.Getenv("ENCODE_PROFILES")); err != nil {
+		log.Fatalln("Invalid ENCODE_PROFILES:", err)
+	}
+	if err := parseTenantProfiles(envList("TENANT_PROFILES")); err != nil {
+		log.Fatalln("Invalid TENANT_PROFILES:", err)
 	}
 
-	entries, err := os.ReadDir(folder)
+	downloadUserAgent = os.Getenv("DOWNLOAD_USER_AGENT")
+	downloadHeaders, err = parseDownloadHeaders(os.Getenv("DOWNLOAD_HEADERS"))
 	if err != nil {
-		return err
+		log.Fatalln("Invalid DOWNLOAD_HEADERS, expected a JSON object of strings:", err)
 	}
+}
 
-	for _, entry := range entries {
-		if entry.IsDir() {
-			continue
-		}
+func envDuration(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Invalid %s %q: %v", name, value, err)
+	}
+	return d
+}
+
+// maxJobRetryBackoff caps the doubling wait between job attempts.
+const maxJobRetryBackoff = 5 * time.Minute
+
+func envInt(name string, fallback int64) int64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		log.Fatalf("Invalid %s %q", name, value)
+	}
+	return n
+}
+
+func envFloat(name string, fallback float64) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f < 0 || f > 1 {
+		log.Fatalf("Invalid %s %q, expected a coefficient between 0 and 1", name, value)
+	}
+	return f
+}
 
-		var objectName string
-		switch {
-		case strings.Contains(entry.Name(), "input"):
-			objectName = objectPrefix + "input.wav"
-		case strings.Contains(entry.Name(), "output"):
-			objectName = objectPrefix + "output.m3u8"
-		case strings.Contains(entry.Name(), "segment"):
-			objectName = objectPrefix + entry.Name()
-		default:
-			objectName = objectPrefix + entry.Name()
+// envList splits a comma-separated variable, dropping empty entries.
+func envList(name string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(name), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
 		}
+	}
+	return values
+}
 
-		filePath := filepath.Join(folder, entry.Name())
+func main() {
+	if bucketPolicyCheck != "" {
+		if err := checkBucketPolicy(); err != nil {
+			if bucketPolicyCheck == "strict" {
+				log.Fatalln("Bucket policy check failed:", err)
+			}
+			log.Println("Warning: bucket policy check failed:", err)
+		}
+	}
 
-		opts := minio.PutObjectOptions{}
-		if strings.HasSuffix(objectName, ".m3u8") {
-			opts.ContentType = "application/vnd.apple.mpegurl"
-		} else if strings.HasSuffix(objectName, ".ts") {
-			opts.ContentType = "video/MP2T"
-		} else if strings.HasSuffix(objectName, ".wav") {
-			opts.ContentType = "audio/wav"
+	if expiryLifecycleSetup && len(expiryDays) > 0 {
+		if err := ensureExpiryRules(); err != nil {
+			log.Println("Warning: could not set expiry lifecycle rules:", err)
 		}
+	}
 
-		_, err := client.FPutObject(ctx, minioBucket, objectName, filePath, opts)
-		if err != nil {
-			log.Println("Upload failed for:", filePath, err)
-			return err
+	if selfTest {
+		if err := runSelfTest(); err != nil {
+			log.Fatalln("Self-test failed:", err)
 		}
-		log.Println("Uploaded:", objectName)
 	}
 
-	return nil
+	configureNotifiers()
+	configureTracing()
+
+	if spoolDir != "" {
+		go runSpoolWorker()
+	}
+
+	if jobStateDir != "" {
+		resumeJobs()
+	}
+
+	if pprofEnabled {
+		go startPprofServer()
+	}
+
+	http.HandleFunc("/convert", validateAgainstSpec(handleConvert))
+	http.HandleFunc("POST /convert", handleConvertBody)
+	http.HandleFunc("/status", validateAgainstSpec(handleStatus))
+	http.HandleFunc("POST /batch", validateAgainstSpec(handleBatch))
+	http.HandleFunc("GET /jobs", requireAPIKey(validateAgainstSpec(handleJobs)))
+	http.HandleFunc("DELETE /jobs/{id}", requireAPIKey(handleCancelJob))
+	http.HandleFunc("POST /jobs/{id}/retry_upload", requireAPIKey(handleRetryUpload))
+	http.HandleFunc("POST /admin/reset", requireAdminKey(handleResetJobs))
+	http.HandleFunc("GET /usage", requireAPIKey(validateAgainstSpec(handleUsage)))
+	http.HandleFunc("POST /playlist", requireAPIKey(validateAgainstSpec(handleRegeneratePlaylist)))
+	http.HandleFunc("GET /version", handleVersion)
+	http.HandleFunc("GET /metrics", handleMetrics)
+	http.HandleFunc("GET /openapi.json", handleOpenAPI)
+
+	server := &http.Server{
+		Addr:              "0.0.0.0:8080",
+		Handler:           withRequestID(limitRequestBody(http.DefaultServeMux)),
+		MaxHeaderBytes:    maxHeaderBytes,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+
+	go shutdownOnSignal(server)
+
+	var err error
+	if tlsEnabled() {
+		server.TLSConfig = serverTLSConfig
+		fmt.Println("Server started at https://0.0.0.0:8080")
+		err = server.ListenAndServeTLS(tlsCertFile, tlsKeyFile)
+	} else {
+		fmt.Println("Server started at 0.0.0.0:8080")
+		err = server.ListenAndServe()
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalln(err)
+	}
+	// Shutdown returns ListenAndServe at once; wait for it to finish
+	<-shutdownDone
+}
+
+// shutdownDone is closed once shutdownOnSignal has finished.
+var shutdownDone = make(chan struct{})
+
+// shutdownOnSignal stops server on SIGINT or SIGTERM, letting open requests
+// finish and flushing the traces still queued for export, within
+// SHUTDOWN_TIMEOUT. Async jobs still running are left to JOB_STATE_DIR to
+// resume.
+func shutdownOnSignal(server *http.Server) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
+	defer close(shutdownDone)
+
+	log.Println("Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("Shutdown didn't finish cleanly:", err)
+	}
+	flushTraces(ctx)
 }
 
 func handleConvert(w http.ResponseWriter, r *http.Request) {
-	presignedURL := r.URL.Query().Get("url")
-	if presignedURL == "" {
-		http.Error(w, "Missing 'url' query parameter", http.StatusBadRequest)
+	span := startSpan(traceParent(r), "POST /convert", spanKindServer)
+	defer span.end(nil)
+
+	req, err := parseConvertRequest(r)
+	req.Trace = span.context()
+	if err != nil {
+		writeErr(w, withStatus(http.StatusBadRequest, err))
 		return
 	}
 
-	// Detect file extension from URL
-	var inputExt string
-	if strings.Contains(presignedURL, ".wav") {
-		inputExt = ".wav"
-	} else if strings.Contains(presignedURL, ".mp3") {
-		inputExt = ".mp3"
-	} else {
-		http.Error(w, "Unsupported input format. Only .wav and .mp3 are allowed", http.StatusBadRequest)
+	// WRITE_TIMEOUT is sized for quick API calls; a sync conversion keeps the
+	// connection open until it finishes, so extend the deadline for it alone
+	if !req.Async {
+		if err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(syncWriteTimeout)); err != nil {
+			log.Println("Could not extend write deadline for sync conversion:", err)
+		}
+	}
+
+	if r.URL.Query().Get("debug") == "playlist" {
+		if req.Protocol != "hls" {
+			writeError(w, http.StatusBadRequest, codeBadInput, "debug=playlist is only available for protocol=hls")
+			return
+		}
+		handleDebugPlaylist(w, r, req)
 		return
 	}
 
-	workingDir := filepath.Join(os.TempDir(), "hls-conversion")
-	if err := os.MkdirAll(workingDir, 0755); err != nil {
-		http.Error(w, "Failed to create temp directory", http.StatusInternalServerError)
+	// Don't spend CPU on a conversion whose upload can't succeed
+	if err := minioUnavailable(r.Context()); err != nil {
+		log.Println("MinIO unavailable:", err)
+		w.Header().Set("Retry-After", minioRetryAfter)
+		writeError(w, http.StatusServiceUnavailable, codeStorageUnavailable, "Storage temporarily unavailable, retry later")
+		return
+	}
+
+	t, err := conversions.enqueue()
+	if err != nil {
+		writeBackpressure(w, codeRateLimited, "Too many conversions queued, retry later", queueRetryAfter)
 		return
 	}
-	defer os.RemoveAll(workingDir)
 
-	inputPath := filepath.Join(workingDir, "input"+inputExt)
-	if err := downloadFile(inputPath, presignedURL); err != nil {
-		http.Error(w, "Failed to download file: "+err.Error(), http.StatusInternalServerError)
+	j := jobs.create(req.RefID, requestTenant(r))
+	j.setTicket(t)
+	span.setAttr("job.id", j.ID)
+	slog.Info("job created", "requestID", requestID(r.Context()), "jobID", j.ID, "traceID", span.context().traceID())
+
+	if req.Async {
+		saveJobState(j, r, r.URL.Query(), req.ObjectPrefix)
+		go runJob(context.Background(), j, req)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{
+			"jobId":     j.ID,
+			"status":    string(jobPending),
+			"statusUrl": "/status?id=" + j.ID,
+		})
 		return
 	}
 
-	outputPath := filepath.Join(workingDir, "output.m3u8")
-	segmentPattern := filepath.Join(workingDir, "segment_%03d.ts")
+	if req.StreamProgress {
+		streamConversion(w, r, j, req)
+		return
+	}
 
-	cmd := exec.Command("ffmpeg",
-		"-i", inputPath,
-		"-c:a", "aac", "-b:a", "192k",
-		"-f", "hls",
-		"-hls_time", "2",
-		"-hls_playlist_type", "vod",
-		"-hls_flags", "independent_segments",
-		"-hls_segment_filename", segmentPattern,
-		"-force_key_frames", "expr:gte(t,n_forced*2)",
-		outputPath,
-	)
+	result, err := runJob(r.Context(), j, req)
+	if errors.Is(err, errUploadSpooled) {
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(fmt.Sprintf("⏳ Conversion successful, upload deferred until storage recovers\nStream: %s", result.URL)))
+		return
+	}
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
 
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(resultBody(req, result)))
+}
 
-	if err := cmd.Run(); err != nil {
-		http.Error(w, "FFmpeg conversion failed: "+err.Error(), http.StatusInternalServerError)
+// resultBody is the plain-text response of a finished sync conversion.
+func resultBody(req convertRequest, result conversionResult) string {
+	label := "Stream"
+	if req.Protocol == "file" {
+		label = "File"
+	}
+
+	body := fmt.Sprintf("✅ Conversion successful!\n%s: %s\nManifest: %s", label, result.URL, result.ManifestURL)
+	if result.Skipped {
+		body = fmt.Sprintf("✅ Source unchanged, conversion skipped\n%s: %s\nManifest: %s", label, result.URL, result.ManifestURL)
+	}
+	if result.Loudness != nil {
+		body += fmt.Sprintf("\nLoudness: %.1f LUFS (ReplayGain %+.2f dB)", result.Loudness.IntegratedLUFS, result.Loudness.TrackGainDB)
+	}
+	if result.MasterURL != "" {
+		body += "\nMaster: " + result.MasterURL
+	}
+	for i, part := range result.Parts {
+		body += fmt.Sprintf("\nPart %d: %s", i+1, part)
+	}
+	if result.PreviewURL != "" {
+		body += "\nPreview: " + result.PreviewURL
+	}
+	if len(result.Chapters) > 0 {
+		body = "✅ Conversion successful!"
+		for _, chapter := range result.Chapters {
+			body += fmt.Sprintf("\nChapter %d (%gs-%gs): %s\nManifest: %s", chapter.Index, chapter.Start, chapter.End, chapter.URL, chapter.ManifestURL)
+		}
+	}
+	if result.Attempts > 1 {
+		body += fmt.Sprintf("\nAttempts: %d", result.Attempts)
+	}
+	for _, warning := range result.Warnings {
+		body += "\n⚠️ Warning: " + warning
+	}
+	switch result.PlaylistEncoding {
+	case inlineRaw:
+		body += "\nPlaylist:\n" + result.Playlist
+	case inlineBase64:
+		body += "\nPlaylist (base64): " + result.Playlist
+	}
+	return body
+}
+
+// handleDebugPlaylist runs the real segmentation but returns the generated
+// playlist instead of uploading anything, for checking segment timing.
+func handleDebugPlaylist(w http.ResponseWriter, r *http.Request, req convertRequest) {
+	t, err := conversions.enqueue()
+	if err != nil {
+		writeBackpressure(w, codeRateLimited, "Too many conversions queued, retry later", queueRetryAfter)
+		return
+	}
+	if err := conversions.wait(r.Context(), t); err != nil {
+		writeErr(w, queueWaitError(err))
 		return
 	}
+	defer conversions.release()
+
+	workingDir, err := os.MkdirTemp("", "hls-conversion-")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to create temp directory")
+		return
+	}
+	defer os.RemoveAll(workingDir)
 
-	folderName := "converted-audio/"
-	if err := uploadToMinio(workingDir, folderName); err != nil {
-		http.Error(w, "Upload to MinIO failed: "+err.Error(), http.StatusInternalServerError)
+	inputPath, err := downloadInput(r.Context(), workingDir, req, nil)
+	if err != nil {
+		writeErr(w, err)
 		return
 	}
 
-	protocol := "http"
-	if useSSL {
-		protocol = "https"
+	output, err := transcodeHLS(r.Context(), inputPath, workingDir, req.Encode, req.HLS, nil)
+	if err != nil {
+		writeErr(w, stageError(codeTranscodeFailed, err))
+		return
 	}
 
-	publicM3U8URL := fmt.Sprintf("%s://%s/%s/%soutput.m3u8", protocol, minioEndpoint, minioBucket, folderName)
-	log.Println("✅ Stream available at:", publicM3U8URL)
+	playlist, err := os.ReadFile(output.Path)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to read generated playlist: "+err.Error())
+		return
+	}
 
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(fmt.Sprintf("✅ Conversion successful!\nStream: %s", publicM3U8URL)))
+	w.Write(playlist)
 }
 
+func runJob(ctx context.Context, j *job, req convertRequest) (conversionResult, error) {
+	if req.Async {
+		defer forgetJobState(j.ID)
+	}
 
-func downloadFile(filepath string, url string) error {
-	resp, err := http.Get(url)
-	if err != nil {
-		return err
+	// Either the caller giving up or DELETE /jobs/{id} stops the conversion
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	stop := context.AfterFunc(j.ctx, func() { cancel(context.Cause(j.ctx)) })
+	defer stop()
+
+	if err := conversions.wait(ctx, j.ticket); err != nil {
+		if j.cancelled() {
+			finishCancelled(j)
+			return conversionResult{}, errJobCancelled
+		}
+		err = queueWaitError(err)
+		j.fail(err)
+		return conversionResult{}, err
 	}
-	defer resp.Body.Close()
+	defer conversions.release()
+
+	j.setRunning()
 
-	out, err := os.Create(filepath)
+	started := time.Now()
+	result, err := convertWithRetries(ctx, j, req)
+	if err != nil && j.cancelled() {
+		recordConversion(req, result, jobCancelled, time.Since(started))
+		finishCancelled(j)
+		return result, errJobCancelled
+	}
+	if errors.Is(err, errUploadSpooled) {
+		recordConversion(req, result, jobSpooled, time.Since(started))
+		log.Println("Job", j.ID, "spooled for upload retry")
+		j.spool(result.URL, result.Missing)
+		return result, err
+	}
 	if err != nil {
-		return err
+		recordConversion(req, result, jobFailed, time.Since(started))
+		log.Println("Job", j.ID, "failed:", err)
+		j.fail(err)
+		notifyCompletion(completionEvent{JobID: j.ID, RefID: j.RefID, Status: jobFailed, Error: err.Error(), ErrorCode: errorCode(err), Attempts: result.Attempts})
+		return result, err
 	}
-	defer out.Close()
 
-	_, err = io.Copy(out, resp.Body)
-	return err
+	recordConversion(req, result, jobCompleted, time.Since(started))
+	j.complete(result)
+	notifyCompletion(completionEvent{JobID: j.ID, RefID: j.RefID, Status: jobCompleted, URL: result.URL, ManifestURL: result.ManifestURL, Chapters: result.Chapters, Attempts: result.Attempts})
+	return result, nil
+}
+
+// finishCancelled records that j was stopped through DELETE /jobs/{id}.
+func finishCancelled(j *job) {
+	log.Println("Job", j.ID, "cancelled")
+	j.setCancelled()
+	notifyCompletion(completionEvent{JobID: j.ID, RefID: j.RefID, Status: jobCancelled, Attempts: j.view().Attempts})
+}
+
+// convertWithRetries runs convert up to 1+JOB_MAX_RETRIES times while it
+// fails in a way retryableJobError accepts, doubling JOB_RETRY_BACKOFF
+// between attempts. Each attempt starts over in a fresh working directory.
+func convertWithRetries(ctx context.Context, j *job, req convertRequest) (conversionResult, error) {
+	backoff := jobRetryBackoff
+	for attempt := 1; ; attempt++ {
+		j.setAttempt(attempt)
+		result, err := convert(ctx, j.ID, req, j.setProgress)
+		result.Attempts = attempt
+		if err == nil || errors.Is(err, errUploadSpooled) {
+			return result, err
+		}
+		if attempt > jobMaxRetries || !retryableJobError(err) || ctx.Err() != nil {
+			if attempt > 1 {
+				err = fmt.Errorf("%w (after %d attempts)", err, attempt)
+			}
+			return result, err
+		}
+
+		log.Printf("Job %s attempt %d failed, retrying in %s: %v", j.ID, attempt, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return result, fmt.Errorf("%w (retry cancelled: %v)", err, ctx.Err())
+		}
+		backoff = min(backoff*2, maxJobRetryBackoff)
+	}
 }
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// A debug=playlist request that gives up while queued is told why rather
+// than getting an empty 200.
+func TestDebugPlaylistCancelledWhileQueued(t *testing.T) {
+	previous := conversions
+	conversions = &conversionLimiter{limit: 1}
+	t.Cleanup(func() { conversions = previous })
+	if _, err := conversions.enqueue(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := httptest.NewRequestWithContext(ctx, http.MethodGet, "/convert?url=https://cdn.example/a.wav&debug=playlist", nil)
+	w := httptest.NewRecorder()
+	handleDebugPlaylist(w, r, convertRequest{SourceURL: "https://cdn.example/a.wav", Protocol: "hls"})
+
+	if w.Code == http.StatusOK || !strings.Contains(w.Body.String(), "Conversion cancelled while queued") {
+		t.Errorf("%d %s, want the queue cancellation reported", w.Code, strings.TrimSpace(w.Body.String()))
+	}
+	if queued := len(conversions.queue); queued != 0 {
+		t.Errorf("%d tickets left queued, want the cancelled one gone", queued)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const manifestName = "manifest.json"
+
+// manifest is the per-conversion catalog entry uploaded next to the output.
+// Ingestion reads it instead of inferring structure from object listings.
+type manifest struct {
+	JobID           string            `json:"jobId"`
+	RefID           string            `json:"refId,omitempty"`
+	CreatedAt       time.Time         `json:"createdAt"`
+	Protocol        string            `json:"protocol"`
+	PlaylistURL     string            `json:"playlistUrl,omitempty"`
+	MasterURL       string            `json:"masterUrl,omitempty"`
+	SegmentsURL     string            `json:"segmentsUrl,omitempty"`
+	Parts           []string          `json:"parts,omitempty"`
+	PartMasters     []string          `json:"partMasters,omitempty"`
+	FileURL         string            `json:"fileUrl,omitempty"`
+	Variants        []manifestVariant `json:"variants"`
+	SegmentCount    int               `json:"segmentCount"`
+	DurationSeconds float64           `json:"durationSeconds"`
+	Codec           string            `json:"codec"`
+	Codecs          string            `json:"codecs,omitempty"`
+	Bitrate         string            `json:"bitrate"`
+	Loudness        *loudnessInfo     `json:"loudness,omitempty"`
+	Source          *sourceValidators `json:"source,omitempty"`
+	Preview         *manifestPreview  `json:"preview,omitempty"`
+	Objects         []manifestObject  `json:"objects"`
+}
+
+// manifestPreview is the preview stream published under preview/.
+type manifestPreview struct {
+	PlaylistURL     string  `json:"playlistUrl"`
+	MasterURL       string  `json:"masterUrl,omitempty"`
+	DurationSeconds float64 `json:"durationSeconds"`
+	Bitrate         string  `json:"bitrate"`
+}
+
+type manifestVariant struct {
+	Bitrate     string `json:"bitrate"`
+	Codecs      string `json:"codecs,omitempty"`
+	PlaylistURL string `json:"playlistUrl"`
+}
+
+type manifestObject struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// addObjects records the uploaded objects with their checksums and counts
+// the segments among them.
+func (m *manifest) addObjects(uploaded []uploadedObject) error {
+	m.Objects = make([]manifestObject, 0, len(uploaded))
+	m.SegmentCount = 0
+
+	for _, obj := range uploaded {
+		sum, err := fileSHA256(obj.LocalPath)
+		if err != nil {
+			return err
+		}
+		m.Objects = append(m.Objects, manifestObject{
+			Name:   obj.Name,
+			URL:    obj.URL,
+			Size:   obj.Size,
+			SHA256: sum,
+		})
+		if isSegmentObject(obj.Name) {
+			m.SegmentCount++
+		}
+	}
+	return nil
+}
+
+const segmentIndexName = "segments.json"
+
+// segmentEntry is one line of segments.json, the per-segment size list CDN
+// edges use to plan prefetching and the timeline event sync maps wall-clock
+// time onto.
+type segmentEntry struct {
+	// Index is the segment's media sequence number
+	Index    int     `json:"index"`
+	URI      string  `json:"uri"`
+	URL      string  `json:"url"`
+	Size     int64   `json:"size"`
+	Duration float64 `json:"duration"`
+	// Start is in seconds from the start of the first listed segment, which
+	// for a sliding window is not the start of the stream
+	Start float64 `json:"start"`
+	// ProgramDateTime is the segment's EXT-X-PROGRAM-DATE-TIME, if tagged
+	ProgramDateTime string `json:"programDateTime,omitempty"`
+	// Offset is where a byte-range segment starts within URI; Size is then
+	// the length of the range rather than of the object
+	Offset *int64 `json:"offset,omitempty"`
+}
+
+// segmentIndex lists the playlist's segments in play order with the sizes
+// they were uploaded with, or their byte ranges in a single-file playlist,
+// and their timing as the playlist gives it.
+func segmentIndex(playlist string, objectPrefix string, uploaded []uploadedObject) ([]byte, error) {
+	sizes := make(map[string]int64, len(uploaded))
+	urls := make(map[string]string, len(uploaded))
+	for _, obj := range uploaded {
+		sizes[obj.Name] = obj.Size
+		urls[obj.Name] = obj.URL
+	}
+
+	entries := []segmentEntry{}
+	var duration, start float64
+	var sequence int
+	var programDateTime string
+	// The pending EXT-X-BYTERANGE, and where the last one ended
+	var rangeLength, rangeEnd int64
+	var rangeStart *int64
+	for _, line := range strings.Split(playlist, "\n") {
+		line = strings.TrimSpace(line)
+		if d, ok := extinfDuration(line); ok {
+			duration = d
+			continue
+		}
+		if value, ok := strings.CutPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"); ok {
+			sequence, _ = strconv.Atoi(value)
+			continue
+		}
+		if value, ok := strings.CutPrefix(line, programDateTimeTag); ok {
+			programDateTime = value
+			continue
+		}
+		if value, ok := strings.CutPrefix(line, byteRangeTag); ok {
+			length, offset, hasOffset, err := parseByteRange(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s%s: %w", byteRangeTag, value, err)
+			}
+			if !hasOffset {
+				offset = rangeEnd
+			}
+			rangeLength, rangeStart, rangeEnd = length, &offset, offset+length
+			continue
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entry := segmentEntry{
+			Index:    sequence + len(entries),
+			URI:      line,
+			URL:      urls[objectPrefix+line],
+			Size:     sizes[objectPrefix+line],
+			Duration: duration,
+			// Rounded so summing EXTINFs doesn't leave float noise
+			Start:           math.Round(start*1e6) / 1e6,
+			ProgramDateTime: programDateTime,
+		}
+		if rangeStart != nil {
+			entry.Size, entry.Offset = rangeLength, rangeStart
+			rangeStart = nil
+		}
+		entries = append(entries, entry)
+		start += duration
+		programDateTime = ""
+	}
+	return json.MarshalIndent(map[string]any{"segments": entries}, "", "  ")
+}
+
+func (m *manifest) encode() ([]byte, error) {
+	if m.Variants == nil {
+		m.Variants = []manifestVariant{}
+	}
+	return json.MarshalIndent(m, "", "  ")
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
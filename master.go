@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Every HLS output also gets a master playlist declaring its one audio-only
+// variant, with the CODECS a player needs to pick it without fetching a
+// segment first. The rendition is declared as an EXT-X-MEDIA audio group
+// without a URI, meaning its audio is in the variant's own playlist.
+const (
+	masterPlaylistName = "master.m3u8"
+	masterAudioGroup   = "audio"
+)
+
+// aacObjectTypes are the MPEG-4 audio object types of the AAC profiles as
+// ffprobe names them, the last part of an mp4a.40.N codec string.
+var aacObjectTypes = map[string]int{
+	"Main":     1,
+	"LC":       2,
+	"LTP":      4,
+	"HE-AAC":   5,
+	"HE-AACv2": 29,
+}
+
+// codecsFor is the RFC 6381 codec string of audio in codec and profile, or
+// "" when it isn't known well enough to declare.
+func codecsFor(codec string, profile string) string {
+	switch codec {
+	case "aac":
+		if objectType, ok := aacObjectTypes[profile]; ok {
+			return "mp4a.40." + strconv.Itoa(objectType)
+		}
+		return ""
+	case "mp3":
+		return "mp4a.40.34"
+	case "ac3":
+		return "ac-3"
+	case "eac3":
+		return "ec-3"
+	default:
+		return ""
+	}
+}
+
+// masterName is the master playlist written for the media playlist name:
+// master.m3u8 for the main output, master_<name> for its parts.
+func masterName(playlistName string) string {
+	if playlistName == hlsPlaylistName {
+		return masterPlaylistName
+	}
+	return "master_" + playlistName
+}
+
+// isMasterPlaylist reports whether name is one masterName produces.
+func isMasterPlaylist(name string) bool {
+	return name == masterPlaylistName || (strings.HasPrefix(name, "master_") && strings.HasSuffix(name, ".m3u8"))
+}
+
+// peakBandwidth is the highest bitrate of any one segment of the playlist
+// at playlistPath, in bits per second, as EXT-X-STREAM-INF's BANDWIDTH is
+// meant to be. Segments are measured on disk, or by their byte range with
+// hls_layout=single_file.
+func peakBandwidth(playlistPath string) (int64, error) {
+	raw, err := os.ReadFile(playlistPath)
+	if err != nil {
+		return 0, err
+	}
+
+	var peak, rangeLength int64
+	duration := 0.0
+	for _, line := range strings.Split(string(raw), "\n") {
+		line = strings.TrimSpace(line)
+		if d, ok := extinfDuration(line); ok {
+			duration = d
+			continue
+		}
+		if value, ok := strings.CutPrefix(line, byteRangeTag); ok {
+			if rangeLength, _, _, err = parseByteRange(value); err != nil {
+				return 0, fmt.Errorf("Invalid byte range %q: %w", value, err)
+			}
+			continue
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		size := rangeLength
+		if size == 0 {
+			stat, err := os.Stat(filepath.Join(filepath.Dir(playlistPath), filepath.FromSlash(line)))
+			if err != nil {
+				return 0, err
+			}
+			size = stat.Size()
+		}
+		if duration > 0 {
+			peak = max(peak, int64(math.Ceil(float64(size)*8/duration)))
+		}
+		duration, rangeLength = 0, 0
+	}
+	return peak, nil
+}
+
+// masterVariant is one EXT-X-STREAM-INF entry of a master playlist.
+type masterVariant struct {
+	URI       string
+	Bandwidth int64
+	Codecs    string
+}
+
+// writeMasterPlaylist writes the master playlist for the media playlist at
+// playlistPath next to it and returns its path. codecs may be empty when
+// the audio's codec string isn't known; the attribute is then left out
+// rather than guessed.
+func writeMasterPlaylist(playlistPath string, codecs string) (string, error) {
+	variant, err := measureVariant(playlistPath, filepath.Base(playlistPath), codecs)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(filepath.Dir(playlistPath), masterName(filepath.Base(playlistPath)))
+	return path, writeMaster(path, []masterVariant{variant})
+}
+
+// measureVariant describes the media playlist at playlistPath as a variant
+// listed as uri.
+func measureVariant(playlistPath string, uri string, codecs string) (masterVariant, error) {
+	bandwidth, err := peakBandwidth(playlistPath)
+	if err != nil {
+		return masterVariant{}, err
+	}
+	if bandwidth == 0 {
+		return masterVariant{}, fmt.Errorf("%s lists no segments to measure", uri)
+	}
+	return masterVariant{URI: uri, Bandwidth: bandwidth, Codecs: codecs}, nil
+}
+
+// writeMaster writes a master playlist at path listing variants, which all
+// share the one audio group.
+func writeMaster(path string, variants []masterVariant) error {
+	lines := []string{
+		"#EXTM3U",
+		`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="` + masterAudioGroup + `",NAME="Audio",DEFAULT=YES,AUTOSELECT=YES`,
+	}
+	for _, variant := range variants {
+		streamInf := "#EXT-X-STREAM-INF:BANDWIDTH=" + strconv.FormatInt(variant.Bandwidth, 10)
+		if variant.Codecs != "" {
+			streamInf += `,CODECS="` + variant.Codecs + `"`
+		}
+		streamInf += `,AUDIO="` + masterAudioGroup + `"`
+		lines = append(lines, streamInf, variant.URI)
+	}
+	return os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+// masterVariantURIs returns the media playlists a master playlist lists.
+func masterVariantURIs(playlist string) []string {
+	var uris []string
+	expectURI := false
+	for _, line := range strings.Split(playlist, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#EXT-X-STREAM-INF:") {
+			expectURI = true
+			continue
+		}
+		if expectURI && line != "" && !strings.HasPrefix(line, "#") {
+			uris = append(uris, line)
+			expectURI = false
+		}
+	}
+	return uris
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCodecsFor(t *testing.T) {
+	tests := []struct {
+		codec, profile string
+		want           string
+	}{
+		{"aac", "LC", "mp4a.40.2"},
+		{"aac", "HE-AAC", "mp4a.40.5"},
+		{"aac", "HE-AACv2", "mp4a.40.29"},
+		{"aac", "", ""},
+		{"mp3", "", "mp4a.40.34"},
+		{"ac3", "", "ac-3"},
+		{"eac3", "", "ec-3"},
+		{"opus", "", ""},
+	}
+	for _, tt := range tests {
+		if got := codecsFor(tt.codec, tt.profile); got != tt.want {
+			t.Errorf("codecsFor(%q, %q) = %q, want %q", tt.codec, tt.profile, got, tt.want)
+		}
+	}
+}
+
+func TestWriteMasterPlaylist(t *testing.T) {
+	dir := t.TempDir()
+	playlist := filepath.Join(dir, hlsPlaylistName)
+	writeFile(t, playlist, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:6\n#EXTINF:6.000000,\nsegment_000.ts\n#EXTINF:2.000000,\nsegment_001.ts\n#EXT-X-ENDLIST\n")
+	// 6s at 150000 bytes is 200000 bps, 2s at 75000 bytes is 300000 bps
+	writeFile(t, filepath.Join(dir, "segment_000.ts"), strings.Repeat("x", 150000))
+	writeFile(t, filepath.Join(dir, "segment_001.ts"), strings.Repeat("x", 75000))
+
+	path, err := writeMasterPlaylist(playlist, "mp4a.40.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Base(path) != masterPlaylistName {
+		t.Errorf("master written as %s, want %s", filepath.Base(path), masterPlaylistName)
+	}
+	want := "#EXTM3U\n" +
+		"#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"audio\",NAME=\"Audio\",DEFAULT=YES,AUTOSELECT=YES\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=300000,CODECS=\"mp4a.40.2\",AUDIO=\"audio\"\n" +
+		"output.m3u8\n"
+	if got := readFile(t, path); got != want {
+		t.Errorf("master playlist:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestWriteMasterPlaylistUnknownCodec(t *testing.T) {
+	dir := t.TempDir()
+	playlist := filepath.Join(dir, "part_001.m3u8")
+	writeFile(t, playlist, "#EXTM3U\n#EXTINF:4,\n000/segment_000.ts\n#EXT-X-ENDLIST\n")
+	writeFile(t, filepath.Join(dir, "000", "segment_000.ts"), strings.Repeat("x", 1000))
+
+	path, err := writeMasterPlaylist(playlist, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Base(path) != "master_part_001.m3u8" {
+		t.Errorf("master written as %s, want master_part_001.m3u8", filepath.Base(path))
+	}
+	got := readFile(t, path)
+	if strings.Contains(got, "CODECS") {
+		t.Errorf("CODECS declared for an unknown codec:\n%s", got)
+	}
+	if !strings.Contains(got, "#EXT-X-STREAM-INF:BANDWIDTH=2000,AUDIO=\"audio\"\npart_001.m3u8\n") {
+		t.Errorf("variant doesn't reference the part:\n%s", got)
+	}
+}
+
+func TestPeakBandwidthByteRange(t *testing.T) {
+	dir := t.TempDir()
+	playlist := filepath.Join(dir, hlsPlaylistName)
+	writeFile(t, playlist, "#EXTM3U\n#EXT-X-MAP:URI=\"media.mp4\",BYTERANGE=\"800@0\"\n#EXTINF:4.0,\n#EXT-X-BYTERANGE:4000@800\nmedia.mp4\n#EXTINF:4.0,\n#EXT-X-BYTERANGE:8000\nmedia.mp4\n#EXT-X-ENDLIST\n")
+
+	got, err := peakBandwidth(playlist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 16000 {
+		t.Errorf("peakBandwidth = %d, want 16000", got)
+	}
+}
+
+func writeFile(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(raw)
+}
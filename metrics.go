@@ -0,0 +1,166 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics are served at /metrics in the Prometheus text format. Like
+// tracing, the client library isn't a dependency: a counter and a
+// histogram keyed by a fixed label set are all the conversions need.
+//
+// Every label value is checked against an allowlist, anything else is
+// reported as "other", so the number of series stays bounded whatever
+// callers send.
+var (
+	metricOutputCodecs    = []string{"aac", "mp3", "ac3", "eac3"}
+	metricOutputBitrates  = []string{"32k", "48k", "64k", "96k", "128k", "160k", "192k", "256k", "320k"}
+	conversionBuckets     = []float64{1, 5, 10, 30, 60, 120, 300, 600, 1800}
+	conversionMetricsLock sync.Mutex
+	conversionCounts      = map[conversionLabels]int64{}
+	conversionDurations   = map[conversionLabels]*histogram{}
+)
+
+// conversionLabels describe what a conversion read and wrote. Status is
+// left empty for the duration histogram, which only counts completed ones.
+type conversionLabels struct {
+	InputFormat   string
+	OutputCodec   string
+	OutputBitrate string
+	Status        string
+}
+
+type histogram struct {
+	// counts[i] is the observations <= conversionBuckets[i]; the last entry
+	// is +Inf
+	counts []int64
+	sum    float64
+	total  int64
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range conversionBuckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.counts[len(conversionBuckets)]++
+	h.sum += v
+	h.total++
+}
+
+// metricLabel returns value when it is one of allowed, "unknown" when it is
+// empty and "other" otherwise.
+func metricLabel(value string, allowed []string) string {
+	switch {
+	case value == "":
+		return "unknown"
+	case slices.Contains(allowed, value):
+		return value
+	default:
+		return "other"
+	}
+}
+
+// recordConversion counts a conversion that ran, and for completed ones
+// observes how long it took.
+func recordConversion(req convertRequest, result conversionResult, status jobStatus, elapsed time.Duration) {
+	labels := conversionLabels{
+		InputFormat:   metricLabel(strings.TrimPrefix(req.InputExt, "."), metricInputFormats()),
+		OutputCodec:   metricLabel(result.Codec, metricOutputCodecs),
+		OutputBitrate: metricLabel(result.Bitrate, metricOutputBitrates),
+		Status:        string(status),
+	}
+	if result.Skipped {
+		labels.Status = "skipped"
+	}
+
+	conversionMetricsLock.Lock()
+	defer conversionMetricsLock.Unlock()
+	conversionCounts[labels]++
+	if labels.Status != string(jobCompleted) {
+		return
+	}
+	labels.Status = ""
+	h := conversionDurations[labels]
+	if h == nil {
+		h = &histogram{counts: make([]int64, len(conversionBuckets)+1)}
+		conversionDurations[labels] = h
+	}
+	h.observe(elapsed.Seconds())
+}
+
+func metricInputFormats() []string {
+	formats := make([]string, len(inputFormats))
+	for i, ext := range inputFormats {
+		formats[i] = strings.TrimPrefix(ext, ".")
+	}
+	return formats
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	conversionMetricsLock.Lock()
+	defer conversionMetricsLock.Unlock()
+
+	var b strings.Builder
+	b.WriteString("# HELP encoder_conversions_total Conversions that ran, by input format, output codec and bitrate, and outcome.\n")
+	b.WriteString("# TYPE encoder_conversions_total counter\n")
+	for _, labels := range sortedLabels(conversionCounts) {
+		fmt.Fprintf(&b, "encoder_conversions_total{%s} %d\n", labels.format(""), conversionCounts[labels])
+	}
+
+	b.WriteString("# HELP encoder_conversion_duration_seconds Time from a completed conversion starting to finishing, queueing excluded.\n")
+	b.WriteString("# TYPE encoder_conversion_duration_seconds histogram\n")
+	for _, labels := range sortedLabels(conversionDurations) {
+		h := conversionDurations[labels]
+		for i, bound := range conversionBuckets {
+			fmt.Fprintf(&b, "encoder_conversion_duration_seconds_bucket{%s} %d\n", labels.format(strconv.FormatFloat(bound, 'f', -1, 64)), h.counts[i])
+		}
+		fmt.Fprintf(&b, "encoder_conversion_duration_seconds_bucket{%s} %d\n", labels.format("+Inf"), h.counts[len(conversionBuckets)])
+		fmt.Fprintf(&b, "encoder_conversion_duration_seconds_sum{%s} %g\n", labels.format(""), h.sum)
+		fmt.Fprintf(&b, "encoder_conversion_duration_seconds_count{%s} %d\n", labels.format(""), h.total)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
+
+// format renders the labels for an exposition line, with le when set. The
+// values come from allowlists, so none need escaping.
+func (l conversionLabels) format(le string) string {
+	parts := []string{
+		`input_format="` + l.InputFormat + `"`,
+		`output_codec="` + l.OutputCodec + `"`,
+		`output_bitrate="` + l.OutputBitrate + `"`,
+	}
+	if l.Status != "" {
+		parts = append(parts, `status="`+l.Status+`"`)
+	}
+	if le != "" {
+		parts = append(parts, `le="`+le+`"`)
+	}
+	return strings.Join(parts, ",")
+}
+
+// sortedLabels keeps the exposition order stable between scrapes.
+func sortedLabels[V any](m map[conversionLabels]V) []conversionLabels {
+	keys := make([]conversionLabels, 0, len(m))
+	for labels := range m {
+		keys = append(keys, labels)
+	}
+	slices.SortFunc(keys, func(a, b conversionLabels) int {
+		return cmp.Or(
+			cmp.Compare(a.InputFormat, b.InputFormat),
+			cmp.Compare(a.OutputCodec, b.OutputCodec),
+			cmp.Compare(a.OutputBitrate, b.OutputBitrate),
+			cmp.Compare(a.Status, b.Status),
+		)
+	})
+	return keys
+}
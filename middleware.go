@@ -0,0 +1,31 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// limitRequestBody caps request bodies at maxBodyBytes. Declared oversized
+// bodies are rejected up front; others fail with 413 once the handler reads
+// past the limit.
+func limitRequestBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > maxBodyBytes {
+			writeError(w, http.StatusRequestEntityTooLarge, codeBodyTooLarge, "Request body too large")
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeBodyError reports a request body that couldn't be decoded: as 413,
+// the same as a declared oversized body, when it ran past limitRequestBody,
+// and as a 400 saying what was wrong with it otherwise.
+func writeBodyError(w http.ResponseWriter, what string, err error) {
+	if errors.As(err, new(*http.MaxBytesError)) {
+		writeError(w, http.StatusRequestEntityTooLarge, codeBodyTooLarge, "Request body too large")
+		return
+	}
+	writeError(w, http.StatusBadRequest, codeBadInput, "Invalid "+what+" body: "+err.Error())
+}
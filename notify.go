@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+type completionEvent struct {
+	JobID       string          `json:"jobId"`
+	RefID       string          `json:"refId,omitempty"`
+	Status      jobStatus       `json:"status"`
+	URL         string          `json:"url,omitempty"`
+	ManifestURL string          `json:"manifestUrl,omitempty"`
+	Chapters    []chapterResult `json:"chapters,omitempty"`
+	Error       string          `json:"error,omitempty"`
+	ErrorCode   string          `json:"errorCode,omitempty"`
+	Attempts    int             `json:"attempts,omitempty"`
+}
+
+// notifier is one destination for completion events.
+type notifier interface {
+	name() string
+	notify(body []byte, ev completionEvent) error
+}
+
+// notifiers are the sinks configured at startup, see configureNotifiers.
+var notifiers []notifier
+
+// optionalNotifiers build sinks compiled in behind build tags. Each returns
+// false when its configuration is absent.
+var optionalNotifiers []func() (notifier, bool)
+
+func configureNotifiers() {
+	if webhookURL != "" {
+		notifiers = append(notifiers, webhookNotifier{url: webhookURL})
+	}
+	if eventPrefix != "" {
+		notifiers = append(notifiers, minioEventNotifier{prefix: eventPrefix})
+	}
+	for _, build := range optionalNotifiers {
+		if n, ok := build(); ok {
+			notifiers = append(notifiers, n)
+		}
+	}
+}
+
+// notifyCompletion hands the event to every sink in the background. Sinks
+// run independently, so a slow or failing one never holds up a conversion
+// or the other sinks.
+func notifyCompletion(ev completionEvent) {
+	if len(notifiers) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(ev)
+	if err != nil {
+		log.Println("Failed to encode completion event:", err)
+		return
+	}
+
+	for _, n := range notifiers {
+		go func() {
+			if err := n.notify(body, ev); err != nil {
+				log.Println("Notification via", n.name(), "failed for job", ev.JobID, err)
+			}
+		}()
+	}
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// webhookNotifier posts the event to WEBHOOK_URL.
+type webhookNotifier struct {
+	url string
+}
+
+func (n webhookNotifier) name() string { return "webhook" }
+
+func (n webhookNotifier) notify(body []byte, ev completionEvent) error {
+	resp, err := webhookClient.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// eventPrefix is EVENT_PREFIX; when set, events are also written to the
+// bucket for consumers that watch it with MinIO bucket notifications.
+var eventPrefix string
+
+// minioEventNotifier stores each event as <prefix><jobId>-<status>.json.
+type minioEventNotifier struct {
+	prefix string
+}
+
+func (n minioEventNotifier) name() string { return "minio" }
+
+func (n minioEventNotifier) notify(body []byte, ev completionEvent) error {
+	return putObjectBytes(n.prefix+ev.JobID+"-"+string(ev.Status)+".json", body, objectOptions{})
+}
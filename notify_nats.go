@@ -0,0 +1,93 @@
+//go:build nats
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Build with -tags nats to publish completion events to NATS_SUBJECT
+// (default encoder.completed) on NATS_URL. It speaks the plain NATS text
+// protocol, one short connection per event, so no client library is needed.
+func init() {
+	optionalNotifiers = append(optionalNotifiers, newNATSNotifier)
+}
+
+type natsNotifier struct {
+	server  *url.URL
+	subject string
+}
+
+func newNATSNotifier() (notifier, bool) {
+	raw := os.Getenv("NATS_URL")
+	if raw == "" {
+		return nil, false
+	}
+	server, err := url.Parse(raw)
+	if err != nil || server.Host == "" {
+		fmt.Fprintf(os.Stderr, "Invalid NATS_URL %q, NATS notifications disabled\n", raw)
+		return nil, false
+	}
+
+	subject := os.Getenv("NATS_SUBJECT")
+	if subject == "" {
+		subject = "encoder.completed"
+	}
+	return natsNotifier{server: server, subject: subject}, true
+}
+
+func (n natsNotifier) name() string { return "nats" }
+
+func (n natsNotifier) notify(body []byte, ev completionEvent) error {
+	host := n.server.Host
+	if n.server.Port() == "" {
+		host = net.JoinHostPort(n.server.Hostname(), "4222")
+	}
+
+	conn, err := net.DialTimeout("tcp", host, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	reader := bufio.NewReader(conn)
+	if line, err := reader.ReadString('\n'); err != nil {
+		return err
+	} else if !strings.HasPrefix(line, "INFO") {
+		return fmt.Errorf("unexpected greeting %q", strings.TrimSpace(line))
+	}
+
+	options := map[string]any{"verbose": false, "pedantic": false, "name": "encoder-go"}
+	if user := n.server.User; user != nil {
+		options["user"] = user.Username()
+		options["pass"], _ = user.Password()
+	}
+	connect, err := json.Marshal(options)
+	if err != nil {
+		return err
+	}
+
+	// PING makes the server answer once it has processed the PUB, so an
+	// error like a permissions violation is seen rather than dropped
+	fmt.Fprintf(conn, "CONNECT %s\r\nPUB %s %d\r\n%s\r\nPING\r\n", connect, n.subject, len(body), body)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		switch line = strings.TrimSpace(line); {
+		case line == "PONG":
+			return nil
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("nats: %s", line)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// openAPIDocument is served as-is at /openapi.json and is also what query
+// parameters are validated against, so the two can't drift apart.
+//
+//go:embed openapi.json
+var openAPIDocument []byte
+
+type openAPISchema struct {
+	Type             string   `json:"type"`
+	Enum             []string `json:"enum"`
+	Pattern          string   `json:"pattern"`
+	Minimum          *float64 `json:"minimum"`
+	Maximum          *float64 `json:"maximum"`
+	ExclusiveMinimum bool     `json:"exclusiveMinimum"`
+
+	pattern *regexp.Regexp
+}
+
+type openAPIParameter struct {
+	Name     string        `json:"name"`
+	In       string        `json:"in"`
+	Required bool          `json:"required"`
+	Schema   openAPISchema `json:"schema"`
+}
+
+type openAPIOperation struct {
+	Parameters []openAPIParameter `json:"parameters"`
+}
+
+type openAPISpec struct {
+	Paths map[string]map[string]*openAPIOperation `json:"paths"`
+}
+
+var apiSpec = mustParseOpenAPI(openAPIDocument)
+
+func mustParseOpenAPI(doc []byte) *openAPISpec {
+	var spec openAPISpec
+	if err := json.Unmarshal(doc, &spec); err != nil {
+		panic("invalid openapi.json: " + err.Error())
+	}
+
+	for _, methods := range spec.Paths {
+		for _, op := range methods {
+			for i := range op.Parameters {
+				schema := &op.Parameters[i].Schema
+				if schema.Pattern != "" {
+					schema.pattern = regexp.MustCompile(schema.Pattern)
+				}
+			}
+		}
+	}
+	return &spec
+}
+
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIDocument)
+}
+
+// validateQuery checks the query string against the parameters documented
+// for path and method. Undocumented parameters are rejected.
+func (s *openAPISpec) validateQuery(path string, method string, q url.Values) error {
+	op := s.Paths[path][strings.ToLower(method)]
+	if op == nil {
+		return nil
+	}
+
+	known := make([]string, 0, len(op.Parameters))
+	for _, param := range op.Parameters {
+		if param.In != "query" {
+			continue
+		}
+		known = append(known, param.Name)
+
+		value := q.Get(param.Name)
+		if value == "" {
+			if param.Required {
+				return fmt.Errorf("Missing '%s' query parameter", param.Name)
+			}
+			continue
+		}
+		if err := param.Schema.validate(value); err != nil {
+			return fmt.Errorf("Invalid '%s' query parameter: %v", param.Name, err)
+		}
+	}
+
+	for name := range q {
+		if !slices.Contains(known, name) {
+			return fmt.Errorf("Unknown query parameter '%s'", name)
+		}
+	}
+	return nil
+}
+
+func (s openAPISchema) validate(value string) error {
+	switch s.Type {
+	case "boolean":
+		if value != "true" && value != "false" {
+			return fmt.Errorf("expected true or false, got %q", value)
+		}
+	case "integer", "number":
+		var n float64
+		var err error
+		if s.Type == "integer" {
+			var i int64
+			i, err = strconv.ParseInt(value, 10, 64)
+			n = float64(i)
+		} else {
+			n, err = strconv.ParseFloat(value, 64)
+		}
+		if err != nil {
+			return fmt.Errorf("expected a %s, got %q", s.Type, value)
+		}
+		if s.Minimum != nil && (n < *s.Minimum || (s.ExclusiveMinimum && n == *s.Minimum)) {
+			return fmt.Errorf("must be greater than %g", *s.Minimum)
+		}
+		if s.Maximum != nil && n > *s.Maximum {
+			return fmt.Errorf("must be at most %g", *s.Maximum)
+		}
+	}
+
+	if len(s.Enum) > 0 && !slices.Contains(s.Enum, value) {
+		return fmt.Errorf("must be one of %s", strings.Join(s.Enum, ", "))
+	}
+	if s.pattern != nil && !s.pattern.MatchString(value) {
+		return fmt.Errorf("must match %s", s.Pattern)
+	}
+	return nil
+}
+
+// validateAgainstSpec rejects requests whose query doesn't match the
+// OpenAPI document before they reach the handler.
+func validateAgainstSpec(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := apiSpec.validateQuery(r.URL.Path, r.Method, r.URL.Query()); err != nil {
+			writeError(w, http.StatusBadRequest, codeBadInput, err.Error())
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestValidateQueryExamples(t *testing.T) {
+	tests := []struct {
+		query   string
+		wantErr string
+	}{
+		{query: "url=https://example.com/a.wav"},
+		{query: "url=https://example.com/a.wav&bitrate=128k&segment_duration=4&protocol=hls"},
+		{query: "url=https://example.com/a.wav&bitrate=auto&async=true&inline_playlist=base64"},
+		{query: "url=https://example.com/a.wav&renditions=64k,128k&rendition_mode=parallel"},
+		{query: "url=https://example.com/a.wav&auto_ladder=true"},
+		{query: "bitrate=128k", wantErr: "Missing 'url'"},
+		{query: "url=https://example.com/a.wav&bitrate=loud", wantErr: "Invalid 'bitrate'"},
+		{query: "url=https://example.com/a.wav&async=yes", wantErr: "Invalid 'async'"},
+		{query: "url=https://example.com/a.wav&segment_group_size=-1", wantErr: "Invalid 'segment_group_size'"},
+		{query: "url=https://example.com/a.wav&inline_playlist=gzip", wantErr: "Invalid 'inline_playlist'"},
+		{query: "url=https://example.com/a.wav&renditions=64k", wantErr: "Invalid 'renditions'"},
+		{query: "url=https://example.com/a.wav&bitrates=128k", wantErr: "Unknown query parameter 'bitrates'"},
+	}
+	for _, tt := range tests {
+		q, err := url.ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = apiSpec.validateQuery("/convert", http.MethodGet, q)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: %v", tt.query, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s: got %v, want %q", tt.query, err, tt.wantErr)
+		}
+	}
+}
+
+// Every query parameter a handler reads has to be in openapi.json, or
+// validateQuery rejects it before the handler ever sees it. The pprof
+// endpoints are on their own listener and aren't part of the API.
+func TestQueryParametersDocumented(t *testing.T) {
+	documented := map[string]bool{}
+	for _, methods := range apiSpec.Paths {
+		for _, op := range methods {
+			for _, param := range op.Parameters {
+				if param.In == "query" {
+					documented[param.Name] = true
+				}
+			}
+		}
+	}
+
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	read := 0
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") || file == "pprof.go" {
+			continue
+		}
+		parsed, err := parser.ParseFile(fset, file, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ast.Inspect(parsed, func(n ast.Node) bool {
+			name, ok := queryParameterRead(n)
+			if !ok {
+				return true
+			}
+			read++
+			if !documented[name] {
+				t.Errorf("%s reads query parameter %q, which openapi.json doesn't document", fset.Position(n.Pos()), name)
+			}
+			return true
+		})
+	}
+	if read == 0 {
+		t.Fatal("found no query parameter reads to check")
+	}
+}
+
+// queryParameterRead matches q.Get("name"), q.Has("name") and
+// r.URL.Query().Get("name").
+func queryParameterRead(n ast.Node) (string, bool) {
+	call, ok := n.(*ast.CallExpr)
+	if !ok || len(call.Args) != 1 {
+		return "", false
+	}
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok || !slices.Contains([]string{"Get", "Has"}, sel.Sel.Name) {
+		return "", false
+	}
+	switch x := sel.X.(type) {
+	case *ast.Ident:
+		if x.Name != "q" && x.Name != "query" {
+			return "", false
+		}
+	case *ast.CallExpr:
+		if fun, ok := x.Fun.(*ast.SelectorExpr); !ok || fun.Sel.Name != "Query" {
+			return "", false
+		}
+	default:
+		return "", false
+	}
+	lit, ok := call.Args[0].(*ast.BasicLit)
+	if !ok || lit.Kind != token.STRING {
+		return "", false
+	}
+	name, err := strconv.Unquote(lit.Value)
+	return name, err == nil
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// allowedHLSFlags are the -hls_flags values callers may request. Anything
+// else is rejected so query input can't smuggle options into ffmpeg.
+var allowedHLSFlags = []string{
+	"append_list",
+	"delete_segments",
+	"discont_start",
+	"omit_endlist",
+	"program_date_time",
+	"round_durations",
+	"split_by_time",
+	"temp_file",
+}
+
+// allowedMpegTSFlags are the -mpegts_flags values callers may request for
+// the TS segments, for devices that need, say, a PAT/PMT ahead of every
+// keyframe. LATM is chosen with aac_framing instead.
+var allowedMpegTSFlags = []string{
+	"initial_discontinuity",
+	"nit",
+	"omit_rai",
+	"pat_pmt_at_frames",
+	"resend_headers",
+	"system_b",
+}
+
+// keyframeExprPattern is the only -force_key_frames shape accepted from
+// callers: a keyframe every N seconds.
+var keyframeExprPattern = regexp.MustCompile(`^expr:gte\(t,n_forced\*(\d+(?:\.\d+)?)\)$`)
+
+const (
+	defaultSegmentDuration = 2
+	maxSegmentDuration     = 60
+	maxTargetDuration      = 2 * maxSegmentDuration
+	// maxHLSVersion is the highest EXT-X-VERSION RFC 8216 defines
+	maxHLSVersion = 7
+)
+
+type hlsOptions struct {
+	Flags []string
+
+	SegmentDuration  float64
+	KeyframeInterval float64
+
+	// ListSize, when non-zero, keeps only the last ListSize segments in
+	// the playlist and deletes the ones that roll off
+	ListSize int64
+
+	// PadLastSegment pads the audio with silence up to the next segment
+	// boundary so the stream never ends on a sub-second tail
+	PadLastSegment bool
+
+	// StartNumber is the index of the first segment, for continuing an
+	// existing stream under the same prefix
+	StartNumber int64
+
+	// ProgramDateTime, when set, is the wall-clock time of the first segment
+	ProgramDateTime *time.Time
+
+	// MaxPlaylistSegments, when non-zero, also splits a longer playlist into
+	// part playlists of at most this many segments for players that can't
+	// cope with very long ones
+	MaxPlaylistSegments int64
+
+	// SegmentGroupSize, when non-zero, moves segments into subfolders of
+	// this many, numbered by segment index, for buckets that limit the
+	// objects per prefix
+	SegmentGroupSize int64
+
+	// TargetDuration, when non-zero, replaces ffmpeg's EXT-X-TARGETDURATION;
+	// TargetDurationAuto sets it to what the segments require instead
+	TargetDuration     int64
+	TargetDurationAuto bool
+
+	// Version, when non-zero, replaces ffmpeg's EXT-X-VERSION. It can't be
+	// below what the playlist's tags require.
+	Version int64
+
+	// MpegTSFlags are passed to the segments' mpegts muxer. The AAC in the
+	// segments is ADTS framed unless they include "latm".
+	MpegTSFlags []string
+	// SingleFile is hls_layout=single_file: one fragmented MP4 holding every
+	// segment, which the playlist addresses with EXT-X-BYTERANGE
+	SingleFile bool
+}
+
+func parseHLSOptions(q url.Values) (hlsOptions, error) {
+	opts := hlsOptions{SegmentDuration: defaultSegmentDuration}
+
+	if raw := q.Get("segment_duration"); raw != "" {
+		d, err := parseSeconds(raw, maxSegmentDuration)
+		if err != nil {
+			return opts, fmt.Errorf("Invalid 'segment_duration': %v", err)
+		}
+		opts.SegmentDuration = d
+	}
+
+	// Keyframes default to segment boundaries so every segment starts on one
+	opts.KeyframeInterval = opts.SegmentDuration
+	rawInterval, rawExpr := q.Get("keyframe_interval"), q.Get("force_key_frames")
+	switch {
+	case rawInterval != "" && rawExpr != "":
+		return opts, errors.New("Only one of 'keyframe_interval' and 'force_key_frames' may be set")
+	case rawInterval != "":
+		d, err := parseSeconds(rawInterval, maxSegmentDuration)
+		if err != nil {
+			return opts, fmt.Errorf("Invalid 'keyframe_interval': %v", err)
+		}
+		opts.KeyframeInterval = d
+	case rawExpr != "":
+		m := keyframeExprPattern.FindStringSubmatch(rawExpr)
+		if m == nil {
+			return opts, errors.New("Invalid 'force_key_frames', expected the form expr:gte(t,n_forced*N)")
+		}
+		d, err := parseSeconds(m[1], maxSegmentDuration)
+		if err != nil {
+			return opts, fmt.Errorf("Invalid 'force_key_frames': %v", err)
+		}
+		opts.KeyframeInterval = d
+	}
+
+	independent := hlsIndependentSegments
+	if raw := q.Get("independent_segments"); raw != "" {
+		switch raw {
+		case "true":
+			independent = true
+		case "false":
+			independent = false
+		default:
+			return opts, fmt.Errorf("Invalid 'independent_segments' value %q, expected true or false", raw)
+		}
+	}
+	if independent {
+		opts.Flags = append(opts.Flags, "independent_segments")
+	}
+
+	opts.PadLastSegment = q.Get("pad_last_segment") == "true"
+
+	if raw := q.Get("start_number"); raw != "" {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n < 0 {
+			return opts, fmt.Errorf("Invalid 'start_number' %q, expected a non-negative integer", raw)
+		}
+		opts.StartNumber = n
+	}
+
+	if raw := q.Get("hls_list_size"); raw != "" {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n < 1 {
+			return opts, fmt.Errorf("Invalid 'hls_list_size' %q, expected a positive integer", raw)
+		}
+		opts.ListSize = n
+	}
+
+	if raw := q.Get("max_playlist_segments"); raw != "" {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n < 1 {
+			return opts, fmt.Errorf("Invalid 'max_playlist_segments' %q, expected a positive integer", raw)
+		}
+		if opts.ListSize > 0 {
+			return opts, errors.New("'max_playlist_segments' can't be combined with 'hls_list_size'")
+		}
+		opts.MaxPlaylistSegments = n
+	}
+
+	opts.SegmentGroupSize = segmentGroupSize
+	if raw := q.Get("segment_group_size"); raw != "" {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n < 0 {
+			return opts, fmt.Errorf("Invalid 'segment_group_size' %q, expected a non-negative integer", raw)
+		}
+		opts.SegmentGroupSize = n
+	}
+
+	if raw := q.Get("hls_flags"); raw != "" {
+		for _, flag := range strings.Split(raw, ",") {
+			flag = strings.TrimSpace(flag)
+			if !slices.Contains(allowedHLSFlags, flag) {
+				return opts, fmt.Errorf("Unsupported hls flag %q, allowed: %s", flag, strings.Join(allowedHLSFlags, ", "))
+			}
+			if !slices.Contains(opts.Flags, flag) {
+				opts.Flags = append(opts.Flags, flag)
+			}
+		}
+	}
+
+	// Strict players reject EXTINF durations that round above the target
+	// or a target well above them, and ffmpeg can be off by one either way
+	switch raw := q.Get("target_duration"); raw {
+	case "":
+	case "auto":
+		opts.TargetDurationAuto = true
+	default:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n < 1 || n > maxTargetDuration {
+			return opts, fmt.Errorf("Invalid 'target_duration' %q, expected \"auto\" or 1-%d", raw, maxTargetDuration)
+		}
+		opts.TargetDuration = n
+	}
+
+	if raw := q.Get("hls_version"); raw != "" {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n < 1 || n > maxHLSVersion {
+			return opts, fmt.Errorf("Invalid 'hls_version' %q, expected 1-%d", raw, maxHLSVersion)
+		}
+		opts.Version = n
+	}
+
+	switch framing := q.Get("aac_framing"); framing {
+	case "", "adts":
+	case "latm":
+		opts.MpegTSFlags = append(opts.MpegTSFlags, "latm")
+	default:
+		return opts, fmt.Errorf("Unsupported aac_framing %q. Only adts and latm are allowed", framing)
+	}
+
+	if raw := q.Get("mpegts_flags"); raw != "" {
+		for _, flag := range strings.Split(raw, ",") {
+			flag = strings.TrimSpace(flag)
+			if !slices.Contains(allowedMpegTSFlags, flag) {
+				return opts, fmt.Errorf("Unsupported mpegts flag %q, allowed: %s", flag, strings.Join(allowedMpegTSFlags, ", "))
+			}
+			if !slices.Contains(opts.MpegTSFlags, flag) {
+				opts.MpegTSFlags = append(opts.MpegTSFlags, flag)
+			}
+		}
+	}
+
+	if raw := q.Get("program_date_time"); raw != "" {
+		start := time.Now()
+		if raw != "now" {
+			parsed, err := time.Parse(time.RFC3339Nano, raw)
+			if err != nil {
+				return opts, fmt.Errorf("Invalid 'program_date_time' %q, expected \"now\" or an ISO 8601 timestamp", raw)
+			}
+			start = parsed
+		}
+		opts.ProgramDateTime = &start
+	}
+
+	switch layout := q.Get("hls_layout"); layout {
+	case "", "segments":
+	case "single_file":
+		if err := opts.singleFileConflict(q); err != nil {
+			return opts, err
+		}
+		opts.SingleFile = true
+		// The env default doesn't apply: there are no segment files to group
+		opts.SegmentGroupSize = 0
+	default:
+		return opts, fmt.Errorf("Unsupported hls_layout %q. Only segments and single_file are allowed", layout)
+	}
+
+	if opts.ListSize > 0 && !slices.Contains(opts.Flags, "delete_segments") {
+		opts.Flags = append(opts.Flags, "delete_segments")
+	}
+
+	return opts, nil
+}
+
+// singleFileConflict rejects the options that only make sense for separate
+// segment files, or for TS segments.
+func (o hlsOptions) singleFileConflict(q url.Values) error {
+	for _, param := range []string{"hls_list_size", "max_playlist_segments", "segment_group_size", "aac_framing", "mpegts_flags"} {
+		if q.Get(param) != "" {
+			return fmt.Errorf("'%s' can't be combined with hls_layout=single_file", param)
+		}
+	}
+	return nil
+}
+
+// lastSegmentDuration returns how long the final segment of a duration-long
+// input will be, or 0 when it is unknown or a full segment.
+func (o hlsOptions) lastSegmentDuration(duration float64) float64 {
+	if duration <= 0 {
+		return 0
+	}
+	tail := math.Mod(duration, o.SegmentDuration)
+	// Ignore float noise when the duration is an exact multiple
+	if tail < 0.001 || o.SegmentDuration-tail < 0.001 {
+		return 0
+	}
+	return tail
+}
+
+func parseSeconds(raw string, max float64) (float64, error) {
+	d, err := strconv.ParseFloat(raw, 64)
+	if err != nil || math.IsNaN(d) || d <= 0 || d > max {
+		return 0, fmt.Errorf("expected a number of seconds between 0 and %g, got %q", max, raw)
+	}
+	return d, nil
+}
+
+func formatSeconds(d float64) string {
+	return strconv.FormatFloat(d, 'f', -1, 64)
+}
+
+func (o hlsOptions) ffmpegArgs() []string {
+	var args []string
+	if o.ListSize > 0 {
+		// A VOD playlist always lists every segment, so a window can't be one
+		args = append(args, "-hls_list_size", strconv.FormatInt(o.ListSize, 10))
+	} else {
+		args = append(args, "-hls_playlist_type", "vod")
+	}
+
+	args = append(args,
+		"-hls_time", formatSeconds(o.SegmentDuration),
+		"-force_key_frames", "expr:gte(t,n_forced*"+formatSeconds(o.KeyframeInterval)+")",
+	)
+	if o.StartNumber > 0 {
+		args = append(args, "-start_number", strconv.FormatInt(o.StartNumber, 10))
+	}
+	flags := o.Flags
+	if o.SingleFile {
+		args = append(args, "-hls_segment_type", "fmp4")
+		flags = append(slices.Clone(flags), "single_file")
+	}
+	if len(flags) > 0 {
+		args = append(args, "-hls_flags", strings.Join(flags, "+"))
+	}
+	// The hls muxer only hands options to the mpegts muxer it writes each
+	// segment with through hls_ts_options
+	if len(o.MpegTSFlags) > 0 {
+		args = append(args, "-hls_ts_options", "mpegts_flags=+"+strings.Join(o.MpegTSFlags, "+"))
+	}
+	return args
+}
+
+// inputOption validates the value of one allowlisted ffmpeg input option.
+type inputOption struct {
+	check func(value string) bool
+	hint  string
+}
+
+func intBetween(lo, hi int64) func(string) bool {
+	return func(value string) bool {
+		n, err := strconv.ParseInt(value, 10, 64)
+		return err == nil && n >= lo && n <= hi
+	}
+}
+
+// forcedDemuxers are the -f values accepted, covering the supported input
+// formats plus headerless PCM.
+var forcedDemuxers = []string{"wav", "mp3", "aac", "mov", "s16le", "s24le", "s32le", "f32le", "u8"}
+
+// allowedInputOptions are the ffmpeg options callers may place before -i,
+// for sources whose extension lies or that need extra probing. Nothing else
+// is accepted, so input_options can't reach ffmpeg's protocol or filter
+// options.
+var allowedInputOptions = map[string]inputOption{
+	"analyzeduration": {intBetween(0, 600_000_000), "microseconds, at most 600000000"},
+	"probesize":       {intBetween(32, 1<<30), "bytes between 32 and 1073741824"},
+	"f": {func(value string) bool {
+		return slices.Contains(forcedDemuxers, value)
+	}, "one of " + strings.Join(forcedDemuxers, ", ")},
+	"ar": {intBetween(8000, 192000), "a sample rate between 8000 and 192000"},
+	"ac": {intBetween(1, 8), "a channel count between 1 and 8"},
+}
+
+// parseInputOptions reads 'input_options', comma-separated key=value pairs
+// such as "f=mp3,probesize=5000000", into ffmpeg arguments.
+func parseInputOptions(raw string) ([]string, error) {
+	if raw == "" {
+		return nil, nil
+	}
+
+	var args []string
+	seen := make(map[string]bool)
+	for _, pair := range strings.Split(raw, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+		opt, ok := allowedInputOptions[key]
+		if !ok {
+			names := slices.Sorted(maps.Keys(allowedInputOptions))
+			return nil, fmt.Errorf("Unsupported input option %q, allowed: %s", key, strings.Join(names, ", "))
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("Input option %q given more than once", key)
+		}
+		if !opt.check(value) {
+			return nil, fmt.Errorf("Invalid input option %s=%q, expected %s", key, value, opt.hint)
+		}
+		seen[key] = true
+		args = append(args, "-"+key, value)
+	}
+	return args, nil
+}
@@ -0,0 +1,1382 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultObjectPrefix = "converted-audio/"
+
+// convertRequest is everything a conversion needs, validated up front so
+// the pipeline steps only deal with well-formed input.
+type convertRequest struct {
+	RefID     string
+	Async     bool
+	SourceURL string
+	InputExt  string
+	HLS       hlsOptions
+	Encode    encodeOptions
+	Chapters  chapterOptions
+	Preview   previewOptions
+
+	// Renditions encodes several bitrates behind one master playlist
+	Renditions renditionOptions
+
+	// InputArgs are the vetted input_options, placed before the source's -i
+	InputArgs []string
+
+	// ConcatURLs are further sources joined after SourceURL, in order
+	ConcatURLs []string
+
+	// Trace is the span of the request that created the job; the pipeline
+	// stages are traced as its children
+	Trace spanContext
+
+	// Upload is the metadata and tags applied to every uploaded object
+	Upload objectOptions
+
+	// ObjectPrefix is where the output is uploaded: defaultObjectPrefix, or
+	// a mirror of the source path with prefix_mode=source. With
+	// prefix_mode=content it is the base the content hash is appended to
+	// once the source is downloaded.
+	ObjectPrefix string
+
+	// ContentAddressed is prefix_mode=content, see contentObjectPrefix
+	ContentAddressed bool
+
+	// DeleteSource removes an s3:// source object once its output is
+	// safely uploaded.
+	DeleteSource bool
+
+	// Resume skips uploading objects already stored from an earlier run of
+	// the same job, see uploadToMinio. Set for jobs resumed after a restart.
+	Resume bool
+
+	// Force converts even when refId's source is unchanged since the last
+	// conversion, see unchangedSource.
+	Force bool
+
+	// StreamProgress writes progress lines while a sync conversion runs,
+	// see streamConversion
+	StreamProgress bool
+
+	// Options are the output-shaping query parameters, canonicalized
+	Options string
+
+	// ArchiveFormat is how the source is kept next to the output:
+	// archiveRaw as downloaded, or archiveFLAC, see archiveOriginal
+	ArchiveFormat string
+
+	// InlinePlaylist is how the playlist is included in the response, see
+	// inlinePlaylist; empty leaves it out
+	InlinePlaylist string
+
+	// ReplayGain measures the source's loudness and records it as
+	// ReplayGain metadata, leaving the audio untouched.
+	ReplayGain bool
+
+	// Protocol is "hls" for segmented output or "file" for a single
+	// transcoded file in Container.
+	Protocol  string
+	Container string
+}
+
+type fileContainer struct {
+	Codec     string
+	CodecName string
+	MuxerArgs []string
+}
+
+// fileContainers are the allowed single-file containers and how to produce
+// each of them.
+var fileContainers = map[string]fileContainer{
+	"m4a": {Codec: "aac", CodecName: "aac", MuxerArgs: []string{"-movflags", "+faststart+use_metadata_tags"}},
+	"mp3": {Codec: "libmp3lame", CodecName: "mp3"},
+	"aac": {Codec: "aac", CodecName: "aac", MuxerArgs: []string{"-f", "adts"}},
+}
+
+// inputFormats are the supported source extensions.
+var inputFormats = []string{".wav", ".mp3", ".m4a", ".aac"}
+
+// detectInputExt picks the input format from the source URL.
+func detectInputExt(sourceURL string) (string, error) {
+	for _, ext := range inputFormats {
+		if strings.Contains(sourceURL, ext) {
+			return ext, nil
+		}
+	}
+	return "", withCode(codeUnsupportedFormat, errors.New("Unsupported input format. Only .wav, .mp3, .m4a and .aac are allowed"))
+}
+
+func parseConvertRequest(r *http.Request) (convertRequest, error) {
+	var req convertRequest
+
+	if err := applyProfile(r); err != nil {
+		return req, err
+	}
+
+	req.RefID = r.URL.Query().Get("refId")
+	req.Force = r.URL.Query().Get("force") == "true"
+	req.Options = conversionOptions(r.URL.Query())
+	req.Async = r.URL.Query().Get("async") == "true"
+	req.StreamProgress = r.URL.Query().Get("stream_progress") == "true"
+	if req.StreamProgress && req.Async {
+		return req, errors.New("'stream_progress' only applies to synchronous conversions")
+	}
+	if len(r.URL.Query()["url"]) > 1 {
+		return req, errors.New("Only one 'url' may be given; use 'concat_url' for further sources")
+	}
+	req.SourceURL = r.URL.Query().Get("url")
+	if req.SourceURL == "" {
+		return req, errors.New("Missing 'url' query parameter")
+	}
+
+	var err error
+	if req.SourceURL, err = normalizeSourceURL(req.SourceURL); err != nil {
+		return req, fmt.Errorf("Invalid 'url': %w", err)
+	}
+	if req.InputExt, err = detectInputExt(req.SourceURL); err != nil {
+		return req, err
+	}
+	if err := checkS3Source(r, req.SourceURL); err != nil {
+		return req, err
+	}
+
+	if req.InputArgs, err = parseInputOptions(r.URL.Query().Get("input_options")); err != nil {
+		return req, err
+	}
+
+	req.ConcatURLs = slices.Clone(r.URL.Query()["concat_url"])
+	if len(req.ConcatURLs)+1 > maxConcatSources {
+		return req, fmt.Errorf("At most %d sources can be concatenated", maxConcatSources)
+	}
+	for i, concatURL := range req.ConcatURLs {
+		if req.ConcatURLs[i], err = normalizeSourceURL(concatURL); err != nil {
+			return req, fmt.Errorf("Invalid 'concat_url' %q: %w", concatURL, err)
+		}
+		concatURL = req.ConcatURLs[i]
+		if _, err := detectInputExt(concatURL); err != nil {
+			return req, fmt.Errorf("Invalid 'concat_url' %q: %w", concatURL, err)
+		}
+		if err := checkS3Source(r, concatURL); err != nil {
+			return req, fmt.Errorf("Invalid 'concat_url' %q: %w", concatURL, err)
+		}
+	}
+
+	req.Protocol = r.URL.Query().Get("protocol")
+	switch req.Protocol {
+	case "", "hls":
+		req.Protocol = "hls"
+		if r.URL.Query().Get("container") != "" {
+			return req, errors.New("'container' is only valid with protocol=file")
+		}
+	case "file":
+		req.Container = r.URL.Query().Get("container")
+		if req.Container == "" {
+			req.Container = "m4a"
+		}
+		if _, ok := fileContainers[req.Container]; !ok {
+			return req, fmt.Errorf("Unsupported container %q. Only m4a, mp3 and aac are allowed", req.Container)
+		}
+	default:
+		return req, fmt.Errorf("Unsupported protocol %q. Only hls and file are allowed", req.Protocol)
+	}
+
+	switch mode := r.URL.Query().Get("prefix_mode"); mode {
+	case "", "fixed":
+		req.ObjectPrefix = defaultObjectPrefix
+		if prefixTemplate != "" {
+			req.ObjectPrefix = renderPrefix(prefixTemplate, requestTenant(r), req.RefID, time.Now())
+		}
+	case "source":
+		prefix, err := sourceObjectPrefix(req.SourceURL)
+		if err != nil {
+			return req, err
+		}
+		req.ObjectPrefix = prefix
+	case "content":
+		req.ContentAddressed = true
+		req.ObjectPrefix = contentPrefixRoot
+		// Tenants never share outputs, or one could learn what another
+		// converted
+		if tenant := requestTenant(r); tenant != "" {
+			req.ObjectPrefix += safeKeySegment(tenant) + "/"
+		}
+		if len(req.ConcatURLs) > 0 {
+			return req, errors.New("prefix_mode=content can't be combined with 'concat_url'")
+		}
+	default:
+		return req, fmt.Errorf("Unsupported prefix_mode %q. Only fixed, source and content are allowed", mode)
+	}
+
+	// Only objects we own can be deleted; never touch an http(s) origin.
+	// /convert is open, so deleting also takes a tenant's API key.
+	req.DeleteSource = r.URL.Query().Get("delete_source") == "true"
+	if _, _, ok := s3Source(req.SourceURL); req.DeleteSource && !ok {
+		return req, errors.New("'delete_source' is only valid for s3:// sources")
+	}
+	if req.DeleteSource && requestTenant(r) == "" {
+		return req, errors.New("'delete_source' requires an API key with a tenant")
+	}
+	if req.DeleteSource && len(req.ConcatURLs) > 0 {
+		return req, errors.New("'delete_source' can't be combined with 'concat_url'")
+	}
+
+	if req.Upload.Metadata, err = parseUserMetadata(r.URL.Query().Get("metadata")); err != nil {
+		return req, err
+	}
+	if req.Upload.Tags, err = parseExpiry(r.URL.Query().Get("expire_days")); err != nil {
+		return req, err
+	}
+	if err := parseRetention(r.URL.Query(), &req.Upload); err != nil {
+		return req, err
+	}
+
+	req.Encode, err = parseEncodeOptions(r.URL.Query())
+	if err != nil {
+		return req, err
+	}
+
+	req.HLS, err = parseHLSOptions(r.URL.Query())
+	if err != nil {
+		return req, err
+	}
+
+	req.Chapters, err = parseChapterOptions(r.URL.Query())
+	if err != nil {
+		return req, err
+	}
+	if req.Encode.Remux && req.Protocol != "hls" {
+		return req, errors.New("'mode=remux' is only valid with protocol=hls")
+	}
+
+	if req.Chapters.enabled() && req.Protocol != "hls" {
+		return req, errors.New("'chapters' and 'chapter_count' are only valid with protocol=hls")
+	}
+	if req.Chapters.enabled() && req.ContentAddressed {
+		return req, errors.New("'chapters' and 'chapter_count' can't be combined with prefix_mode=content")
+	}
+	if req.Chapters.enabled() && len(req.ConcatURLs) > 0 {
+		return req, errors.New("'chapters' and 'chapter_count' can't be combined with 'concat_url'")
+	}
+
+	req.Preview, err = parsePreviewOptions(r.URL.Query())
+	if err != nil {
+		return req, err
+	}
+	if req.Preview.enabled() && req.Protocol != "hls" {
+		return req, errors.New("'preview' is only valid with protocol=hls")
+	}
+	if req.Preview.enabled() && req.Chapters.enabled() {
+		return req, errors.New("'preview' can't be combined with chapters")
+	}
+	if req.Preview.enabled() && req.HLS.ListSize > 0 {
+		return req, errors.New("'preview' can't be combined with 'hls_list_size'")
+	}
+
+	if req.InlinePlaylist, err = parseInlinePlaylist(r.URL.Query()); err != nil {
+		return req, err
+	}
+	if req.InlinePlaylist != "" && req.Protocol != "hls" {
+		return req, errors.New("'inline_playlist' is only valid with protocol=hls")
+	}
+	// The response's URL would then be one playlist of several
+	if req.InlinePlaylist != "" && req.Chapters.enabled() {
+		return req, errors.New("'inline_playlist' can't be combined with chapters")
+	}
+
+	if req.ArchiveFormat, err = parseArchiveFormat(r.URL.Query()); err != nil {
+		return req, err
+	}
+	if req.ArchiveFormat != archiveRaw && req.Chapters.enabled() {
+		return req, errors.New("'archive_format' can't be combined with chapters")
+	}
+
+	req.ReplayGain = r.URL.Query().Get("replaygain") == "true"
+	if req.ReplayGain && req.Chapters.enabled() {
+		return req, errors.New("'replaygain' can't be combined with chapters")
+	}
+
+	if req.Renditions, err = parseRenditions(r.URL.Query()); err != nil {
+		return req, err
+	}
+	if req.Renditions.enabled() {
+		if err := checkRenditions(r.URL.Query(), req); err != nil {
+			return req, err
+		}
+	}
+	return req, nil
+}
+
+// checkRenditions rejects what 'renditions' and 'auto_ladder' can't be
+// combined with: a single bitrate or a copy of the source, and outputs that
+// are more than one playlist already.
+func checkRenditions(q url.Values, req convertRequest) error {
+	param := "'renditions'"
+	if req.Renditions.Auto {
+		param = "'auto_ladder'"
+	}
+	switch {
+	case req.Protocol != "hls":
+		return fmt.Errorf("%s is only valid with protocol=hls", param)
+	case q.Get("bitrate") != "":
+		return fmt.Errorf("%s can't be combined with 'bitrate'", param)
+	case req.Encode.CopyIfAAC || req.Encode.Remux:
+		return fmt.Errorf("%s can't be combined with 'copy_if_aac' or mode=remux", param)
+	case req.Chapters.enabled() || req.Preview.enabled():
+		return fmt.Errorf("%s can't be combined with chapters or 'preview'", param)
+	case req.HLS.ListSize > 0 || req.HLS.MaxPlaylistSegments > 0:
+		return fmt.Errorf("%s can't be combined with 'hls_list_size' or 'max_playlist_segments'", param)
+	case req.HLS.SingleFile:
+		return fmt.Errorf("%s can't be combined with hls_layout=single_file", param)
+	case q.Get("debug") != "":
+		return fmt.Errorf("'debug' can't be combined with %s", param)
+	}
+	return nil
+}
+
+// sourceObjectPrefix mirrors the source's path as an object prefix, minus
+// the file extension: .../albums/foo/track1.wav becomes albums/foo/track1/.
+// For s3:// sources the object key is used. Traversal is rejected outright
+// rather than cleaned; each segment is then made key-safe.
+func sourceObjectPrefix(sourceURL string) (string, error) {
+	p := ""
+	if _, key, ok := s3Source(sourceURL); ok {
+		p = key
+	} else {
+		u, err := url.Parse(sourceURL)
+		if err != nil {
+			return "", fmt.Errorf("Invalid 'url': %v", err)
+		}
+		p = u.Path
+	}
+
+	var segments []string
+	for _, segment := range strings.Split(p, "/") {
+		switch segment {
+		case "", ".":
+			continue
+		case "..":
+			return "", errors.New("prefix_mode=source can't be used with a source path containing '..'")
+		}
+		segments = append(segments, safeKeySegment(segment))
+	}
+	if len(segments) == 0 {
+		return "", errors.New("prefix_mode=source needs a source URL with a path")
+	}
+
+	last := len(segments) - 1
+	segments[last] = strings.TrimSuffix(segments[last], path.Ext(segments[last]))
+	if strings.Trim(segments[last], ".") == "" {
+		return "", errors.New("prefix_mode=source needs a source file name")
+	}
+	return strings.Join(segments, "/") + "/", nil
+}
+
+type conversionResult struct {
+	URL         string
+	ManifestURL string
+	Warnings    []string
+
+	// Chapters replaces URL and ManifestURL when the input was split
+	Chapters []chapterResult
+
+	// PreviewURL is the playlist of the preview stream, if one was asked for
+	PreviewURL string
+
+	// Codec and Bitrate are what the output was encoded with, for metrics
+	Codec   string
+	Bitrate string
+
+	Loudness *loudnessInfo
+
+	// Parts are the part playlist URLs when the playlist was split; URL
+	// is still the full playlist, for players that can take it
+	Parts []string
+
+	// MasterURL is the master playlist declaring URL's codecs, for HLS
+	MasterURL string
+
+	// Skipped is set when refId's source hadn't changed and the earlier
+	// output was returned instead of converting again
+	Skipped bool
+
+	// Missing are the objects a spooled upload didn't get to
+	Missing []string
+
+	// Fallback is set when the output was uploaded to fallbackStorage
+	Fallback bool
+
+	// Playlist is the playlist's text for inline_playlist, encoded as
+	// PlaylistEncoding
+	Playlist         string
+	PlaylistEncoding string
+
+	// Attempts is how many times the job ran, counting retries
+	Attempts int
+}
+
+// transcodeOutput describes what a transcode step produced.
+type transcodeOutput struct {
+	Path     string
+	Duration float64
+	Codec    string
+	Bitrate  string
+
+	// Warnings are output-quality concerns that don't fail the job
+	Warnings []string
+
+	// Parts are the part playlists written for max_playlist_segments,
+	// alongside the full playlist at Path
+	Parts []string
+
+	// Codecs is the RFC 6381 codec string the master playlists declare,
+	// see codecsFor
+	Codecs string
+
+	// PartMasters are the master playlists of Parts, in the same order
+	PartMasters []string
+
+	// Variants are the renditions a master playlist at Path lists, see
+	// transcodeRenditions
+	Variants []transcodeOutput
+}
+
+// convert runs the full pipeline for one job and returns the public URL of
+// the playlist, or of the output file for protocol=file. If the upload fails
+// and a spool is configured, the output is kept for a later retry and
+// errUploadSpooled is returned alongside the result.
+func convert(ctx context.Context, jobID string, req convertRequest, onProgress func(percent float64, known bool)) (conversionResult, error) {
+	// Each conversion gets its own directory so concurrent jobs don't collide
+	workingDir, err := os.MkdirTemp("", "hls-conversion-")
+	if err != nil {
+		return conversionResult{}, errors.New("Failed to create temp directory")
+	}
+	defer func() {
+		// A cancelled job's artifacts aren't worth keeping around
+		cleanupWorkingDir(workingDir, req.Async && ctx.Err() == nil)
+	}()
+
+	var validators sourceValidators
+	if req.RefID != "" && !req.Chapters.enabled() && len(req.ConcatURLs) == 0 {
+		if validators, err = headSource(req.SourceURL); err != nil {
+			log.Println("Could not read source validators:", err)
+		}
+		if result, ok := unchangedSource(req, validators); ok {
+			log.Println("Source unchanged for refId", req.RefID, "skipping conversion")
+			return result, nil
+		}
+	}
+
+	downloadSpan := startSpan(req.Trace, "download", spanKindInternal)
+	downloadSpan.setAttr("job.id", jobID)
+	downloadSpan.setAttr("input.format", strings.TrimPrefix(req.InputExt, "."))
+	downloadSpan.setAttr("input.sources", 1+len(req.ConcatURLs))
+	var inputSum hash.Hash
+	if req.ContentAddressed {
+		inputSum = sha256.New()
+	}
+	inputPath, err := downloadInput(ctx, workingDir, req, inputSum)
+	downloadSpan.end(err)
+	if err != nil {
+		return conversionResult{}, err
+	}
+
+	if inputSum != nil {
+		req.ObjectPrefix = contentObjectPrefix(req.ObjectPrefix, inputSum.Sum(nil), req.Options)
+		if result, ok := existingOutput(req.ObjectPrefix); ok && !req.Force {
+			log.Println("Identical input already converted under", req.ObjectPrefix, "skipping conversion")
+			return result, nil
+		}
+	}
+
+	if req.Chapters.enabled() {
+		chaptersSpan := startSpan(req.Trace, "chapters", spanKindInternal)
+		chaptersSpan.setAttr("job.id", jobID)
+		result, err := convertChapters(ctx, jobID, req, workingDir, inputPath, onProgress)
+		err = stageError(codeTranscodeFailed, err)
+		chaptersSpan.setAttr("chapter.count", len(result.Chapters))
+		chaptersSpan.end(err)
+		return result, err
+	}
+
+	transcodeSpan := startSpan(req.Trace, "transcode", spanKindInternal)
+	transcodeSpan.setAttr("job.id", jobID)
+	transcodeSpan.setAttr("input.format", strings.TrimPrefix(req.InputExt, "."))
+	transcodeSpan.setAttr("output.protocol", req.Protocol)
+
+	var loudness *loudnessInfo
+	if req.ReplayGain {
+		measured, err := measureLoudness(ctx, inputPath)
+		if err != nil {
+			err = stageError(codeTranscodeFailed, err)
+			transcodeSpan.end(err)
+			return conversionResult{}, err
+		}
+		loudness = &measured
+		req.Encode.Tags = measured.tags()
+	}
+
+	var output transcodeOutput
+	if req.Protocol == "file" {
+		output, err = transcodeFile(ctx, inputPath, workingDir, req.Container, req.Encode, onProgress)
+	} else if req.Renditions.enabled() {
+		output, err = transcodeRenditions(ctx, inputPath, workingDir, req.Encode, req.HLS, req.Renditions, onProgress)
+	} else {
+		output, err = transcodeHLS(ctx, inputPath, workingDir, req.Encode, req.HLS, onProgress)
+	}
+	err = stageError(codeTranscodeFailed, err)
+	transcodeSpan.setAttr("output.codec", output.Codec)
+	transcodeSpan.setAttr("output.bitrate", output.Bitrate)
+	transcodeSpan.setAttr("output.duration_seconds", output.Duration)
+	transcodeSpan.end(err)
+	if err != nil {
+		return conversionResult{}, err
+	}
+
+	outputName := filepath.Base(output.Path)
+	m := &manifest{
+		JobID:           jobID,
+		RefID:           req.RefID,
+		CreatedAt:       time.Now().UTC(),
+		Protocol:        req.Protocol,
+		DurationSeconds: output.Duration,
+		Codec:           output.Codec,
+		Codecs:          output.Codecs,
+		Bitrate:         output.Bitrate,
+		Loudness:        loudness,
+	}
+	if validators.known() {
+		m.Source = &validators
+	}
+
+	m.Parts = partURLs(req.ObjectPrefix, output.Parts)
+	m.PartMasters = partURLs(req.ObjectPrefix, output.PartMasters)
+	for _, variant := range output.Variants {
+		m.Variants = append(m.Variants, manifestVariant{
+			Bitrate:     variant.Bitrate,
+			Codecs:      variant.Codecs,
+			PlaylistURL: publicObjectURL(req.ObjectPrefix + variantURI(variant)),
+		})
+	}
+
+	if req.Preview.enabled() {
+		previewSpan := startSpan(req.Trace, "preview", spanKindInternal)
+		previewSpan.setAttr("job.id", jobID)
+		m.Preview, err = convertPreview(ctx, req, workingDir, inputPath)
+		previewSpan.end(err)
+		if err != nil {
+			return conversionResult{}, err
+		}
+	}
+
+	if req.ArchiveFormat == archiveFLAC {
+		if err := archiveOriginal(ctx, inputPath, workingDir); err != nil {
+			return conversionResult{}, stageError(codeTranscodeFailed, err)
+		}
+	}
+
+	uploadSpan := startSpan(req.Trace, "upload", spanKindInternal)
+	uploadSpan.setAttr("job.id", jobID)
+	uploadSpan.setAttr("object.prefix", req.ObjectPrefix)
+	result, err := uploadOutput(ctx, workingDir, req.ObjectPrefix, outputName, m, req.Upload, req.Resume)
+	err = stageError(codeUploadFailed, err)
+	uploadSpan.setAttr("object.count", len(m.Objects))
+	uploadSpan.setAttr("segment.count", m.SegmentCount)
+	uploadSpan.end(err)
+	result.Warnings = output.Warnings
+	result.Loudness = loudness
+	result.Codec, result.Bitrate = output.Codec, output.Bitrate
+	result.Parts = m.Parts
+	if m.Preview != nil {
+		result.PreviewURL = m.Preview.PlaylistURL
+	}
+	if err == nil {
+		// Pruning only knows primaryStorage
+		if req.HLS.ListSize > 0 && !result.Fallback {
+			pruneRolledOffSegments(output.Path, req.ObjectPrefix)
+		}
+		if validators.known() {
+			saveSourceRecord(sourceRecord{
+				RefID:       req.RefID,
+				Source:      validators,
+				Options:     req.Options,
+				URL:         result.URL,
+				ManifestURL: result.ManifestURL,
+				ConvertedAt: time.Now().UTC(),
+			})
+		}
+		if req.DeleteSource {
+			deleteSourceObject(req.SourceURL)
+		}
+		if req.InlinePlaylist != "" {
+			playlist, warning := inlinePlaylist(output.Path, req.InlinePlaylist)
+			if warning != "" {
+				result.Warnings = append(result.Warnings, warning)
+			} else {
+				result.Playlist, result.PlaylistEncoding = playlist, req.InlinePlaylist
+			}
+		}
+		return result, nil
+	}
+	if ctx.Err() != nil && m.Preview != nil {
+		removeObjectsUnder(req.ObjectPrefix + previewDirName + "/")
+	}
+	// A mismatch would be reproduced by every retry, so don't spool it, and
+	// a cancelled job has nothing left to deliver
+	if spoolDir == "" || errors.Is(err, errSegmentMismatch) || ctx.Err() != nil {
+		return conversionResult{}, err
+	}
+
+	// Keep the converted output so the upload can be retried later
+	log.Println("Upload to MinIO failed, spooling output:", err)
+	entry := spoolEntry{
+		JobID:        jobID,
+		ObjectPrefix: req.ObjectPrefix,
+		OutputName:   outputName,
+		StreamURL:    result.URL,
+		PruneWindow:  req.HLS.ListSize > 0,
+		Manifest:     m,
+		Upload:       req.Upload,
+	}
+	if req.DeleteSource {
+		entry.DeleteSource = req.SourceURL
+	}
+	if spoolErr := spoolOutput(workingDir, entry); spoolErr != nil {
+		log.Println("Failed to spool output:", spoolErr)
+		return conversionResult{}, err
+	}
+	result.Missing = missingObjects(err)
+	return result, errUploadSpooled
+}
+
+// cleanupWorkingDir removes a finished job's directory. Async jobs can keep
+// theirs for asyncCleanupDelay so local artifacts outlive the job briefly;
+// the timer runs whether or not the client ever polls.
+func cleanupWorkingDir(workingDir string, async bool) {
+	if !async || asyncCleanupDelay <= 0 {
+		os.RemoveAll(workingDir)
+		return
+	}
+
+	time.AfterFunc(asyncCleanupDelay, func() {
+		if err := os.RemoveAll(workingDir); err != nil {
+			log.Println("Failed to clean up", workingDir, err)
+		}
+	})
+}
+
+// downloadInput fetches the source into workingDir and returns its local
+// path. With concat_url, every source is fetched and they are joined into
+// a single input first. The downloaded bytes are also written to sum when
+// it is set.
+func downloadInput(ctx context.Context, workingDir string, req convertRequest, sum hash.Hash) (string, error) {
+	if len(req.ConcatURLs) > 0 {
+		return concatInputs(ctx, workingDir, req)
+	}
+
+	inputPath := filepath.Join(workingDir, "input"+req.InputExt)
+	if err := fetchSource(ctx, inputPath, req.SourceURL, sum); err != nil {
+		return "", fmt.Errorf("Failed to download file: %w", err)
+	}
+	if err := checkInputSize(inputPath); err != nil {
+		return "", err
+	}
+	if err := sniffInput(inputPath); err != nil {
+		return "", err
+	}
+	return applyInputOptions(ctx, inputPath, req.InputArgs)
+}
+
+// applyInputOptions remuxes the audio of path into Matroska, reading it with
+// the caller's input_options, and returns the new file. Every later step
+// (probe, loudness, chapter cuts, transcode) then reads a well-formed file
+// and the options don't have to be threaded through each ffmpeg and
+// ffprobe call. Without options path is returned as is.
+func applyInputOptions(ctx context.Context, path string, inputArgs []string) (string, error) {
+	if len(inputArgs) == 0 {
+		return path, nil
+	}
+
+	remuxed := strings.TrimSuffix(path, filepath.Ext(path)) + ".mka"
+	args := append(slices.Clone(inputArgs), "-i", path, "-map", "0:a:0", "-c", "copy", remuxed)
+	if err := runFFmpeg(ctx, ffmpegCommand(args...)); err != nil {
+		// Only ffmpeg itself rejecting the options is the caller's fault; a
+		// missing binary or a cancelled job keeps its own status
+		if errors.As(err, new(*exec.ExitError)) {
+			return "", withCode(codeBadInput, withStatus(http.StatusBadRequest, fmt.Errorf("Could not read the source with 'input_options': %w", err)))
+		}
+		return "", fmt.Errorf("Could not read the source with 'input_options': %w", err)
+	}
+	os.Remove(path)
+	return remuxed, nil
+}
+
+// fetchSource downloads one http(s) or s3:// source to path, teeing the
+// bytes into sum when it is set.
+func fetchSource(ctx context.Context, path string, sourceURL string, sum hash.Hash) error {
+	if err := downloadSlots.acquireContext(ctx); err != nil {
+		return err
+	}
+	defer downloadSlots.release()
+
+	if bucket, key, ok := s3Source(sourceURL); ok {
+		if err := downloadObject(ctx, path, bucket, key); err != nil {
+			return stageError(codeDownloadFailed, transient(err))
+		}
+		// FGetObject writes the file itself, so it is hashed afterwards
+		if sum != nil {
+			return copyFileTo(sum, path)
+		}
+		return nil
+	}
+	return stageError(codeDownloadFailed, transient(downloadFile(ctx, path, sourceURL, sum)))
+}
+
+// singleFileMediaName is the fragmented MP4 written for
+// hls_layout=single_file in place of the .ts segments.
+const singleFileMediaName = "media.mp4"
+
+// transcodeHLS segments inputPath into output.m3u8 plus .ts segments inside
+// workingDir, or a single media.mp4 with hls_layout=single_file, with a
+// master playlist for it and for each of its parts.
+func transcodeHLS(ctx context.Context, inputPath string, workingDir string, enc encodeOptions, opts hlsOptions, onProgress func(percent float64, known bool)) (transcodeOutput, error) {
+	output, err := encodeHLS(ctx, inputPath, workingDir, enc, opts, onProgress)
+	if err != nil {
+		return output, err
+	}
+
+	if _, err := writeMasterPlaylist(output.Path, output.Codecs); err != nil {
+		return output, fmt.Errorf("Failed to write master playlist: %w", err)
+	}
+	for _, part := range output.Parts {
+		master, err := writeMasterPlaylist(part, output.Codecs)
+		if err != nil {
+			return output, fmt.Errorf("Failed to write master playlist: %w", err)
+		}
+		output.PartMasters = append(output.PartMasters, master)
+	}
+	return output, nil
+}
+
+// encodeHLS is transcodeHLS without the master playlists, for renditions
+// that are listed in a shared one.
+func encodeHLS(ctx context.Context, inputPath string, workingDir string, enc encodeOptions, opts hlsOptions, onProgress func(percent float64, known bool)) (transcodeOutput, error) {
+	// Total duration is needed to turn ffmpeg's out_time into a percentage
+	info, err := probeInput(inputPath)
+	if err != nil {
+		log.Println("Warning: could not probe input:", err)
+	}
+
+	output, encodeArgs, opts, err := planHLS(info, workingDir, enc, opts)
+	if err != nil {
+		return output, err
+	}
+
+	args := []string{"-i", inputPath, "-progress", "pipe:1"}
+	args = append(args, encodeArgs...)
+	args = append(args, "-f", "hls")
+	args = append(args, opts.ffmpegArgs()...)
+	args = append(args,
+		"-hls_segment_filename", hlsSegmentPattern(workingDir, opts),
+		output.Path,
+	)
+
+	cmd, warnings := ffmpegEncodeCommand(args...)
+
+	if err := runWithProgress(ctx, cmd, info.Duration, onProgress); err != nil {
+		return output, fmt.Errorf("FFmpeg conversion failed: %w", err)
+	}
+	output.Warnings = append(output.Warnings, warnings.list()...)
+
+	return output, finishHLS(&output, opts)
+}
+
+// hlsSegmentPattern is where ffmpeg writes the segments of a playlist in
+// workingDir.
+func hlsSegmentPattern(workingDir string, opts hlsOptions) string {
+	if opts.SingleFile {
+		return filepath.Join(workingDir, singleFileMediaName)
+	}
+	return filepath.Join(workingDir, "segment_%03d.ts")
+}
+
+// planHLS works out how info's audio is encoded into an HLS output in
+// workingDir: the ffmpeg encode arguments, the output as far as it is known
+// before encoding, and opts adjusted to the input.
+func planHLS(info mediaInfo, workingDir string, enc encodeOptions, opts hlsOptions) (transcodeOutput, []string, hlsOptions, error) {
+	output := transcodeOutput{
+		Path:     filepath.Join(workingDir, "output.m3u8"),
+		Duration: info.Duration,
+		Codec:    "aac",
+		Bitrate:  enc.resolveBitrate(info),
+		// ffmpeg's own AAC encoder only writes LC
+		Codecs: codecsFor("aac", "LC"),
+	}
+
+	// An input no longer than one segment comes out as a single segment.
+	// That is a complete stream rather than a short tail, but ffmpeg rounds
+	// its target duration up, so it is set from the segment instead.
+	singleSegment := info.Duration > 0 && info.Duration <= opts.SegmentDuration
+	if singleSegment && opts.TargetDuration == 0 {
+		opts.TargetDurationAuto = true
+	}
+
+	var padFilters []string
+	if tail := opts.lastSegmentDuration(info.Duration); tail > 0 {
+		switch {
+		case opts.PadLastSegment:
+			padded := info.Duration - tail + opts.SegmentDuration
+			padFilters = append(padFilters, "apad=whole_dur="+formatSeconds(padded))
+		case tail < minLastSegment && !singleSegment:
+			output.Warnings = append(output.Warnings, fmt.Sprintf(
+				"Final segment is only %.3fs long (threshold %gs); some players reject short tails, set pad_last_segment=true to avoid it",
+				tail, minLastSegment))
+		}
+	}
+
+	var encodeArgs []string
+	switch {
+	case enc.Remux && enc.remuxBlocker(info, padFilters) == "":
+		log.Printf("Remuxing %s source without re-encoding", info.Codec)
+		// Only the audio: cover art in an MP3 can't go into TS
+		encodeArgs = []string{"-vn", "-c:a", "copy"}
+		output.Codec = info.Codec
+		output.Codecs = codecsFor(info.Codec, info.Profile)
+		output.Bitrate = ""
+		if info.BitRate > 0 {
+			output.Bitrate = fmt.Sprintf("%dk", info.BitRate/1000)
+		}
+	case enc.canCopy(info, padFilters):
+		log.Printf("Source is already AAC at %dk, copying audio instead of re-encoding", info.BitRate/1000)
+		encodeArgs = []string{"-c:a", "copy"}
+		output.Codecs = codecsFor(info.Codec, info.Profile)
+		output.Bitrate = fmt.Sprintf("%dk", info.BitRate/1000)
+	default:
+		if enc.Remux {
+			output.Warnings = append(output.Warnings, "mode=remux fell back to re-encoding: "+enc.remuxBlocker(info, padFilters))
+		}
+		var err error
+		encodeArgs, err = enc.ffmpegArgs("aac", info, padFilters...)
+		if err != nil {
+			return output, nil, opts, err
+		}
+	}
+	return output, encodeArgs, opts, nil
+}
+
+// finishHLS applies what ffmpeg can't do itself to the playlist ffmpeg
+// wrote for output.
+func finishHLS(output *transcodeOutput, opts hlsOptions) error {
+	// delete_segments leaves a few rolled-off segments on disk; drop them so
+	// only the window is uploaded
+	if opts.ListSize > 0 {
+		if err := removeUnlistedSegments(output.Path); err != nil {
+			return fmt.Errorf("Failed to trim rolled-off segments: %w", err)
+		}
+	}
+
+	if opts.ProgramDateTime != nil {
+		err := rewritePlaylist(output.Path, func(playlist string) string {
+			return insertProgramDateTime(playlist, *opts.ProgramDateTime)
+		})
+		if err != nil {
+			return fmt.Errorf("Failed to add program date time: %w", err)
+		}
+	}
+
+	if opts.TargetDuration > 0 || opts.TargetDurationAuto {
+		if err := fixTargetDuration(output.Path, opts); err != nil {
+			return err
+		}
+	}
+
+	if opts.SegmentGroupSize > 0 {
+		if err := groupSegments(output.Path, int(opts.SegmentGroupSize)); err != nil {
+			return fmt.Errorf("Failed to group segments: %w", err)
+		}
+	}
+
+	// Before splitting, so every part carries the same version
+	if opts.Version > 0 {
+		if err := fixVersion(output.Path, int(opts.Version)); err != nil {
+			return err
+		}
+	}
+
+	if opts.MaxPlaylistSegments > 0 {
+		parts, err := writePlaylistParts(output.Path, int(opts.MaxPlaylistSegments))
+		if err != nil {
+			return fmt.Errorf("Failed to split playlist: %w", err)
+		}
+		output.Parts = parts
+	}
+	return nil
+}
+
+// fixTargetDuration patches EXT-X-TARGETDURATION in the playlist at
+// playlistPath: to the value the segments require with target_duration=auto,
+// or to the requested value, which can't be below that.
+func fixTargetDuration(playlistPath string, opts hlsOptions) error {
+	return fixHeaderTag(playlistPath, targetDurationTag, func(playlist string) (int, error) {
+		required := requiredTargetDuration(playlist)
+		if opts.TargetDurationAuto {
+			return required, nil
+		}
+		target := int(opts.TargetDuration)
+		if target < required {
+			return 0, withCode(codeBadInput, withStatus(http.StatusBadRequest, fmt.Errorf("'target_duration' %d is below the longest segment, which needs %d", target, required)))
+		}
+		return target, nil
+	})
+}
+
+// fixVersion patches EXT-X-VERSION in the playlist at playlistPath to the
+// requested hls_version, which can't be below what its tags require:
+// claiming less would have players misread them.
+func fixVersion(playlistPath string, version int) error {
+	return fixHeaderTag(playlistPath, versionTag, func(playlist string) (int, error) {
+		if required, feature := requiredVersion(playlist); version < required {
+			return 0, withCode(codeBadInput, withStatus(http.StatusBadRequest, fmt.Errorf("'hls_version' %d is too low: the playlist uses %s, which needs version %d", version, feature, required)))
+		}
+		return version, nil
+	})
+}
+
+// fixHeaderTag sets the integer tag in the playlist at playlistPath to the
+// value valueFor picks for it, leaving the file alone when it already
+// carries that value.
+func fixHeaderTag(playlistPath string, tag string, valueFor func(playlist string) (int, error)) error {
+	raw, err := os.ReadFile(playlistPath)
+	if err != nil {
+		return err
+	}
+	playlist := string(raw)
+
+	value, err := valueFor(playlist)
+	if err != nil {
+		return err
+	}
+	name := strings.TrimSuffix(strings.TrimPrefix(tag, "#"), ":")
+	current, ok := headerTag(playlist, tag)
+	if ok && current == value {
+		return nil
+	}
+	if ok {
+		log.Printf("Patching %s from %d to %d", name, current, value)
+	}
+
+	patched, err := setHeaderTag(playlist, tag, value)
+	if err != nil {
+		return fmt.Errorf("Failed to set %s: %w", name, err)
+	}
+	return os.WriteFile(playlistPath, []byte(patched), 0644)
+}
+
+// transcodeFile encodes inputPath into a single output.<container> file
+// inside workingDir.
+func transcodeFile(ctx context.Context, inputPath string, workingDir string, container string, enc encodeOptions, onProgress func(percent float64, known bool)) (transcodeOutput, error) {
+	info, err := probeInput(inputPath)
+	if err != nil {
+		log.Println("Warning: could not probe input:", err)
+	}
+
+	format := fileContainers[container]
+	output := transcodeOutput{
+		Path:     filepath.Join(workingDir, "output."+container),
+		Duration: info.Duration,
+		Codec:    format.CodecName,
+		Bitrate:  enc.resolveBitrate(info),
+	}
+
+	encodeArgs, err := enc.ffmpegArgs(format.Codec, info)
+	if err != nil {
+		return output, err
+	}
+
+	args := []string{"-i", inputPath, "-progress", "pipe:1", "-vn"}
+	args = append(args, encodeArgs...)
+	for key, value := range enc.Tags {
+		args = append(args, "-metadata", key+"="+value)
+	}
+	args = append(args, format.MuxerArgs...)
+	args = append(args, output.Path)
+
+	cmd, warnings := ffmpegEncodeCommand(args...)
+
+	if err := runWithProgress(ctx, cmd, info.Duration, onProgress); err != nil {
+		return output, fmt.Errorf("FFmpeg conversion failed: %w", err)
+	}
+	output.Warnings = append(output.Warnings, warnings.list()...)
+
+	return output, nil
+}
+
+// uploadOutput publishes workingDir under objectPrefix, followed by the
+// manifest describing it. The output URL is returned even on failure so
+// callers can spool. resume skips objects a failed attempt already
+// uploaded, see uploadToMinio.
+//
+// When the upload to primaryStorage fails it is made to fallbackStorage
+// instead, if configured, and the result points there. A fallback that
+// fails too reports the primary's failure, so retries start from the
+// primary again.
+func uploadOutput(ctx context.Context, workingDir string, objectPrefix string, outputName string, m *manifest, objOpts objectOptions, resume bool) (conversionResult, error) {
+	result, err := primaryStorage.uploadOutput(ctx, workingDir, objectPrefix, outputName, m, objOpts, resume)
+	// A mismatch would be the same on any target
+	if err == nil || fallbackStorage == nil || ctx.Err() != nil || errors.Is(err, errSegmentMismatch) {
+		return result, err
+	}
+
+	log.Printf("Upload to %s storage failed (%v), uploading to %s storage at %s/%s instead", primaryStorage.Name, err, fallbackStorage.Name, fallbackStorage.Endpoint, fallbackStorage.Bucket)
+	fallback, fallbackErr := fallbackStorage.uploadOutput(ctx, workingDir, objectPrefix, outputName, m, objOpts, resume)
+	if fallbackErr != nil {
+		log.Printf("Upload to %s storage failed too: %v", fallbackStorage.Name, fallbackErr)
+		return result, err
+	}
+	fallback.Fallback = true
+	return fallback, nil
+}
+
+func (t *storageTarget) uploadOutput(ctx context.Context, workingDir string, objectPrefix string, outputName string, m *manifest, objOpts objectOptions, resume bool) (conversionResult, error) {
+	result := conversionResult{URL: t.objectURL(objectPrefix + outputName)}
+
+	uploaded, err := t.uploadToMinio(ctx, workingDir, objectPrefix, objOpts, resume)
+	if ctx.Err() != nil {
+		t.removeUploaded(uploaded)
+		return result, context.Cause(ctx)
+	}
+	if err != nil {
+		return result, transient(fmt.Errorf("Upload to MinIO failed: %w", err))
+	}
+
+	isPlaylist := strings.HasSuffix(outputName, ".m3u8")
+	// A master playlist's renditions are each verified and indexed in
+	// their own folder
+	mediaPlaylists := []string{outputName}
+	if isPlaylist && isMasterPlaylist(outputName) {
+		raw, err := os.ReadFile(filepath.Join(workingDir, outputName))
+		if err != nil {
+			return result, err
+		}
+		mediaPlaylists = masterVariantURIs(string(raw))
+		result.MasterURL = result.URL
+	}
+	var indexes []string
+	for _, playlist := range mediaPlaylists {
+		if !isPlaylist {
+			break
+		}
+		dir := strings.TrimPrefix(path.Dir(playlist)+"/", "./")
+		playlistPath := filepath.Join(workingDir, filepath.FromSlash(playlist))
+		if err := verifySegments(playlistPath, objectPrefix+dir, uploadedUnder(uploaded, objectPrefix+dir)); err != nil {
+			// Take the playlist down rather than publish a stream with holes
+			if rmErr := t.removeObject(objectPrefix + outputName); rmErr != nil {
+				log.Println("Failed to remove unverified playlist:", rmErr)
+			}
+			return result, err
+		}
+
+		raw, err := os.ReadFile(playlistPath)
+		if err != nil {
+			return result, fmt.Errorf("Failed to build segment index: %w", err)
+		}
+		index, err := segmentIndex(string(raw), objectPrefix+dir, uploaded)
+		if err != nil {
+			return result, fmt.Errorf("Failed to build segment index: %w", err)
+		}
+		if err := t.putObjectBytes(objectPrefix+dir+segmentIndexName, index, objOpts); err != nil {
+			return result, transient(fmt.Errorf("Upload to MinIO failed: %w", err))
+		}
+		indexes = append(indexes, objectPrefix+dir+segmentIndexName)
+	}
+	if isPlaylist && !isMasterPlaylist(outputName) {
+		if m != nil {
+			m.SegmentsURL = t.objectURL(objectPrefix + segmentIndexName)
+		}
+		if _, err := os.Stat(filepath.Join(workingDir, masterName(outputName))); err == nil {
+			result.MasterURL = t.objectURL(objectPrefix + masterName(outputName))
+		}
+	}
+
+	// The manifest marks the output as complete, so this is the last point
+	// a cancelled job can still take its objects down
+	if ctx.Err() != nil {
+		t.removeUploaded(uploaded)
+		for _, index := range indexes {
+			t.removeObject(index)
+		}
+		return result, context.Cause(ctx)
+	}
+
+	if m != nil {
+		if isPlaylist {
+			m.PlaylistURL = result.URL
+			m.MasterURL = result.MasterURL
+		} else {
+			m.FileURL = result.URL
+		}
+		// Part URLs are worked out before uploading, for primaryStorage
+		for i, part := range m.Parts {
+			m.Parts[i] = t.rebaseURL(part)
+		}
+		for i, master := range m.PartMasters {
+			m.PartMasters[i] = t.rebaseURL(master)
+		}
+		for i := range m.Variants {
+			m.Variants[i].PlaylistURL = t.rebaseURL(m.Variants[i].PlaylistURL)
+		}
+		if err := m.addObjects(uploaded); err != nil {
+			return result, fmt.Errorf("Failed to build manifest: %w", err)
+		}
+		body, err := m.encode()
+		if err != nil {
+			return result, fmt.Errorf("Failed to build manifest: %w", err)
+		}
+		if err := t.putObjectBytes(objectPrefix+manifestName, body, objOpts); err != nil {
+			return result, transient(fmt.Errorf("Upload to MinIO failed: %w", err))
+		}
+		result.ManifestURL = t.objectURL(objectPrefix + manifestName)
+	}
+
+	log.Printf("✅ Stream available at: %s (%s storage)", result.URL, t.Name)
+	return result, nil
+}
+
+var errSegmentMismatch = errors.New("Segment verification failed")
+
+// uploadedUnder is the part of uploaded stored under prefix.
+func uploadedUnder(uploaded []uploadedObject, prefix string) []uploadedObject {
+	var under []uploadedObject
+	for _, obj := range uploaded {
+		if strings.HasPrefix(obj.Name, prefix) {
+			under = append(under, obj)
+		}
+	}
+	return under
+}
+
+// verifySegments checks that every media file the playlist references was
+// uploaded, and that no more and no fewer were uploaded than it lists. A
+// single-file playlist references the same file for every segment, so each
+// is counted once.
+func verifySegments(playlistPath string, objectPrefix string, uploaded []uploadedObject) error {
+	raw, err := os.ReadFile(playlistPath)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errSegmentMismatch, err)
+	}
+	var segments []string
+	for _, segment := range append(playlistMapURIs(string(raw)), playlistSegments(string(raw))...) {
+		if !slices.Contains(segments, segment) {
+			segments = append(segments, segment)
+		}
+	}
+
+	uploadedSegments := make(map[string]bool)
+	for _, obj := range uploaded {
+		if isSegmentObject(obj.Name) {
+			uploadedSegments[obj.Name] = true
+		}
+	}
+
+	if len(segments) != len(uploadedSegments) {
+		return fmt.Errorf("%w: playlist references %d segments but %d were uploaded", errSegmentMismatch, len(segments), len(uploadedSegments))
+	}
+	for _, segment := range segments {
+		if !uploadedSegments[objectPrefix+segment] {
+			return fmt.Errorf("%w: segment %s was not uploaded", errSegmentMismatch, segment)
+		}
+	}
+
+	return nil
+}
+
+// writePlaylistParts splits the playlist at playlistPath into part_NNN.m3u8
+// files next to it when it has more than maxSegments segments, and returns
+// their paths. Nothing is written for a playlist that already fits.
+func writePlaylistParts(playlistPath string, maxSegments int) ([]string, error) {
+	raw, err := os.ReadFile(playlistPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(playlistSegments(string(raw))) <= maxSegments {
+		return nil, nil
+	}
+
+	var paths []string
+	for i, part := range splitPlaylist(string(raw), maxSegments) {
+		path := filepath.Join(filepath.Dir(playlistPath), fmt.Sprintf("part_%03d.m3u8", i+1))
+		if err := os.WriteFile(path, []byte(part), 0644); err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// partURLs returns the public URLs the part playlists will be uploaded to.
+func partURLs(objectPrefix string, parts []string) []string {
+	var urls []string
+	for _, part := range parts {
+		urls = append(urls, publicObjectURL(objectPrefix+filepath.Base(part)))
+	}
+	return urls
+}
+
+// removeUnlistedSegments deletes local .ts files the playlist no longer
+// references.
+func removeUnlistedSegments(playlistPath string) error {
+	raw, err := os.ReadFile(playlistPath)
+	if err != nil {
+		return err
+	}
+	listed := make(map[string]bool)
+	for _, segment := range playlistSegments(string(raw)) {
+		listed[segment] = true
+	}
+
+	dir := filepath.Dir(playlistPath)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".ts") && !listed[entry.Name()] {
+			if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// pruneRolledOffSegments removes segment objects under objectPrefix that the
+// windowed playlist no longer lists, keeping storage bounded for long event
+// streams. Failures are only logged since the stream itself is fine.
+func pruneRolledOffSegments(playlistPath string, objectPrefix string) {
+	raw, err := os.ReadFile(playlistPath)
+	if err != nil {
+		log.Println("Failed to read playlist for pruning:", err)
+		return
+	}
+	listed := make(map[string]bool)
+	for _, segment := range playlistSegments(string(raw)) {
+		listed[objectPrefix+segment] = true
+	}
+
+	// Recursive so grouped segments are found too; anything nested deeper
+	// than a segment group belongs to some other stream
+	names, err := listObjects(objectPrefix, true)
+	if err != nil {
+		log.Println("Failed to list segments for pruning:", err)
+		return
+	}
+	for _, name := range names {
+		rel := strings.TrimPrefix(name, objectPrefix)
+		if !strings.HasSuffix(name, ".ts") || listed[name] {
+			continue
+		}
+		if strings.Contains(rel, "/") && !segmentGroupPattern.MatchString(rel) {
+			continue
+		}
+		if err := removeObject(name); err != nil {
+			log.Println("Failed to remove rolled-off segment:", name, err)
+			continue
+		}
+		log.Println("Removed rolled-off segment:", name)
+	}
+}
+
+func publicObjectURL(objectName string) string {
+	return primaryStorage.objectURL(objectName)
+}
+
+func (t *storageTarget) objectURL(objectName string) string {
+	protocol := publicScheme
+	if protocol == "" {
+		protocol = "http"
+		if t.UseSSL {
+			protocol = "https"
+		}
+	}
+
+	// Keys are stored as-is; only the URL form is escaped, per segment so
+	// the slashes stay path separators
+	segments := strings.Split(objectName, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return fmt.Sprintf("%s://%s/%s/%s", protocol, t.Endpoint, url.PathEscape(t.Bucket), strings.Join(segments, "/"))
+}
+
+// rebaseURL moves an object URL of either storage target onto t.
+func (t *storageTarget) rebaseURL(objectURL string) string {
+	for _, other := range []*storageTarget{primaryStorage, fallbackStorage} {
+		if other == nil {
+			continue
+		}
+		if rest, ok := strings.CutPrefix(objectURL, other.objectURL("")); ok {
+			return t.objectURL("") + rest
+		}
+	}
+	return objectURL
+}
+
+var (
+	segmentIndexPattern = regexp.MustCompile(`^segment_(\d+)\.ts$`)
+	segmentGroupPattern = regexp.MustCompile(`^\d{3,}/segment_\d+\.ts$`)
+)
+
+// groupSegments moves each segment next to playlistPath into a NNN/
+// subfolder holding groupSize segments, numbered by segment index so a
+// stream continued with start_number keeps filling the same folders. The
+// playlist is rewritten to the relative paths, which resolve against the
+// playlist's own URL wherever it is served from.
+func groupSegments(playlistPath string, groupSize int) error {
+	dir := filepath.Dir(playlistPath)
+	moved := make(map[string]string)
+
+	raw, err := os.ReadFile(playlistPath)
+	if err != nil {
+		return err
+	}
+	for _, segment := range playlistSegments(string(raw)) {
+		m := segmentIndexPattern.FindStringSubmatch(segment)
+		if m == nil {
+			continue
+		}
+		index, _ := strconv.Atoi(m[1])
+		group := fmt.Sprintf("%03d", index/groupSize)
+		if err := os.MkdirAll(filepath.Join(dir, group), 0o755); err != nil {
+			return err
+		}
+		if err := os.Rename(filepath.Join(dir, segment), filepath.Join(dir, group, segment)); err != nil {
+			return err
+		}
+		moved[segment] = group + "/" + segment
+	}
+
+	return rewritePlaylist(playlistPath, func(playlist string) string {
+		return mapSegmentURIs(playlist, func(uri string) string {
+			if grouped, ok := moved[uri]; ok {
+				return grouped
+			}
+			return uri
+		})
+	})
+}
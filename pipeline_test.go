@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDownloadInput(t *testing.T) {
+	audio := strings.Repeat("RIFF", 64)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/track.wav" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(audio))
+	}))
+	defer origin.Close()
+	useDownloadClient(t, "")
+
+	dir := t.TempDir()
+	sum := sha256.New()
+	path, err := downloadInput(context.Background(), dir, convertRequest{SourceURL: origin.URL + "/track.wav", InputExt: ".wav"}, sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != filepath.Join(dir, "input.wav") {
+		t.Errorf("downloaded to %s, want input.wav in the working directory", path)
+	}
+	if got := readFile(t, path); got != audio {
+		t.Errorf("downloaded %d bytes, want the source's %d", len(got), len(audio))
+	}
+	want := sha256.Sum256([]byte(audio))
+	if got := hex.EncodeToString(sum.Sum(nil)); got != hex.EncodeToString(want[:]) {
+		t.Errorf("sum is %s, want the source's", got)
+	}
+}
+
+func TestDownloadInputErrors(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/empty.wav":
+		case "/page.wav":
+			w.Write([]byte("<!DOCTYPE html><html><body>" + strings.Repeat("Not here. ", 20) + "</body></html>"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer origin.Close()
+	useDownloadClient(t, "")
+	previousSniff := sniffInputs
+	sniffInputs = true
+	t.Cleanup(func() { sniffInputs = previousSniff })
+
+	tests := []struct {
+		path       string
+		wantStatus int
+		wantCode   string
+	}{
+		{"/missing.wav", http.StatusNotFound, codeDownloadFailed},
+		{"/empty.wav", http.StatusBadRequest, codeBadInput},
+		{"/page.wav", http.StatusBadRequest, codeUnsupportedFormat},
+	}
+	for _, tt := range tests {
+		_, err := downloadInput(context.Background(), t.TempDir(), convertRequest{SourceURL: origin.URL + tt.path, InputExt: ".wav"}, nil)
+		if err == nil {
+			t.Errorf("%s: downloaded, want an error", tt.path)
+			continue
+		}
+		if status := errorStatus(err); status != tt.wantStatus {
+			t.Errorf("%s: status %d, want %d (%v)", tt.path, status, tt.wantStatus, err)
+		}
+		if code := errorCode(err); code != tt.wantCode {
+			t.Errorf("%s: code %q, want %q (%v)", tt.path, code, tt.wantCode, err)
+		}
+	}
+}
+
+func TestTranscodeHLS(t *testing.T) {
+	calls := fakeTranscoder(t)
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "input.wav")
+
+	output, err := transcodeHLS(context.Background(), inputPath, dir, encodeOptions{Bitrate: "128k"}, hlsOptions{SegmentDuration: 6}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output.Path != filepath.Join(dir, hlsPlaylistName) {
+		t.Errorf("output is %s, want %s in the working directory", output.Path, hlsPlaylistName)
+	}
+	if output.Codec != "aac" || output.Bitrate != "128k" || output.Codecs != "mp4a.40.2" {
+		t.Errorf("output is %s %s (%s), want aac 128k (mp4a.40.2)", output.Codec, output.Bitrate, output.Codecs)
+	}
+	if output.Duration != 10 {
+		t.Errorf("duration %g, want the probed 10s", output.Duration)
+	}
+
+	runs := calls.ffmpeg()
+	if len(runs) != 1 {
+		t.Fatalf("ffmpeg ran %d times, want once", len(runs))
+	}
+	args := runs[0]
+	if i := slices.Index(args, "-i"); i < 0 || args[i+1] != inputPath {
+		t.Errorf("ffmpeg args %q don't read the input", args)
+	}
+	if i := slices.Index(args, "-b:a"); i < 0 || args[i+1] != "128k" {
+		t.Errorf("ffmpeg args %q don't encode at 128k", args)
+	}
+	if args[len(args)-1] != output.Path {
+		t.Errorf("ffmpeg writes to %s, want %s", args[len(args)-1], output.Path)
+	}
+
+	master := readFile(t, filepath.Join(dir, masterPlaylistName))
+	if got := masterVariantURIs(master); !slices.Equal(got, []string{hlsPlaylistName}) {
+		t.Errorf("master lists %v, want the output playlist", got)
+	}
+}
+
+func TestTranscodeHLSFailure(t *testing.T) {
+	fakeTranscoder(t)
+	dir := t.TempDir()
+
+	// The fake can't write into a working directory that doesn't exist and
+	// exits non-zero, as ffmpeg would
+	_, err := transcodeHLS(context.Background(), filepath.Join(dir, "input.wav"), filepath.Join(dir, "missing"), encodeOptions{Bitrate: "128k"}, hlsOptions{SegmentDuration: 6}, nil)
+	if err == nil || !strings.Contains(err.Error(), "FFmpeg conversion failed") {
+		t.Errorf("transcodeHLS = %v, want the ffmpeg failure", err)
+	}
+}
+
+func TestUploadOutput(t *testing.T) {
+	storage := useFakeStorage(t)
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, hlsPlaylistName), "#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXTINF:6.0,\nsegment_000.ts\n#EXTINF:4.0,\nsegment_001.ts\n#EXT-X-ENDLIST\n")
+	writeFile(t, filepath.Join(dir, "segment_000.ts"), "first")
+	writeFile(t, filepath.Join(dir, "segment_001.ts"), "second")
+	if _, err := writeMasterPlaylist(filepath.Join(dir, hlsPlaylistName), "mp4a.40.2"); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &manifest{JobID: "job", Protocol: "hls"}
+	result, err := uploadOutput(context.Background(), dir, "converted-audio/job/", hlsPlaylistName, m, objectOptions{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"converted-audio/job/manifest.json",
+		"converted-audio/job/master.m3u8",
+		"converted-audio/job/output.m3u8",
+		"converted-audio/job/segment_000.ts",
+		"converted-audio/job/segment_001.ts",
+		"converted-audio/job/segments.json",
+	}
+	if got := storage.keys(); !slices.Equal(got, want) {
+		t.Errorf("uploaded %v, want %v", got, want)
+	}
+	if body, _ := storage.object("converted-audio/job/segment_001.ts"); body != "second" {
+		t.Errorf("segment_001.ts holds %q, want the local file", body)
+	}
+	if !strings.HasSuffix(result.URL, "/test-bucket/converted-audio/job/output.m3u8") {
+		t.Errorf("URL is %s, want the uploaded playlist", result.URL)
+	}
+	if !strings.HasSuffix(result.MasterURL, "/converted-audio/job/master.m3u8") {
+		t.Errorf("MasterURL is %s, want the uploaded master", result.MasterURL)
+	}
+
+	raw, _ := storage.object("converted-audio/job/" + manifestName)
+	var uploaded manifest
+	if err := json.Unmarshal([]byte(raw), &uploaded); err != nil {
+		t.Fatal(err)
+	}
+	if uploaded.PlaylistURL != result.URL || uploaded.SegmentsURL == "" || len(uploaded.Objects) != 4 {
+		t.Errorf("manifest lists playlist %s, segments %q and %d objects, want the upload", uploaded.PlaylistURL, uploaded.SegmentsURL, len(uploaded.Objects))
+	}
+}
+
+func TestUploadOutputMissingSegment(t *testing.T) {
+	storage := useFakeStorage(t)
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, hlsPlaylistName), "#EXTM3U\n#EXTINF:6.0,\nsegment_000.ts\n#EXTINF:6.0,\nsegment_001.ts\n#EXT-X-ENDLIST\n")
+	writeFile(t, filepath.Join(dir, "segment_000.ts"), "first")
+
+	_, err := uploadOutput(context.Background(), dir, "converted-audio/job/", hlsPlaylistName, nil, objectOptions{}, false)
+	if !errors.Is(err, errSegmentMismatch) {
+		t.Fatalf("uploadOutput = %v, want a segment mismatch", err)
+	}
+	if _, ok := storage.object("converted-audio/job/" + hlsPlaylistName); ok {
+		t.Error("playlist with a missing segment was left published")
+	}
+}
+
+func TestFixHeaderTags(t *testing.T) {
+	const playlist = "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:6\n#EXTINF:6.000000,\nsegment_000.ts\n#EXTINF:7.400000,\nsegment_001.ts\n#EXT-X-ENDLIST\n"
+	tests := []struct {
+		name    string
+		fix     func(path string) error
+		want    string
+		wantErr string
+	}{
+		{name: "auto target", fix: func(path string) error { return fixTargetDuration(path, hlsOptions{TargetDurationAuto: true}) }, want: "#EXT-X-TARGETDURATION:7\n"},
+		{name: "requested target", fix: func(path string) error { return fixTargetDuration(path, hlsOptions{TargetDuration: 10}) }, want: "#EXT-X-TARGETDURATION:10\n"},
+		{name: "target too low", fix: func(path string) error { return fixTargetDuration(path, hlsOptions{TargetDuration: 6}) }, wantErr: "below the longest segment"},
+		{name: "version", fix: func(path string) error { return fixVersion(path, 4) }, want: "#EXT-X-VERSION:4\n"},
+		{name: "version too low", fix: func(path string) error { return fixVersion(path, 2) }, wantErr: "needs version 3"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "output.m3u8")
+		writeFile(t, path, playlist)
+		err := tt.fix(path)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: got %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := readFile(t, path); !strings.Contains(got, tt.want) || !slices.Equal(playlistSegments(got), playlistSegments(playlist)) {
+			t.Errorf("%s: patched playlist\n%s\nwant it to carry %q and the same segments", tt.name, got, strings.TrimSpace(tt.want))
+		}
+	}
+
+	// A tag ffmpeg left out is added after #EXTM3U
+	patched, err := setHeaderTag("#EXTM3U\n#EXTINF:6,\nsegment_000.ts\n", versionTag, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := headerTag(patched, versionTag); !ok || got != 3 || !strings.HasPrefix(patched, "#EXTM3U\n#EXT-X-VERSION:3\n") {
+		t.Errorf("setHeaderTag added the tag as\n%s", patched)
+	}
+	if _, err := setHeaderTag("segment_000.ts\n", versionTag, 3); err == nil {
+		t.Error("setHeaderTag accepted a playlist without #EXTM3U")
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	programDateTimeTag = "#EXT-X-PROGRAM-DATE-TIME:"
+	targetDurationTag  = "#EXT-X-TARGETDURATION:"
+	mapTag             = "#EXT-X-MAP:"
+	byteRangeTag       = "#EXT-X-BYTERANGE:"
+	versionTag         = "#EXT-X-VERSION:"
+)
+
+// programDateTimeLayout is ISO 8601 with millisecond precision, as used in
+// the HLS spec examples.
+const programDateTimeLayout = "2006-01-02T15:04:05.000Z07:00"
+
+// extinfDuration returns the duration of an "#EXTINF:<duration>,<title>" line.
+func extinfDuration(line string) (float64, bool) {
+	rest, ok := strings.CutPrefix(line, "#EXTINF:")
+	if !ok {
+		return 0, false
+	}
+	value, _, _ := strings.Cut(rest, ",")
+	duration, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return 0, false
+	}
+	return duration, true
+}
+
+// insertProgramDateTime tags every segment with its wall-clock start time,
+// counting from start. Any tags ffmpeg already wrote are replaced so the
+// playlist carries a single consistent timeline.
+func insertProgramDateTime(playlist string, start time.Time) string {
+	lines := strings.Split(playlist, "\n")
+	out := make([]string, 0, len(lines)*2)
+
+	offset := 0.0
+	for _, line := range lines {
+		if strings.HasPrefix(line, programDateTimeTag) {
+			continue
+		}
+		if duration, ok := extinfDuration(line); ok {
+			at := start.Add(time.Duration(offset * float64(time.Second)))
+			out = append(out, programDateTimeTag+at.UTC().Format(programDateTimeLayout))
+			offset += duration
+		}
+		out = append(out, line)
+	}
+
+	return strings.Join(out, "\n")
+}
+
+// playlistSegments returns the URI following each #EXTINF tag, in order.
+func playlistSegments(playlist string) []string {
+	var segments []string
+	expectURI := false
+	for _, line := range strings.Split(playlist, "\n") {
+		line = strings.TrimSpace(line)
+		if _, ok := extinfDuration(line); ok {
+			expectURI = true
+			continue
+		}
+		if expectURI && line != "" && !strings.HasPrefix(line, "#") {
+			segments = append(segments, line)
+			expectURI = false
+		}
+	}
+	return segments
+}
+
+// playlistMapURIs returns the URI of each #EXT-X-MAP tag, the
+// initialization sections of an fMP4 playlist.
+func playlistMapURIs(playlist string) []string {
+	var uris []string
+	for _, line := range strings.Split(playlist, "\n") {
+		attrs, ok := strings.CutPrefix(strings.TrimSpace(line), mapTag)
+		if !ok {
+			continue
+		}
+		for _, attr := range strings.Split(attrs, ",") {
+			if value, ok := strings.CutPrefix(attr, "URI="); ok {
+				uris = append(uris, strings.Trim(value, `"`))
+			}
+		}
+	}
+	return uris
+}
+
+// parseByteRange reads the "<length>[@<offset>]" of an EXT-X-BYTERANGE tag.
+// hasOffset is false when the sub-range starts where the previous one ended.
+func parseByteRange(value string) (length, offset int64, hasOffset bool, err error) {
+	rawLength, rawOffset, hasOffset := strings.Cut(strings.TrimSpace(value), "@")
+	length, err = strconv.ParseInt(rawLength, 10, 64)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if hasOffset {
+		offset, err = strconv.ParseInt(rawOffset, 10, 64)
+	}
+	return length, offset, hasOffset, err
+}
+
+func rewritePlaylist(path string, rewrite func(string) string) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(rewrite(string(raw))), 0644)
+}
+
+// playlistHeaderTags apply to a whole playlist rather than one segment, so
+// every part produced by splitPlaylist repeats them.
+var playlistHeaderTags = []string{
+	"#EXTM3U",
+	versionTag,
+	targetDurationTag,
+	"#EXT-X-PLAYLIST-TYPE:",
+	"#EXT-X-INDEPENDENT-SEGMENTS",
+}
+
+// splitPlaylist cuts a VOD playlist into standalone playlists of at most
+// maxSegments segments each. The segments aren't touched; each part just
+// lists its share, with a media sequence continuing from the previous part.
+func splitPlaylist(playlist string, maxSegments int) []string {
+	var header []string
+	var blocks [][]string
+	var current []string
+	sequence := 0
+
+	for _, line := range strings.Split(playlist, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "" || trimmed == "#EXT-X-ENDLIST":
+			continue
+		case strings.HasPrefix(trimmed, "#EXT-X-MEDIA-SEQUENCE:"):
+			sequence, _ = strconv.Atoi(strings.TrimPrefix(trimmed, "#EXT-X-MEDIA-SEQUENCE:"))
+			continue
+		case len(blocks) == 0 && len(current) == 0 && isHeaderTag(trimmed):
+			header = append(header, trimmed)
+			continue
+		}
+
+		current = append(current, trimmed)
+		if !strings.HasPrefix(trimmed, "#") {
+			blocks = append(blocks, current)
+			current = nil
+		}
+	}
+
+	var parts []string
+	for start := 0; start < len(blocks); start += maxSegments {
+		end := min(start+maxSegments, len(blocks))
+
+		lines := append([]string{}, header...)
+		lines = append(lines, "#EXT-X-MEDIA-SEQUENCE:"+strconv.Itoa(sequence+start))
+		for _, block := range blocks[start:end] {
+			lines = append(lines, block...)
+		}
+		lines = append(lines, "#EXT-X-ENDLIST", "")
+		parts = append(parts, strings.Join(lines, "\n"))
+	}
+	return parts
+}
+
+func isHeaderTag(line string) bool {
+	for _, tag := range playlistHeaderTags {
+		if strings.HasPrefix(line, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// mapSegmentURIs replaces the URI following each #EXTINF tag with
+// rewrite(uri), leaving every other line as it was.
+func mapSegmentURIs(playlist string, rewrite func(uri string) string) string {
+	lines := strings.Split(playlist, "\n")
+	expectURI := false
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if _, ok := extinfDuration(trimmed); ok {
+			expectURI = true
+			continue
+		}
+		if expectURI && trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+			lines[i] = rewrite(trimmed)
+			expectURI = false
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// requiredTargetDuration is the smallest EXT-X-TARGETDURATION the playlist's
+// segments allow: RFC 8216 requires every EXTINF duration, rounded to the
+// nearest integer, to be at most the target.
+func requiredTargetDuration(playlist string) int {
+	target := 1
+	for _, line := range strings.Split(playlist, "\n") {
+		if d, ok := extinfDuration(strings.TrimSpace(line)); ok {
+			target = max(target, int(math.Round(d)))
+		}
+	}
+	return target
+}
+
+// headerTag returns the value of the playlist's integer tag, such as
+// EXT-X-TARGETDURATION, if it has one.
+func headerTag(playlist string, tag string) (int, bool) {
+	for _, line := range strings.Split(playlist, "\n") {
+		if value, ok := strings.CutPrefix(strings.TrimSpace(line), tag); ok {
+			n, err := strconv.Atoi(value)
+			return n, err == nil
+		}
+	}
+	return 0, false
+}
+
+// setHeaderTag replaces the playlist's integer tag with value, adding the
+// tag after #EXTM3U if ffmpeg left it out, and checks the result still
+// reads as the same playlist.
+func setHeaderTag(playlist string, tag string, value int) (string, error) {
+	lines := strings.Split(playlist, "\n")
+	found := false
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), tag) {
+			lines[i] = tag + strconv.Itoa(value)
+			found = true
+		}
+	}
+	if !found {
+		if len(lines) == 0 || strings.TrimSpace(lines[0]) != "#EXTM3U" {
+			return "", errors.New("playlist doesn't start with #EXTM3U")
+		}
+		lines = append(lines[:1], append([]string{tag + strconv.Itoa(value)}, lines[1:]...)...)
+	}
+	patched := strings.Join(lines, "\n")
+
+	if got, ok := headerTag(patched, tag); !ok || got != value || strings.Count(patched, tag) != 1 {
+		return "", fmt.Errorf("patched playlist doesn't carry a single %s%d", tag, value)
+	}
+	if !slices.Equal(playlistSegments(patched), playlistSegments(playlist)) {
+		return "", errors.New("patched playlist lists different segments")
+	}
+	return patched, nil
+}
+
+// requiredVersion is the lowest EXT-X-VERSION the playlist's tags allow
+// under RFC 8216 section 7, with the feature that needs it.
+func requiredVersion(playlist string) (int, string) {
+	version, feature := 1, ""
+	need := func(v int, f string) {
+		if v > version {
+			version, feature = v, f
+		}
+	}
+	for _, line := range strings.Split(playlist, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, mapTag):
+			need(6, "EXT-X-MAP")
+		case strings.HasPrefix(line, byteRangeTag):
+			need(4, "EXT-X-BYTERANGE")
+		case strings.HasPrefix(line, "#EXTINF:"):
+			// The written form counts: ffmpeg's 2.000000 is still decimal
+			duration, _, _ := strings.Cut(strings.TrimPrefix(line, "#EXTINF:"), ",")
+			if strings.ContainsAny(duration, ".eE") {
+				need(3, "decimal EXTINF durations")
+			}
+		}
+	}
+	return version, feature
+}
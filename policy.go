@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// bucketPolicyCheck is BUCKET_POLICY_CHECK: "warn" logs a policy that
+// doesn't match bucketPublicRead at startup, "strict" refuses to start.
+var (
+	bucketPolicyCheck string
+	bucketPublicRead  bool
+)
+
+type bucketPolicy struct {
+	Statement []struct {
+		Effect    string          `json:"Effect"`
+		Principal json.RawMessage `json:"Principal"`
+		Action    stringList      `json:"Action"`
+		Resource  stringList      `json:"Resource"`
+	} `json:"Statement"`
+}
+
+// stringList accepts the policy grammar's "one string or a list of them".
+type stringList []string
+
+func (l *stringList) UnmarshalJSON(raw []byte) error {
+	var one string
+	if err := json.Unmarshal(raw, &one); err == nil {
+		*l = []string{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(raw, &many); err != nil {
+		return err
+	}
+	*l = many
+	return nil
+}
+
+// anonymousPrincipal reports whether a Principal is "*" or {"AWS": "*"}.
+func anonymousPrincipal(raw json.RawMessage) bool {
+	var one string
+	if json.Unmarshal(raw, &one) == nil {
+		return one == "*"
+	}
+	var byType map[string]stringList
+	if json.Unmarshal(raw, &byType) == nil {
+		for _, principal := range byType["AWS"] {
+			if principal == "*" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// allowsPublicRead reports whether the policy lets anyone GET objects under
+// prefix, which is what players fetching playlists and segments need.
+func (p bucketPolicy) allowsPublicRead(bucket string, prefix string) bool {
+	object := "arn:aws:s3:::" + bucket + "/" + prefix
+	for _, st := range p.Statement {
+		if st.Effect != "Allow" || !anonymousPrincipal(st.Principal) {
+			continue
+		}
+
+		canGet := false
+		for _, action := range st.Action {
+			canGet = canGet || action == "s3:GetObject" || action == "s3:*" || action == "*"
+		}
+		if !canGet {
+			continue
+		}
+
+		for _, resource := range st.Resource {
+			if resource == "*" || (strings.HasSuffix(resource, "*") && strings.HasPrefix(object, strings.TrimSuffix(resource, "*"))) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkBucketPolicy compares the bucket's policy with BUCKET_PUBLIC_READ, so
+// a bucket players can't read from is caught at deploy time rather than on
+// first playback.
+func checkBucketPolicy() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := newMinioClient()
+	if err != nil {
+		return err
+	}
+
+	exists, err := client.BucketExists(ctx, minioBucket)
+	if err != nil {
+		return fmt.Errorf("could not check bucket %s: %w", minioBucket, err)
+	}
+	if !exists {
+		return fmt.Errorf("bucket %s does not exist yet, so its policy can't be checked", minioBucket)
+	}
+
+	raw, err := client.GetBucketPolicy(ctx, minioBucket)
+	if err != nil {
+		return fmt.Errorf("could not read policy of bucket %s: %w", minioBucket, err)
+	}
+
+	public := false
+	if raw != "" {
+		var policy bucketPolicy
+		if err := json.Unmarshal([]byte(raw), &policy); err != nil {
+			return fmt.Errorf("could not parse policy of bucket %s: %w", minioBucket, err)
+		}
+		public = policy.allowsPublicRead(minioBucket, defaultObjectPrefix)
+	}
+
+	switch {
+	case bucketPublicRead && !public:
+		return fmt.Errorf("bucket %s does not allow anonymous reads under %s, so returned URLs won't play", minioBucket, defaultObjectPrefix)
+	case !bucketPublicRead && public:
+		return fmt.Errorf("bucket %s allows anonymous reads but BUCKET_PUBLIC_READ=false", minioBucket)
+	}
+	log.Println("✅ Bucket policy of", minioBucket, "matches BUCKET_PUBLIC_READ")
+	return nil
+}
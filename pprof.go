@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/pprof"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ENABLE_PPROF and PPROF_ADDR. Profiling is served from its own listener,
+// never the public port, and only when explicitly enabled.
+var (
+	pprofEnabled bool
+	pprofAddr    string
+)
+
+// maxProfileSeconds bounds how long one CPU profile or trace may run.
+const maxProfileSeconds = 300
+
+// net/http/pprof isn't imported: its init registers the handlers on
+// http.DefaultServeMux, which is the public server's mux. These handlers
+// serve the same profiles from runtime/pprof on a private mux instead, in
+// the format `go tool pprof` expects.
+func startPprofServer() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /debug/pprof/", handlePprof)
+	mux.HandleFunc("GET /debug/pprof/profile", handleCPUProfile)
+	mux.HandleFunc("GET /debug/pprof/trace", handleTrace)
+
+	server := &http.Server{
+		Addr:              pprofAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: readHeaderTimeout,
+	}
+
+	log.Println("pprof listening on", pprofAddr)
+	if err := server.ListenAndServe(); err != nil {
+		log.Println("pprof server stopped:", err)
+	}
+}
+
+// handlePprof serves /debug/pprof/<name> for any profile runtime/pprof
+// knows (heap, goroutine, allocs, block, mutex, threadcreate), and an index
+// of them at /debug/pprof/.
+func handlePprof(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/debug/pprof/")
+	if name == "" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, p := range pprof.Profiles() {
+			fmt.Fprintf(w, "%d\t%s\n", p.Count(), p.Name())
+		}
+		fmt.Fprintln(w, "-\tprofile")
+		fmt.Fprintln(w, "-\ttrace")
+		return
+	}
+
+	profile := pprof.Lookup(name)
+	if profile == nil {
+		writeError(w, http.StatusNotFound, codeNotFound, "Unknown profile")
+		return
+	}
+
+	debug, _ := strconv.Atoi(r.URL.Query().Get("debug"))
+	if debug > 0 {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	}
+	profile.WriteTo(w, debug)
+}
+
+func handleCPUProfile(w http.ResponseWriter, r *http.Request) {
+	duration, ok := profileDuration(w, r, 30)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="profile"`)
+	if err := pprof.StartCPUProfile(w); err != nil {
+		// Only one CPU profile can run at a time
+		writeError(w, http.StatusConflict, codeConflict, "Could not start CPU profile: "+err.Error())
+		return
+	}
+	sleepUnlessCancelled(r, duration)
+	pprof.StopCPUProfile()
+}
+
+func handleTrace(w http.ResponseWriter, r *http.Request) {
+	duration, ok := profileDuration(w, r, 1)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="trace"`)
+	if err := trace.Start(w); err != nil {
+		writeError(w, http.StatusConflict, codeConflict, "Could not start trace: "+err.Error())
+		return
+	}
+	sleepUnlessCancelled(r, duration)
+	trace.Stop()
+}
+
+func profileDuration(w http.ResponseWriter, r *http.Request, fallback int) (time.Duration, bool) {
+	seconds := fallback
+	if raw := r.URL.Query().Get("seconds"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxProfileSeconds {
+			writeError(w, http.StatusBadRequest, codeBadInput, fmt.Sprintf("Invalid 'seconds', expected 1-%d", maxProfileSeconds))
+			return 0, false
+		}
+		seconds = n
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+func sleepUnlessCancelled(r *http.Request, d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-r.Context().Done():
+	}
+}
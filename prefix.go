@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// prefixTemplate is PREFIX_TEMPLATE, e.g. "{tenant}/{year}/{refId}/". When
+// set it replaces defaultObjectPrefix for prefix_mode=fixed requests.
+var prefixTemplate string
+
+var (
+	placeholderPattern = regexp.MustCompile(`\{([A-Za-z]+)\}`)
+	prefixPlaceholders = []string{"tenant", "refId", "year", "month", "day"}
+)
+
+// validatePrefixTemplate checks a template only uses known placeholders and
+// that its literal parts can't climb out of the bucket root.
+func validatePrefixTemplate(template string) error {
+	for _, m := range placeholderPattern.FindAllStringSubmatch(template, -1) {
+		known := false
+		for _, name := range prefixPlaceholders {
+			known = known || m[1] == name
+		}
+		if !known {
+			return fmt.Errorf("unknown placeholder {%s}, allowed: {%s}", m[1], strings.Join(prefixPlaceholders, "}, {"))
+		}
+	}
+
+	literal := placeholderPattern.ReplaceAllString(template, "x")
+	if strings.ContainsAny(literal, "{}") {
+		return fmt.Errorf("unbalanced braces in %q", template)
+	}
+	if strings.HasPrefix(literal, "/") {
+		return fmt.Errorf("template must be relative, got %q", template)
+	}
+	for _, segment := range strings.Split(literal, "/") {
+		if segment == ".." || segment == "." {
+			return fmt.Errorf("template may not contain %q segments", segment)
+		}
+	}
+	return nil
+}
+
+// renderPrefix fills in the template for one request. Every value becomes a
+// single safe key segment, so a refId can't add path levels or traverse.
+func renderPrefix(template string, tenant string, refID string, now time.Time) string {
+	now = now.UTC()
+	values := map[string]string{
+		"tenant": tenant,
+		"refId":  refID,
+		"year":   now.Format("2006"),
+		"month":  now.Format("01"),
+		"day":    now.Format("02"),
+	}
+
+	prefix := placeholderPattern.ReplaceAllStringFunc(template, func(placeholder string) string {
+		value := values[strings.Trim(placeholder, "{}")]
+		if value == "" || strings.Trim(value, ".") == "" {
+			return "_"
+		}
+		return safeKeySegment(value)
+	})
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return prefix
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	previewDirName        = "preview"
+	defaultPreviewBitrate = "64k"
+	maxPreviewDuration    = 300
+)
+
+// previewOptions ask for a short, low-bitrate copy of the start of the
+// input, published as its own HLS stream under <prefix>preview/ for
+// unauthenticated listening.
+type previewOptions struct {
+	// Duration is how many seconds from the start the preview covers
+	Duration float64
+	Bitrate  string
+}
+
+func (o previewOptions) enabled() bool {
+	return o.Duration > 0
+}
+
+func parsePreviewOptions(q url.Values) (previewOptions, error) {
+	var opts previewOptions
+
+	raw, rawBitrate := q.Get("preview"), q.Get("preview_bitrate")
+	if raw == "" {
+		if rawBitrate != "" {
+			return opts, errors.New("'preview_bitrate' needs 'preview'")
+		}
+		return opts, nil
+	}
+
+	d, err := parseSeconds(raw, maxPreviewDuration)
+	if err != nil {
+		return opts, fmt.Errorf("Invalid 'preview': %v", err)
+	}
+	opts.Duration = d
+
+	opts.Bitrate = defaultPreviewBitrate
+	if rawBitrate != "" {
+		m := bitratePattern.FindStringSubmatch(rawBitrate)
+		kbps := 0
+		if m != nil {
+			kbps, _ = strconv.Atoi(m[1])
+		}
+		if kbps < minBitrateKbps || kbps > maxBitrateKbps {
+			return opts, fmt.Errorf("Invalid 'preview_bitrate' %q, expected %dk-%dk", rawBitrate, minBitrateKbps, maxBitrateKbps)
+		}
+		opts.Bitrate = rawBitrate
+	}
+	return opts, nil
+}
+
+// convertPreview encodes the first req.Preview.Duration seconds of
+// inputPath at the preview bitrate and uploads them under
+// <prefix>preview/. The local files are removed afterwards so the main
+// upload of workingDir doesn't pick them up. Previews aren't spooled: if
+// the upload fails the job fails.
+func convertPreview(ctx context.Context, req convertRequest, workingDir string, inputPath string) (*manifestPreview, error) {
+	previewDir := filepath.Join(workingDir, previewDirName)
+	if err := os.Mkdir(previewDir, 0o755); err != nil {
+		return nil, errors.New("Failed to create temp directory")
+	}
+	defer os.RemoveAll(previewDir)
+
+	// Named apart from "input" so it can never be uploaded as the source
+	previewInput := filepath.Join(workingDir, previewDirName+req.InputExt)
+	if err := cutChapter(ctx, inputPath, previewInput, chapterSpan{Start: 0, End: req.Preview.Duration}); err != nil {
+		return nil, fmt.Errorf("Preview: %w", err)
+	}
+	defer os.Remove(previewInput)
+
+	// The fade-out belongs to the end of the track, which isn't in the
+	// preview, and copying would keep the full bitrate
+	enc := req.Encode
+	enc.Bitrate = req.Preview.Bitrate
+	enc.CopyIfAAC = false
+	enc.Remux = false
+	enc.FadeOut = 0
+	opts := req.HLS
+	opts.MaxPlaylistSegments = 0
+
+	output, err := transcodeHLS(ctx, previewInput, previewDir, enc, opts, nil)
+	if err != nil {
+		return nil, stageError(codeTranscodeFailed, fmt.Errorf("Preview: %w", err))
+	}
+
+	prefix := req.ObjectPrefix + previewDirName + "/"
+	uploaded, err := uploadOutput(ctx, previewDir, prefix, filepath.Base(output.Path), nil, req.Upload, req.Resume)
+	if err != nil {
+		return nil, stageError(codeUploadFailed, fmt.Errorf("Preview: %w", err))
+	}
+	return &manifestPreview{
+		PlaylistURL:     uploaded.URL,
+		MasterURL:       uploaded.MasterURL,
+		DurationSeconds: output.Duration,
+		Bitrate:         output.Bitrate,
+	}, nil
+}
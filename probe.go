@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// mediaInfo is what ffprobe reports about the first audio stream. Zero
+// values mean ffprobe couldn't tell.
+type mediaInfo struct {
+	Duration   float64
+	Channels   int
+	SampleRate int
+	Codec      string
+	BitRate    int64
+
+	// Profile is ffprobe's name for the codec profile, such as LC or
+	// HE-AAC for AAC
+	Profile string
+}
+
+type ffprobeOutput struct {
+	Streams []struct {
+		CodecName  string `json:"codec_name"`
+		Profile    string `json:"profile"`
+		Channels   int    `json:"channels"`
+		SampleRate string `json:"sample_rate"`
+		BitRate    string `json:"bit_rate"`
+	} `json:"streams"`
+	Format struct {
+		Duration string `json:"duration"`
+		BitRate  string `json:"bit_rate"`
+	} `json:"format"`
+}
+
+func probeInput(inputPath string) (mediaInfo, error) {
+	out, err := execCommand(ffprobePath,
+		"-v", "error",
+		"-select_streams", "a:0",
+		"-show_entries", "stream=codec_name,profile,channels,sample_rate,bit_rate:format=duration,bit_rate",
+		"-of", "json",
+		inputPath,
+	).Output()
+	if err != nil {
+		return mediaInfo{}, checkTranscoder(err)
+	}
+
+	var parsed ffprobeOutput
+	if err := json.Unmarshal(out, &parsed); err != nil {
+		return mediaInfo{}, err
+	}
+
+	// Fields ffprobe reports as "N/A" simply stay zero
+	var info mediaInfo
+	info.Duration, _ = strconv.ParseFloat(parsed.Format.Duration, 64)
+	info.BitRate, _ = strconv.ParseInt(parsed.Format.BitRate, 10, 64)
+	if len(parsed.Streams) > 0 {
+		stream := parsed.Streams[0]
+		info.Codec = stream.CodecName
+		info.Profile = stream.Profile
+		info.Channels = stream.Channels
+		info.SampleRate, _ = strconv.Atoi(stream.SampleRate)
+		if br, err := strconv.ParseInt(stream.BitRate, 10, 64); err == nil {
+			info.BitRate = br
+		}
+	}
+	return info, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// encodeProfiles are named presets of /convert parameters, picked with
+// ?profile= or through a tenant's default in TENANT_PROFILES. A profile
+// only fills in what the request leaves out, so explicit parameters always
+// win. ENCODE_PROFILES adds profiles or replaces these built-in ones.
+var encodeProfiles = map[string]map[string]string{
+	"podcast": {"bitrate": "96k", "segment_duration": "10"},
+	"music":   {"bitrate": "256k", "segment_duration": "6"},
+	"voice":   {"bitrate": "48k", "segment_duration": "10"},
+}
+
+// tenantProfiles maps a tenant to the profile its requests get when they
+// don't name one.
+var tenantProfiles = map[string]string{}
+
+// parseEncodeProfiles merges ENCODE_PROFILES, a JSON object of profile name
+// to parameters, into encodeProfiles and checks every profile is a valid
+// set of /convert parameters.
+func parseEncodeProfiles(raw string) error {
+	if raw != "" {
+		var profiles map[string]map[string]string
+		if err := json.Unmarshal([]byte(raw), &profiles); err != nil {
+			return err
+		}
+		for name, params := range profiles {
+			encodeProfiles[name] = params
+		}
+	}
+
+	for name, params := range encodeProfiles {
+		// A dummy source so the spec's required url is satisfied
+		q := url.Values{"url": {"s3://bucket/key.wav"}}
+		for param, value := range params {
+			if param == "profile" || slices.Contains(jobParams, param) {
+				return fmt.Errorf("profile %q: '%s' can't be part of a profile", name, param)
+			}
+			q.Set(param, value)
+		}
+		if err := apiSpec.validateQuery("/convert", http.MethodGet, q); err != nil {
+			return fmt.Errorf("profile %q: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// parseTenantProfiles reads TENANT_PROFILES entries written as
+// tenant:profile.
+func parseTenantProfiles(entries []string) error {
+	for _, entry := range entries {
+		tenant, profile, ok := strings.Cut(entry, ":")
+		if !ok || tenant == "" {
+			return fmt.Errorf("%q isn't tenant:profile", entry)
+		}
+		if _, ok := encodeProfiles[profile]; !ok {
+			return fmt.Errorf("tenant %q: unknown profile %q", tenant, profile)
+		}
+		tenantProfiles[tenant] = profile
+	}
+	return nil
+}
+
+// applyProfile expands the request's profile, or its tenant's default,
+// into the query parameters it doesn't set itself. The profile parameter
+// is removed so the expanded query is what gets saved and compared.
+func applyProfile(r *http.Request) error {
+	q := r.URL.Query()
+	name := q.Get("profile")
+	if name == "" {
+		name = tenantProfiles[requestTenant(r)]
+	}
+	if name == "" {
+		return nil
+	}
+
+	params, ok := encodeProfiles[name]
+	if !ok {
+		names := make([]string, 0, len(encodeProfiles))
+		for known := range encodeProfiles {
+			names = append(names, known)
+		}
+		slices.Sort(names)
+		return fmt.Errorf("Unknown profile %q, known: %s", name, strings.Join(names, ", "))
+	}
+
+	q.Del("profile")
+	explicitBitrate := q.Has("bitrate")
+	for param, value := range params {
+		if !q.Has(param) {
+			q.Set(param, value)
+		}
+	}
+	// Renditions are encoded at their own bitrates, so the profile's yields
+	if !explicitBitrate && (q.Has("renditions") || q.Get("auto_ladder") == "true") {
+		q.Del("bitrate")
+	}
+	r.URL.RawQuery = q.Encode()
+	return nil
+}
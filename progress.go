@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// execCommand builds every ffmpeg/ffprobe invocation. Tests can swap it for
+// a fake that records the arguments and writes stand-in output, so the
+// transcode steps can be exercised without ffmpeg installed.
+var execCommand = exec.Command
+
+// FFMPEG_PATH and FFPROBE_PATH override the binaries looked up on $PATH
+var (
+	ffmpegPath  = "ffmpeg"
+	ffprobePath = "ffprobe"
+)
+
+// ffmpegLogLevel is FFMPEG_LOGLEVEL, passed as -loglevel. Progress comes
+// from -progress rather than stderr, so stderr only needs real problems.
+var ffmpegLogLevel = "error"
+
+var ffmpegLogLevels = []string{"quiet", "panic", "fatal", "error", "warning", "info", "verbose", "debug", "trace"}
+
+// ffmpegCommand builds an ffmpeg invocation without the banner and stats
+// noise, logging to stderr at ffmpegLogLevel.
+func ffmpegCommand(args ...string) *exec.Cmd {
+	cmd := execCommand(ffmpegPath, append([]string{"-hide_banner", "-nostats", "-loglevel", ffmpegLogLevel}, args...)...)
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// checkTranscoder reports a failure to start ffmpeg/ffprobe at all as a 503,
+// so a missing or misconfigured binary isn't mistaken for a bad input.
+func checkTranscoder(err error) error {
+	if errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) {
+		log.Println("🚨 Transcoder unavailable, check FFMPEG_PATH/FFPROBE_PATH:", err)
+		return withCode(codeTranscoderUnavailable, withStatus(http.StatusServiceUnavailable, fmt.Errorf("Transcoder unavailable: %w", err)))
+	}
+	return err
+}
+
+// runFFmpeg runs an ffmpeg command that doesn't report progress, within the
+// same MAX_CONCURRENT_TRANSCODES limit as runWithProgress.
+func runFFmpeg(ctx context.Context, cmd *exec.Cmd) error {
+	if err := transcodeSlots.acquireContext(ctx); err != nil {
+		return err
+	}
+	defer transcodeSlots.release()
+
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	if err := cmd.Start(); err != nil {
+		return checkTranscoder(err)
+	}
+	return waitOrKill(ctx, cmd, killOnCancel(ctx, cmd))
+}
+
+// killOnCancel kills cmd's process as soon as ctx ends, so a cancelled job
+// doesn't keep a transcode slot busy until ffmpeg finishes on its own.
+func killOnCancel(ctx context.Context, cmd *exec.Cmd) (stop func() bool) {
+	return context.AfterFunc(ctx, func() {
+		cmd.Process.Kill()
+	})
+}
+
+// waitOrKill waits for cmd and reports why ctx ended if that is what
+// stopped it, rather than ffmpeg's "signal: killed".
+func waitOrKill(ctx context.Context, cmd *exec.Cmd, stop func() bool) error {
+	err := cmd.Wait()
+	if !stop() && ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	return err
+}
+
+// runWithProgress runs an ffmpeg command started with "-progress pipe:1" and
+// reports the completed percentage as out_time advances. When the total
+// duration is unknown, progress is reported as indeterminate.
+func runWithProgress(ctx context.Context, cmd *exec.Cmd, totalDuration float64, onProgress func(percent float64, known bool)) error {
+	if err := transcodeSlots.acquireContext(ctx); err != nil {
+		return err
+	}
+	defer transcodeSlots.release()
+
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return checkTranscoder(err)
+	}
+	stop := killOnCancel(ctx, cmd)
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok || onProgress == nil {
+			continue
+		}
+
+		switch key {
+		// out_time_ms is in microseconds as well, despite its name
+		case "out_time_us", "out_time_ms":
+			if totalDuration <= 0 {
+				onProgress(0, false)
+				continue
+			}
+			us, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || us < 0 {
+				continue
+			}
+			percent := float64(us) / 1e6 / totalDuration * 100
+			onProgress(min(percent, 100), true)
+		case "progress":
+			if value == "end" && totalDuration > 0 {
+				onProgress(100, true)
+			}
+		}
+	}
+
+	return waitOrKill(ctx, cmd, stop)
+}
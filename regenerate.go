@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// hlsPlaylistName is the playlist every HLS conversion uploads.
+const hlsPlaylistName = "output.m3u8"
+
+// handleRegeneratePlaylist patches the playlist of an existing HLS output
+// in place, for metadata-only changes that don't need a re-encode:
+//
+//   - base_url points the segment URIs at another host, e.g. a CDN; an
+//     empty base_url makes them relative to the playlist again
+//   - program_date_time retimes the EXT-X-PROGRAM-DATE-TIME tags
+//
+// Every segment the playlist lists must still exist under the prefix, and
+// the manifest's checksum for the playlist is updated to match.
+func handleRegeneratePlaylist(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	prefix := q.Get("prefix")
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	if !prefixAllowed(prefix) {
+		writeError(w, http.StatusForbidden, codeForbidden, "Prefix is not allowed")
+		return
+	}
+
+	var start *time.Time
+	if raw := q.Get("program_date_time"); raw != "" {
+		opts, err := parseHLSOptions(url.Values{"program_date_time": {raw}})
+		if err != nil {
+			writeError(w, http.StatusBadRequest, codeBadInput, err.Error())
+			return
+		}
+		start = opts.ProgramDateTime
+	}
+	baseURL, rebase := strings.TrimSuffix(q.Get("base_url"), "/"), q.Has("base_url")
+	if baseURL != "" {
+		if u, err := url.Parse(baseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			writeError(w, http.StatusBadRequest, codeBadInput, "Invalid 'base_url', expected an absolute http(s) URL")
+			return
+		}
+	}
+	if !rebase && start == nil {
+		writeError(w, http.StatusBadRequest, codeBadInput, "Nothing to change: set 'base_url' and/or 'program_date_time'")
+		return
+	}
+
+	raw, err := getObjectBytes(prefix + hlsPlaylistName)
+	if err != nil {
+		status, code := http.StatusBadGateway, codeStorageError
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			status, code = http.StatusNotFound, codeNotFound
+		}
+		writeError(w, status, code, "Failed to read playlist: "+err.Error())
+		return
+	}
+	playlist := string(raw)
+
+	names, err := listObjects(prefix, true)
+	if err != nil {
+		log.Println("Listing segments failed:", err)
+		writeError(w, http.StatusBadGateway, codeStorageError, "Failed to list objects: "+err.Error())
+		return
+	}
+	var stored []string
+	for _, name := range names {
+		if isSegmentObject(name) {
+			stored = append(stored, strings.TrimPrefix(name, prefix))
+		}
+	}
+
+	var missing []string
+	playlist = mapSegmentURIs(playlist, func(uri string) string {
+		segment, ok := storedSegment(uri, stored)
+		if !ok {
+			missing = append(missing, uri)
+			return uri
+		}
+		if !rebase {
+			return uri
+		}
+		if baseURL == "" {
+			return segment
+		}
+		return baseURL + "/" + segment
+	})
+	if len(missing) > 0 {
+		writeError(w, http.StatusConflict, codeConflict, fmt.Sprintf("%d segments listed in the playlist are missing, e.g. %s", len(missing), missing[0]))
+		return
+	}
+
+	if start != nil {
+		playlist = insertProgramDateTime(playlist, *start)
+	}
+
+	// Keep the metadata and expiry tags the conversion uploaded it with
+	objOpts, err := storedObjectOptions(prefix + hlsPlaylistName)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, codeStorageError, "Failed to read playlist metadata: "+err.Error())
+		return
+	}
+	if err := putObjectBytes(prefix+hlsPlaylistName, []byte(playlist), objOpts); err != nil {
+		writeError(w, http.StatusBadGateway, codeUploadFailed, "Upload to MinIO failed: "+err.Error())
+		return
+	}
+	updateManifestObject(prefix, prefix+hlsPlaylistName, []byte(playlist), objOpts)
+
+	playlistURL := publicObjectURL(prefix + hlsPlaylistName)
+	log.Println("✅ Playlist regenerated:", playlistURL)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(fmt.Sprintf("✅ Playlist regenerated\nStream: %s", playlistURL)))
+}
+
+// storedSegment finds which stored segment, relative to the prefix, a
+// playlist URI refers to. Relative URIs must match exactly; absolute ones,
+// left by an earlier base_url, match on their trailing path.
+func storedSegment(uri string, stored []string) (string, bool) {
+	if !strings.Contains(uri, "://") {
+		for _, segment := range stored {
+			if segment == uri {
+				return segment, true
+			}
+		}
+		return "", false
+	}
+
+	best := ""
+	for _, segment := range stored {
+		if strings.HasSuffix(uri, "/"+segment) && len(segment) > len(best) {
+			best = segment
+		}
+	}
+	return best, best != ""
+}
+
+// updateManifestObject refreshes the size and checksum recorded for
+// objectName in the manifest under prefix. Outputs converted without a
+// manifest are left alone; failures are only logged since the playlist
+// itself is already published.
+func updateManifestObject(prefix string, objectName string, data []byte, objOpts objectOptions) {
+	raw, err := getObjectBytes(prefix + manifestName)
+	if err != nil {
+		log.Println("No manifest to update under", prefix+":", err)
+		return
+	}
+	var m manifest
+	if err := json.Unmarshal(raw, &m); err != nil {
+		log.Println("Failed to parse manifest:", err)
+		return
+	}
+
+	sum := sha256.Sum256(data)
+	for i := range m.Objects {
+		if m.Objects[i].Name == objectName {
+			m.Objects[i].Size = int64(len(data))
+			m.Objects[i].SHA256 = hex.EncodeToString(sum[:])
+		}
+	}
+
+	body, err := m.encode()
+	if err != nil {
+		log.Println("Failed to encode manifest:", err)
+		return
+	}
+	if err := putObjectBytes(prefix+manifestName, body, objOpts); err != nil {
+		log.Println("Failed to upload manifest:", err)
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// With 'renditions' the audio is encoded at several bitrates, each into its
+// own <bitrate>/ folder with its own output.m3u8 and segments, and the
+// returned stream is the master.m3u8 listing them for adaptive players.
+const maxRenditions = 6
+
+// How the renditions are encoded: in one ffmpeg run that decodes the input
+// once and feeds every encoder, or as one ffmpeg run per rendition with at
+// most renditionParallelism of them at a time. A single run does the least
+// work in all; separate runs finish sooner when there are idle cores.
+const (
+	renditionsSingle   = "single"
+	renditionsParallel = "parallel"
+)
+
+// renditionMode is RENDITION_MODE, the rendition_mode used when a request
+// doesn't choose; renditionParallelism is RENDITION_PARALLELISM.
+var (
+	renditionMode        = renditionsSingle
+	renditionParallelism = 2
+)
+
+// autoLadder is AUTO_LADDER_BITRATES, the candidate renditions of
+// auto_ladder=true, lowest first. Those above the source's bitrate are
+// skipped once it has been probed.
+var autoLadder = []string{"64k", "96k", "128k", "192k", "256k"}
+
+type renditionOptions struct {
+	// Bitrates are the distinct renditions, lowest first
+	Bitrates []string
+	Mode     string
+
+	// Auto means Bitrates are autoLadder's candidates, still to be capped
+	// at the source's bitrate
+	Auto bool
+}
+
+func (o renditionOptions) enabled() bool {
+	return len(o.Bitrates) > 0
+}
+
+func parseRenditionMode(mode string) (string, error) {
+	switch mode {
+	case renditionsSingle, renditionsParallel:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("Unsupported rendition_mode %q. Only single and parallel are allowed", mode)
+	}
+}
+
+func parseRenditions(q url.Values) (renditionOptions, error) {
+	var opts renditionOptions
+	raw := q.Get("renditions")
+	switch q.Get("auto_ladder") {
+	case "", "false":
+	case "true":
+		if raw != "" {
+			return opts, errors.New("'auto_ladder' can't be combined with 'renditions'")
+		}
+		opts.Bitrates, opts.Auto = autoLadder, true
+	default:
+		return opts, fmt.Errorf("Invalid 'auto_ladder' %q, expected true or false", q.Get("auto_ladder"))
+	}
+	if raw == "" && !opts.Auto {
+		if q.Get("rendition_mode") != "" {
+			return opts, errors.New("'rendition_mode' needs 'renditions' or 'auto_ladder'")
+		}
+		return opts, nil
+	}
+
+	if raw != "" {
+		var err error
+		if opts.Bitrates, err = parseLadder(strings.Split(raw, ",")); err != nil {
+			return opts, fmt.Errorf("Invalid 'renditions': %w", err)
+		}
+		if len(opts.Bitrates) < 2 {
+			return opts, fmt.Errorf("'renditions' needs between 2 and %d bitrates", maxRenditions)
+		}
+	}
+
+	opts.Mode = renditionMode
+	if mode := q.Get("rendition_mode"); mode != "" {
+		var err error
+		if opts.Mode, err = parseRenditionMode(mode); err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
+}
+
+// parseLadder validates a list of 1-maxRenditions distinct bitrates and
+// sorts it lowest first.
+func parseLadder(bitrates []string) ([]string, error) {
+	var ladder []string
+	for _, bitrate := range bitrates {
+		bitrate = strings.TrimSpace(bitrate)
+		if _, ok := bitrateKbps(bitrate); !ok {
+			return nil, fmt.Errorf("bitrate %q, expected %dk-%dk", bitrate, minBitrateKbps, maxBitrateKbps)
+		}
+		if slices.Contains(ladder, bitrate) {
+			return nil, fmt.Errorf("%s is listed twice", bitrate)
+		}
+		ladder = append(ladder, bitrate)
+	}
+	if len(ladder) == 0 || len(ladder) > maxRenditions {
+		return nil, fmt.Errorf("%d bitrates, expected 1-%d", len(ladder), maxRenditions)
+	}
+	slices.SortFunc(ladder, func(a, b string) int {
+		kbpsA, _ := bitrateKbps(a)
+		kbpsB, _ := bitrateKbps(b)
+		return cmp.Compare(kbpsA, kbpsB)
+	})
+	return ladder, nil
+}
+
+// capLadder drops the renditions of ladder above sourceBitRate, in bits
+// per second, as encoding them only wastes bits. The lowest is always kept,
+// and an unknown source bitrate keeps them all.
+func capLadder(ladder []string, sourceBitRate int64) []string {
+	if sourceBitRate <= 0 {
+		return ladder
+	}
+	capped := ladder[:1]
+	for _, bitrate := range ladder[1:] {
+		if kbps, _ := bitrateKbps(bitrate); int64(kbps)*1000 <= sourceBitRate {
+			capped = append(capped, bitrate)
+		}
+	}
+	return capped
+}
+
+// transcodeRenditions encodes inputPath once per rendition into a
+// <bitrate>/ folder of workingDir and writes the master.m3u8 listing them
+// there. The output is the master playlist, with each rendition's own
+// output in Variants.
+func transcodeRenditions(ctx context.Context, inputPath string, workingDir string, enc encodeOptions, opts hlsOptions, renditions renditionOptions, onProgress func(percent float64, known bool)) (transcodeOutput, error) {
+	if renditions.Auto {
+		info, err := probeInput(inputPath)
+		if err != nil {
+			log.Println("Warning: could not probe input:", err)
+		}
+		renditions.Bitrates = capLadder(renditions.Bitrates, info.BitRate)
+		log.Printf("Auto ladder for a %dk source: %s", info.BitRate/1000, strings.Join(renditions.Bitrates, ","))
+	}
+	for _, bitrate := range renditions.Bitrates {
+		if err := os.Mkdir(filepath.Join(workingDir, bitrate), 0o755); err != nil {
+			return transcodeOutput{}, errors.New("Failed to create temp directory")
+		}
+	}
+
+	var variants []transcodeOutput
+	var err error
+	if renditions.Mode == renditionsParallel {
+		variants, err = encodeRenditionsApart(ctx, inputPath, workingDir, enc, opts, renditions.Bitrates, onProgress)
+	} else {
+		variants, err = encodeRenditionsTogether(ctx, inputPath, workingDir, enc, opts, renditions.Bitrates, onProgress)
+	}
+	if err != nil {
+		return transcodeOutput{}, err
+	}
+
+	top := variants[len(variants)-1]
+	output := transcodeOutput{
+		Path:     filepath.Join(workingDir, masterPlaylistName),
+		Duration: top.Duration,
+		Codec:    top.Codec,
+		Codecs:   top.Codecs,
+		Bitrate:  top.Bitrate,
+		Variants: variants,
+	}
+	masters := make([]masterVariant, len(variants))
+	for i, variant := range variants {
+		// Every rendition is cut from the same input, so they all warn alike
+		for _, warning := range variant.Warnings {
+			if !slices.Contains(output.Warnings, warning) {
+				output.Warnings = append(output.Warnings, warning)
+			}
+		}
+		if masters[i], err = measureVariant(variant.Path, variantURI(variant), variant.Codecs); err != nil {
+			return output, fmt.Errorf("Failed to write master playlist: %w", err)
+		}
+	}
+	if err := writeMaster(output.Path, masters); err != nil {
+		return output, fmt.Errorf("Failed to write master playlist: %w", err)
+	}
+	return output, nil
+}
+
+// variantURI is where a rendition's playlist is relative to the master.
+func variantURI(variant transcodeOutput) string {
+	return filepath.Base(filepath.Dir(variant.Path)) + "/" + filepath.Base(variant.Path)
+}
+
+// encodeRenditionsApart runs encodeHLS once per bitrate, at most
+// renditionParallelism at a time, reporting their average progress. The
+// first failure stops the rest.
+func encodeRenditionsApart(ctx context.Context, inputPath string, workingDir string, enc encodeOptions, opts hlsOptions, bitrates []string, onProgress func(percent float64, known bool)) ([]transcodeOutput, error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		percents = make([]float64, len(bitrates))
+		variants = make([]transcodeOutput, len(bitrates))
+		slots    = make(chan struct{}, renditionParallelism)
+	)
+	for i, bitrate := range bitrates {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-slots }()
+
+			progress := func(percent float64, known bool) {
+				mu.Lock()
+				defer mu.Unlock()
+				percents[i] = percent
+				if onProgress != nil {
+					var sum float64
+					for _, p := range percents {
+						sum += p
+					}
+					onProgress(sum/float64(len(percents)), known)
+				}
+			}
+
+			renditionEnc := enc
+			renditionEnc.Bitrate = bitrate
+			variant, err := encodeHLS(ctx, inputPath, filepath.Join(workingDir, bitrate), renditionEnc, opts, progress)
+			if err != nil {
+				cancel(fmt.Errorf("Rendition %s: %w", bitrate, err))
+				return
+			}
+			variants[i] = variant
+		}()
+	}
+	wg.Wait()
+
+	if err := context.Cause(ctx); err != nil {
+		return nil, err
+	}
+	return variants, nil
+}
+
+// encodeRenditionsTogether encodes every bitrate in one ffmpeg run, the
+// input's audio mapped once per rendition and each copy written to its own
+// folder through -var_stream_map.
+func encodeRenditionsTogether(ctx context.Context, inputPath string, workingDir string, enc encodeOptions, opts hlsOptions, bitrates []string, onProgress func(percent float64, known bool)) ([]transcodeOutput, error) {
+	info, err := probeInput(inputPath)
+	if err != nil {
+		log.Println("Warning: could not probe input:", err)
+	}
+
+	variants := make([]transcodeOutput, len(bitrates))
+	var encodeArgs []string
+	for i, bitrate := range bitrates {
+		renditionEnc := enc
+		renditionEnc.Bitrate = bitrate
+		variants[i], encodeArgs, opts, err = planHLS(info, filepath.Join(workingDir, bitrate), renditionEnc, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The filters and codec are the same for every rendition; only the
+	// bitrate is set per stream
+	if i := slices.Index(encodeArgs, "-b:a"); i >= 0 {
+		encodeArgs = slices.Delete(slices.Clone(encodeArgs), i, i+2)
+	}
+	args := []string{"-i", inputPath, "-progress", "pipe:1"}
+	var streamMap []string
+	for i, bitrate := range bitrates {
+		args = append(args, "-map", "0:a:0")
+		streamMap = append(streamMap, fmt.Sprintf("a:%d,name:%s", i, bitrate))
+	}
+	args = append(args, encodeArgs...)
+	for i, bitrate := range bitrates {
+		args = append(args, fmt.Sprintf("-b:a:%d", i), bitrate)
+	}
+	args = append(args, "-f", "hls")
+	args = append(args, opts.ffmpegArgs()...)
+	args = append(args,
+		"-var_stream_map", strings.Join(streamMap, " "),
+		"-hls_segment_filename", hlsSegmentPattern(filepath.Join(workingDir, "%v"), opts),
+		filepath.Join(workingDir, "%v", hlsPlaylistName),
+	)
+
+	cmd, warnings := ffmpegEncodeCommand(args...)
+	if err := runWithProgress(ctx, cmd, info.Duration, onProgress); err != nil {
+		return nil, fmt.Errorf("FFmpeg conversion failed: %w", err)
+	}
+	ffmpegWarnings := warnings.list()
+
+	for i := range variants {
+		variants[i].Warnings = append(variants[i].Warnings, ffmpegWarnings...)
+		if err := finishHLS(&variants[i], opts); err != nil {
+			return nil, fmt.Errorf("Rendition %s: %w", bitrates[i], err)
+		}
+	}
+	return variants, nil
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseRenditions(t *testing.T) {
+	tests := []struct {
+		query    string
+		bitrates []string
+		mode     string
+		auto     bool
+		wantErr  bool
+	}{
+		{query: ""},
+		{query: "renditions=256k,64k,128k", bitrates: []string{"64k", "128k", "256k"}, mode: renditionsSingle},
+		{query: "renditions=64k,%20128k&rendition_mode=parallel", bitrates: []string{"64k", "128k"}, mode: renditionsParallel},
+		{query: "renditions=128k", wantErr: true},
+		{query: "renditions=64k,64k", wantErr: true},
+		{query: "renditions=64k,1000k", wantErr: true},
+		{query: "renditions=64k,fast", wantErr: true},
+		{query: "renditions=32k,64k,96k,128k,192k,256k,320k", wantErr: true},
+		{query: "renditions=64k,128k&rendition_mode=serial", wantErr: true},
+		{query: "rendition_mode=single", wantErr: true},
+		{query: "auto_ladder=true&rendition_mode=parallel", bitrates: autoLadder, mode: renditionsParallel, auto: true},
+		{query: "auto_ladder=false"},
+		{query: "auto_ladder=yes", wantErr: true},
+		{query: "auto_ladder=true&renditions=64k,128k", wantErr: true},
+	}
+	for _, tt := range tests {
+		q, err := url.ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := parseRenditions(q)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseRenditions(%q) = %+v, want an error", tt.query, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseRenditions(%q): %v", tt.query, err)
+			continue
+		}
+		if !slices.Equal(got.Bitrates, tt.bitrates) || got.Mode != tt.mode || got.Auto != tt.auto {
+			t.Errorf("parseRenditions(%q) = %+v, want %v in %q mode", tt.query, got, tt.bitrates, tt.mode)
+		}
+	}
+}
+
+func TestCapLadder(t *testing.T) {
+	ladder := []string{"64k", "96k", "128k", "192k", "256k"}
+	tests := []struct {
+		sourceBitRate int64
+		want          []string
+	}{
+		{1411200, ladder},
+		{256000, ladder},
+		{160000, []string{"64k", "96k", "128k"}},
+		{128000, []string{"64k", "96k", "128k"}},
+		{48000, []string{"64k"}},
+		{0, ladder},
+	}
+	for _, tt := range tests {
+		if got := capLadder(ladder, tt.sourceBitRate); !slices.Equal(got, tt.want) {
+			t.Errorf("capLadder(%d) = %v, want %v", tt.sourceBitRate, got, tt.want)
+		}
+	}
+}
+
+func TestParseLadder(t *testing.T) {
+	got, err := parseLadder([]string{"192k", " 64k", "128k"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"64k", "128k", "192k"}; !slices.Equal(got, want) {
+		t.Errorf("parseLadder = %v, want %v", got, want)
+	}
+	for _, bad := range [][]string{nil, {"64k", "64k"}, {"64"}, {"32k", "64k", "96k", "128k", "160k", "192k", "256k"}} {
+		if _, err := parseLadder(bad); err == nil {
+			t.Errorf("parseLadder(%q) succeeded, want an error", bad)
+		}
+	}
+}
+
+func TestTranscodeRenditionsSingleRun(t *testing.T) {
+	calls := fakeTranscoder(t)
+	dir := t.TempDir()
+	renditions := renditionOptions{Bitrates: []string{"64k", "128k"}, Mode: renditionsSingle}
+
+	output, err := transcodeRenditions(context.Background(), filepath.Join(dir, "input.wav"), dir, encodeOptions{}, hlsOptions{SegmentDuration: 6}, renditions, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ffmpegRuns := calls.ffmpeg()
+	if len(ffmpegRuns) != 1 {
+		t.Fatalf("ffmpeg ran %d times, want once", len(ffmpegRuns))
+	}
+	args := strings.Join(ffmpegRuns[0], " ")
+	for _, want := range []string{"-b:a:0 64k", "-b:a:1 128k", "-var_stream_map a:0,name:64k a:1,name:128k"} {
+		if !strings.Contains(args, want) {
+			t.Errorf("ffmpeg args %q don't contain %q", args, want)
+		}
+	}
+	if strings.Contains(args, "-b:a 192k") {
+		t.Errorf("ffmpeg args %q still set the default bitrate", args)
+	}
+
+	checkRenditionsMaster(t, output, dir, renditions.Bitrates)
+}
+
+func TestTranscodeRenditionsParallel(t *testing.T) {
+	calls := fakeTranscoder(t)
+	dir := t.TempDir()
+	renditions := renditionOptions{Bitrates: []string{"64k", "128k", "256k"}, Mode: renditionsParallel}
+
+	output, err := transcodeRenditions(context.Background(), filepath.Join(dir, "input.wav"), dir, encodeOptions{}, hlsOptions{SegmentDuration: 6}, renditions, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var bitrates []string
+	for _, args := range calls.ffmpeg() {
+		if i := slices.Index(args, "-b:a"); i >= 0 {
+			bitrates = append(bitrates, args[i+1])
+		}
+	}
+	slices.Sort(bitrates)
+	if !slices.Equal(bitrates, []string{"128k", "256k", "64k"}) {
+		t.Errorf("ffmpeg encoded at %v, want one run per rendition", bitrates)
+	}
+
+	checkRenditionsMaster(t, output, dir, renditions.Bitrates)
+}
+
+// checkRenditionsMaster checks that output is the master playlist in dir
+// listing one variant per bitrate, lowest first.
+func checkRenditionsMaster(t *testing.T, output transcodeOutput, dir string, bitrates []string) {
+	t.Helper()
+	if output.Path != filepath.Join(dir, masterPlaylistName) {
+		t.Errorf("output is %s, want the master playlist", output.Path)
+	}
+	if len(output.Variants) != len(bitrates) {
+		t.Fatalf("%d variants, want %d", len(output.Variants), len(bitrates))
+	}
+	var want []string
+	for i, bitrate := range bitrates {
+		if output.Variants[i].Bitrate != bitrate {
+			t.Errorf("variant %d is %s, want %s", i, output.Variants[i].Bitrate, bitrate)
+		}
+		want = append(want, bitrate+"/"+hlsPlaylistName)
+	}
+	master := readFile(t, output.Path)
+	if got := masterVariantURIs(master); !slices.Equal(got, want) {
+		t.Errorf("master lists %v, want %v", got, want)
+	}
+	if !strings.Contains(master, `CODECS="mp4a.40.2"`) {
+		t.Errorf("master doesn't declare CODECS:\n%s", master)
+	}
+}
+
+// Both renditions write their own segment_000.ts; uploaded under one
+// prefix, each has to land in its own folder rather than replace the
+// other's.
+func TestUploadRenditionsKeepsVariantsApart(t *testing.T) {
+	fakeTranscoder(t)
+	storage := useFakeStorage(t)
+	dir := t.TempDir()
+	renditions := renditionOptions{Bitrates: []string{"64k", "128k"}, Mode: renditionsSingle}
+	output, err := transcodeRenditions(context.Background(), filepath.Join(dir, "input.wav"), dir, encodeOptions{}, hlsOptions{SegmentDuration: 6}, renditions, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prefix := "converted-audio/job/"
+	result, err := uploadOutput(context.Background(), dir, prefix, filepath.Base(output.Path), nil, objectOptions{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(result.URL, prefix+masterPlaylistName) || result.MasterURL != result.URL {
+		t.Errorf("stream %s, master %s, want both to be the uploaded master", result.URL, result.MasterURL)
+	}
+
+	if overwritten := storage.overwritten(); len(overwritten) > 0 {
+		t.Errorf("objects written more than once: %v", overwritten)
+	}
+	want := []string{
+		prefix + "128k/output.m3u8",
+		prefix + "128k/segment_000.ts",
+		prefix + "128k/segments.json",
+		prefix + "64k/output.m3u8",
+		prefix + "64k/segment_000.ts",
+		prefix + "64k/segments.json",
+		prefix + "master.m3u8",
+	}
+	if got := storage.keys(); !slices.Equal(got, want) {
+		t.Errorf("uploaded %v, want %v", got, want)
+	}
+
+	// Every reference resolves against the playlist that makes it
+	master, _ := storage.object(prefix + masterPlaylistName)
+	for _, variant := range masterVariantURIs(master) {
+		playlist, ok := storage.object(prefix + variant)
+		if !ok {
+			t.Errorf("master lists %s, which wasn't uploaded", variant)
+			continue
+		}
+		for _, segment := range playlistSegments(playlist) {
+			if _, ok := storage.object(prefix + path.Dir(variant) + "/" + segment); !ok {
+				t.Errorf("%s lists %s, which wasn't uploaded next to it", variant, segment)
+			}
+		}
+	}
+}
+
+// Every built-in profile sets a bitrate; it gives way to renditions rather
+// than conflicting with them, while one the caller sets still conflicts.
+func TestParseConvertRequestRenditionsWithProfile(t *testing.T) {
+	previousKeys, previousProfiles := apiKeys, tenantProfiles
+	apiKeys, tenantProfiles = parseAPIKeys([]string{"acme:acme-key"}), map[string]string{"acme": "music"}
+	t.Cleanup(func() { apiKeys, tenantProfiles = previousKeys, previousProfiles })
+
+	tests := []struct {
+		key      string
+		query    string
+		bitrates []string
+		wantErr  string
+	}{
+		{query: "renditions=64k,128k&profile=podcast", bitrates: []string{"64k", "128k"}},
+		{query: "auto_ladder=true&profile=voice", bitrates: autoLadder},
+		{key: "acme-key", query: "renditions=64k,256k", bitrates: []string{"64k", "256k"}},
+		{key: "acme-key", query: "auto_ladder=true", bitrates: autoLadder},
+		{query: "renditions=64k,128k&profile=podcast&bitrate=96k", wantErr: "'renditions' can't be combined with 'bitrate'"},
+		{key: "acme-key", query: "auto_ladder=true&bitrate=96k", wantErr: "'auto_ladder' can't be combined with 'bitrate'"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/convert?url=https://cdn.example/a.wav&protocol=hls&"+tt.query, nil)
+		if tt.key != "" {
+			r.Header.Set("X-API-Key", tt.key)
+		}
+		req, err := parseConvertRequest(r)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: got %v, want %q", tt.query, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.query, err)
+			continue
+		}
+		if !slices.Equal(req.Renditions.Bitrates, tt.bitrates) {
+			t.Errorf("%s: renditions %v, want %v", tt.query, req.Renditions.Bitrates, tt.bitrates)
+		}
+		if r.URL.Query().Has("bitrate") {
+			t.Errorf("%s: expanded query %q still sets the profile's bitrate", tt.query, r.URL.RawQuery)
+		}
+	}
+}
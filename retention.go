@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// maxRetentionDays bounds retention_days; a typo shouldn't lock objects
+// for centuries.
+const maxRetentionDays = 36500
+
+// parseRetention reads 'retention_mode' and 'retention_days' into opts.
+// Both are needed together, and the bucket must have object lock enabled,
+// which can only be chosen when it is created.
+func parseRetention(q url.Values, opts *objectOptions) error {
+	rawMode, rawDays := q.Get("retention_mode"), q.Get("retention_days")
+	if rawMode == "" && rawDays == "" {
+		return nil
+	}
+	if rawMode == "" || rawDays == "" {
+		return errors.New("'retention_mode' and 'retention_days' must be set together")
+	}
+
+	mode := minio.RetentionMode(strings.ToUpper(rawMode))
+	if !mode.IsValid() {
+		return fmt.Errorf("Unsupported retention_mode %q. Only governance and compliance are allowed", rawMode)
+	}
+	days, err := strconv.Atoi(rawDays)
+	if err != nil || days < 1 || days > maxRetentionDays {
+		return fmt.Errorf("Invalid 'retention_days' %q, expected 1-%d", rawDays, maxRetentionDays)
+	}
+	// Retained objects can't be taken down again, which rolling a window
+	// off needs
+	if q.Get("hls_list_size") != "" {
+		return errors.New("'retention_mode' can't be combined with 'hls_list_size'")
+	}
+
+	if err := checkObjectLock(); err != nil {
+		return err
+	}
+	opts.RetentionMode = string(mode)
+	opts.RetentionDays = days
+	return nil
+}
+
+// checkObjectLock reports whether the bucket has object lock enabled, as
+// retention on its objects requires.
+func checkObjectLock() error {
+	client, err := newMinioClient()
+	if err != nil {
+		return err
+	}
+
+	enabled, _, _, _, err := client.GetObjectLockConfig(context.Background(), minioBucket)
+	if status := minio.ToErrorResponse(err).StatusCode; err != nil && (status == 0 || status >= 500) {
+		return withCode(codeStorageError, fmt.Errorf("Failed to read the bucket's object lock configuration: %w", err))
+	}
+	if err != nil || enabled != "Enabled" {
+		return fmt.Errorf("Bucket %q doesn't have object lock enabled, so 'retention_mode' can't be applied", minioBucket)
+	}
+	return nil
+}
+
+// retainUntil is when an object uploaded now stops being retained.
+func (o objectOptions) retainUntil() time.Time {
+	if !o.RetainUntil.IsZero() {
+		return o.RetainUntil
+	}
+	return time.Now().UTC().AddDate(0, 0, o.RetentionDays)
+}
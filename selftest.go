@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"log"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// selfTest is SELF_TEST: convert a generated sample through transcode and
+// upload at startup and refuse to start if that fails, so a broken ffmpeg
+// build or storage misconfiguration shows up before the first request.
+var selfTest bool
+
+const selfTestPrefix = "self-test/"
+
+// sampleWAV is one second of a 440 Hz tone as 16-bit mono PCM.
+func sampleWAV() []byte {
+	const rate = 8000
+	samples := make([]int16, rate)
+	for i := range samples {
+		samples[i] = int16(8000 * math.Sin(2*math.Pi*440*float64(i)/rate))
+	}
+
+	var buf bytes.Buffer
+	dataSize := uint32(len(samples) * 2)
+	buf.WriteString("RIFF")
+	binary.Write(&buf, binary.LittleEndian, 36+dataSize)
+	buf.WriteString("WAVEfmt ")
+	for _, field := range []any{
+		uint32(16),       // fmt chunk size
+		uint16(1),        // PCM
+		uint16(1),        // channels
+		uint32(rate),     // sample rate
+		uint32(rate * 2), // byte rate
+		uint16(2),        // block align
+		uint16(16),       // bits per sample
+	} {
+		binary.Write(&buf, binary.LittleEndian, field)
+	}
+	buf.WriteString("data")
+	binary.Write(&buf, binary.LittleEndian, dataSize)
+	binary.Write(&buf, binary.LittleEndian, samples)
+	return buf.Bytes()
+}
+
+// runSelfTest converts the sample to HLS under a throwaway prefix, checks
+// the upload, then removes everything it wrote.
+func runSelfTest() error {
+	ctx := context.Background()
+	start := time.Now()
+
+	workingDir, err := os.MkdirTemp("", "hls-self-test-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workingDir)
+
+	inputPath := filepath.Join(workingDir, "input.wav")
+	if err := os.WriteFile(inputPath, sampleWAV(), 0o644); err != nil {
+		return err
+	}
+
+	enc, err := parseEncodeOptions(url.Values{})
+	if err != nil {
+		return err
+	}
+	opts, err := parseHLSOptions(url.Values{})
+	if err != nil {
+		return err
+	}
+	output, err := transcodeHLS(ctx, inputPath, workingDir, enc, opts, nil)
+	if err != nil {
+		return err
+	}
+	// Only the output is published; the input isn't part of the check
+	os.Remove(inputPath)
+
+	jobID := uuid.NewString()
+	prefix := selfTestPrefix + jobID + "/"
+	defer removeObjectsUnder(prefix)
+
+	m := &manifest{JobID: jobID, CreatedAt: time.Now().UTC(), Protocol: "hls", Codec: output.Codec, Bitrate: output.Bitrate}
+	if _, err := uploadOutput(ctx, workingDir, prefix, filepath.Base(output.Path), m, objectOptions{}, false); err != nil {
+		return err
+	}
+	if m.SegmentCount == 0 {
+		return errors.New("no segments were produced")
+	}
+
+	log.Printf("✅ Self-test passed in %s (%d segments)", time.Since(start).Round(time.Millisecond), m.SegmentCount)
+	return nil
+}
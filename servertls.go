@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+)
+
+// TLS_CERT_FILE and TLS_KEY_FILE switch the server to HTTPS for
+// deployments without a proxy in front; plain HTTP stays the default.
+var (
+	tlsCertFile     string
+	tlsKeyFile      string
+	serverTLSConfig *tls.Config
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newServerTLSConfig builds the listener config from TLS_MIN_VERSION
+// (default 1.2) and TLS_CIPHER_SUITES, a comma-separated list of Go cipher
+// suite names. Cipher suites only apply up to TLS 1.2; Go always picks the
+// TLS 1.3 suites itself. Insecure suites are refused.
+func newServerTLSConfig(minVersion string, cipherSuites []string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if minVersion != "" {
+		v, ok := tlsVersions[minVersion]
+		if !ok {
+			return nil, fmt.Errorf("invalid TLS_MIN_VERSION %q, expected 1.0, 1.1, 1.2 or 1.3", minVersion)
+		}
+		config.MinVersion = v
+	}
+
+	if len(cipherSuites) > 0 {
+		known := make(map[string]uint16)
+		for _, suite := range tls.CipherSuites() {
+			known[suite.Name] = suite.ID
+		}
+		for _, name := range cipherSuites {
+			id, ok := known[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown or insecure cipher suite %q in TLS_CIPHER_SUITES", name)
+			}
+			config.CipherSuites = append(config.CipherSuites, id)
+		}
+		if config.MinVersion == tls.VersionTLS13 {
+			return nil, errors.New("TLS_CIPHER_SUITES has no effect with TLS_MIN_VERSION=1.3")
+		}
+	}
+
+	return config, nil
+}
+
+// tlsEnabled reports whether both halves of the key pair are configured.
+func tlsEnabled() bool {
+	return tlsCertFile != "" && tlsKeyFile != ""
+}
+
+func validateTLSFiles() error {
+	if (tlsCertFile == "") != (tlsKeyFile == "") {
+		return errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if tlsEnabled() {
+		if _, err := tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile); err != nil {
+			return fmt.Errorf("loading TLS key pair: %w", err)
+		}
+	}
+	return nil
+}
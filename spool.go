@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errUploadSpooled is returned by convert when the output was converted but
+// the upload failed and has been handed to the spool for retrying.
+var errUploadSpooled = errors.New("upload deferred to spool")
+
+type spoolEntry struct {
+	JobID        string    `json:"jobId"`
+	ObjectPrefix string    `json:"objectPrefix"`
+	OutputName   string    `json:"outputName"`
+	StreamURL    string    `json:"streamUrl"`
+	Manifest     *manifest `json:"manifest,omitempty"`
+	PruneWindow  bool      `json:"pruneWindow,omitempty"`
+	// DeleteSource is the s3:// source to remove once the upload succeeds
+	DeleteSource string        `json:"deleteSource,omitempty"`
+	Upload       objectOptions `json:"upload"`
+	SpooledAt    time.Time     `json:"spooledAt"`
+}
+
+func (e spoolEntry) refID() string {
+	if e.Manifest == nil {
+		return ""
+	}
+	return e.Manifest.RefID
+}
+
+// spoolOutput moves a finished working directory into the spool. The
+// metadata needed to upload it later is written next to it as <jobID>.json.
+func spoolOutput(workingDir string, entry spoolEntry) error {
+	entry.SpooledAt = time.Now()
+
+	dest := filepath.Join(spoolDir, entry.JobID)
+	if err := os.MkdirAll(spoolDir, 0755); err != nil {
+		return err
+	}
+
+	// The temp dir and spool may live on different filesystems
+	if err := os.Rename(workingDir, dest); err != nil {
+		if err := os.CopyFS(dest, os.DirFS(workingDir)); err != nil {
+			os.RemoveAll(dest)
+			return err
+		}
+	}
+
+	meta, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dest+".json", meta, 0644)
+}
+
+func runSpoolWorker() {
+	ticker := time.NewTicker(spoolRetryInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		retrySpool()
+	}
+}
+
+func retrySpool() {
+	entries, err := os.ReadDir(spoolDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("Failed to read spool:", err)
+		}
+		return
+	}
+
+	for _, dirEntry := range entries {
+		if dirEntry.IsDir() || filepath.Ext(dirEntry.Name()) != ".json" {
+			continue
+		}
+		retrySpoolEntry(filepath.Join(spoolDir, dirEntry.Name()))
+	}
+}
+
+// spoolLock keeps the worker and POST /jobs/{id}/retry_upload from
+// uploading the same entry at once.
+var spoolLock sync.Mutex
+
+// errNotSpooled is returned for a job with no spooled output to retry.
+var errNotSpooled = withCode(codeConflict, withStatus(http.StatusConflict, errors.New("No retained output to upload for this job")))
+
+// retrySpoolEntry tries the upload described by the entry at metaPath
+// again. Objects a previous attempt already uploaded unchanged are kept
+// rather than sent again, see uploadToMinio. It returns the upload's
+// error, or nil once the entry is done with, uploaded or given up on.
+func retrySpoolEntry(metaPath string) error {
+	spoolLock.Lock()
+	defer spoolLock.Unlock()
+
+	dir := strings.TrimSuffix(metaPath, ".json")
+	raw, err := os.ReadFile(metaPath)
+	if os.IsNotExist(err) {
+		return errNotSpooled
+	}
+	if err != nil {
+		log.Println("Failed to read spool entry:", metaPath, err)
+		return err
+	}
+	var entry spoolEntry
+	if err := json.Unmarshal(raw, &entry); err != nil {
+		log.Println("Skipping unreadable spool entry:", metaPath, err)
+		return err
+	}
+
+	if time.Since(entry.SpooledAt) > spoolTTL {
+		log.Println("Spooled upload expired for job", entry.JobID)
+		removeSpoolEntry(dir)
+		expired := withCode(codeUploadFailed, errors.New("upload retry window expired"))
+		if j, ok := jobs.get(entry.JobID); ok {
+			j.fail(expired)
+		}
+		notifyCompletion(completionEvent{JobID: entry.JobID, RefID: entry.refID(), Status: jobFailed, Error: expired.Error(), ErrorCode: errorCode(expired)})
+		return expired
+	}
+
+	result, err := uploadOutput(context.Background(), dir, entry.ObjectPrefix, entry.OutputName, entry.Manifest, entry.Upload, true)
+	if err != nil {
+		err = stageError(codeUploadFailed, err)
+		if errors.Is(err, errSegmentMismatch) {
+			log.Println("Dropping spooled upload for job", entry.JobID, err)
+			removeSpoolEntry(dir)
+			if j, ok := jobs.get(entry.JobID); ok {
+				j.fail(err)
+			}
+			notifyCompletion(completionEvent{JobID: entry.JobID, RefID: entry.refID(), Status: jobFailed, Error: err.Error(), ErrorCode: errorCode(err)})
+			return err
+		}
+		log.Println("Spooled upload still failing for job", entry.JobID, err)
+		if j, ok := jobs.get(entry.JobID); ok {
+			j.spool(entry.StreamURL, missingObjects(err))
+		}
+		return err
+	}
+
+	log.Println("✅ Spooled upload succeeded, stream available at:", entry.StreamURL)
+	if entry.PruneWindow && !result.Fallback {
+		pruneRolledOffSegments(filepath.Join(dir, entry.OutputName), entry.ObjectPrefix)
+	}
+	if entry.DeleteSource != "" {
+		deleteSourceObject(entry.DeleteSource)
+	}
+	removeSpoolEntry(dir)
+	if j, ok := jobs.get(entry.JobID); ok {
+		j.complete(result)
+	}
+	notifyCompletion(completionEvent{JobID: entry.JobID, RefID: entry.refID(), Status: jobCompleted, URL: result.URL, ManifestURL: result.ManifestURL})
+	return nil
+}
+
+// handleRetryUpload retries a spooled job's upload now instead of waiting
+// for SPOOL_RETRY_INTERVAL, sending only the objects still missing from
+// the bucket. A failure lists them in the error body's missing field.
+func handleRetryUpload(w http.ResponseWriter, r *http.Request) {
+	j, ok := jobs.get(r.PathValue("id"))
+	if !ok || j.Tenant != requestTenant(r) {
+		writeError(w, http.StatusNotFound, codeNotFound, "Job not found")
+		return
+	}
+	if spoolDir == "" || j.view().Status != jobSpooled {
+		writeErr(w, errNotSpooled)
+		return
+	}
+
+	if err := retrySpoolEntry(filepath.Join(spoolDir, j.ID+".json")); err != nil {
+		writeErr(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(j.view())
+}
+
+func removeSpoolEntry(dir string) {
+	os.RemoveAll(dir)
+	os.Remove(dir + ".json")
+}
@@ -0,0 +1,693 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+var minioTransport http.RoundTripper
+
+// createBucketIfMissing is CREATE_BUCKET_IF_MISSING. Turning it off leaves
+// bucket creation, with its policy and lifecycle, to whoever manages the
+// infrastructure; uploads then fail until the bucket exists.
+var createBucketIfMissing bool
+
+// newMinioTransport returns a transport trusting caFile in addition to the
+// system roots. It returns nil when no TLS customisation is needed so the
+// minio client keeps its own default transport.
+func newMinioTransport(caFile string, insecureSkipVerify bool) (http.RoundTripper, error) {
+	if caFile == "" && !insecureSkipVerify {
+		return nil, nil
+	}
+
+	transport, err := minio.DefaultTransport(useSSL)
+	if err != nil {
+		return nil, err
+	}
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + caFile)
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+
+	if insecureSkipVerify {
+		log.Println("⚠️  WARNING: INSECURE_SKIP_VERIFY is enabled, MinIO TLS certificates will NOT be verified")
+		transport.TLSClientConfig.InsecureSkipVerify = true
+	}
+
+	return transport, nil
+}
+
+// storageTarget is a MinIO endpoint and bucket outputs can be uploaded
+// to. Everything but conversion outputs only ever uses primaryStorage.
+type storageTarget struct {
+	// Name is how logs refer to the target
+	Name      string
+	Endpoint  string
+	AccessKey string
+	SecretKey string
+	Bucket    string
+	UseSSL    bool
+}
+
+var (
+	// primaryStorage is the MINIO_* target
+	primaryStorage *storageTarget
+
+	// fallbackStorage is FALLBACK_MINIO_*, where outputs go when uploading
+	// them to primaryStorage fails; nil when not configured
+	fallbackStorage *storageTarget
+)
+
+func (t *storageTarget) client() (*minio.Client, error) {
+	return minio.New(t.Endpoint, &minio.Options{
+		Creds:     credentials.NewStaticV4(t.AccessKey, t.SecretKey, ""),
+		Secure:    t.UseSSL,
+		Transport: minioTransport,
+	})
+}
+
+func newMinioClient() (*minio.Client, error) {
+	return primaryStorage.client()
+}
+
+// minioUnavailable pings the bucket so a conversion isn't started when the
+// upload is bound to fail. Only network errors and 5xx responses count; an
+// answer like AccessDenied means MinIO is up and the upload will report it.
+// A reachable fallback is enough for the upload to succeed.
+func minioUnavailable(ctx context.Context) error {
+	err := primaryStorage.unavailable(ctx)
+	if err != nil && fallbackStorage != nil && fallbackStorage.unavailable(ctx) == nil {
+		return nil
+	}
+	return err
+}
+
+func (t *storageTarget) unavailable(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	client, err := t.client()
+	if err != nil {
+		return err
+	}
+
+	_, err = client.BucketExists(ctx, t.Bucket)
+	if err == nil {
+		return nil
+	}
+	if status := minio.ToErrorResponse(err).StatusCode; status != 0 && status < 500 {
+		return nil
+	}
+	return err
+}
+
+// objectOptions are the per-request settings applied to every object a
+// conversion uploads.
+type objectOptions struct {
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty"`
+
+	// RetentionMode is GOVERNANCE or COMPLIANCE object lock, holding each
+	// object for RetentionDays from its upload, or until RetainUntil when
+	// that is set to carry over an existing object's retention
+	RetentionMode string    `json:"retentionMode,omitempty"`
+	RetentionDays int       `json:"retentionDays,omitempty"`
+	RetainUntil   time.Time `json:"retainUntil,omitzero"`
+}
+
+func (o objectOptions) putOptions(objectName string) minio.PutObjectOptions {
+	opts := minio.PutObjectOptions{
+		ContentType:  contentTypeFor(objectName),
+		UserMetadata: o.Metadata,
+		UserTags:     o.Tags,
+	}
+	if o.RetentionMode != "" {
+		opts.Mode = minio.RetentionMode(o.RetentionMode)
+		opts.RetainUntilDate = o.retainUntil()
+		// S3 only accepts a locked upload with a checksum
+		opts.SendContentMd5 = true
+	}
+	return opts
+}
+
+// storedObjectOptions reads back the metadata, tags and retention an object
+// was uploaded with, so replacing it doesn't drop them.
+func storedObjectOptions(objectName string) (objectOptions, error) {
+	ctx := context.Background()
+
+	client, err := newMinioClient()
+	if err != nil {
+		return objectOptions{}, err
+	}
+
+	info, err := client.StatObject(ctx, minioBucket, objectName, minio.StatObjectOptions{})
+	if err != nil {
+		return objectOptions{}, err
+	}
+	opts := objectOptions{Metadata: info.UserMetadata}
+	if info.UserTagCount > 0 {
+		t, err := client.GetObjectTagging(ctx, minioBucket, objectName, minio.GetObjectTaggingOptions{})
+		if err != nil {
+			return objectOptions{}, err
+		}
+		opts.Tags = t.ToMap()
+	}
+
+	mode, until, err := client.GetObjectRetention(ctx, minioBucket, objectName, "")
+	if err != nil {
+		switch minio.ToErrorResponse(err).Code {
+		case "NoSuchObjectLockConfiguration", "ObjectLockConfigurationNotFoundError", "InvalidRequest":
+			// Not locked, or in a bucket without object lock
+			return opts, nil
+		}
+		return objectOptions{}, err
+	}
+	// Lapsed retention can't be set again, and no longer holds anything
+	if mode != nil && until != nil && until.After(time.Now()) {
+		opts.RetentionMode = string(*mode)
+		opts.RetainUntil = *until
+	}
+	return opts, nil
+}
+
+type uploadedObject struct {
+	Name      string
+	URL       string
+	Size      int64
+	LocalPath string
+}
+
+// incompleteUploadError is an upload that stopped partway. Missing are the
+// object names it didn't get to, in upload order.
+type incompleteUploadError struct {
+	Missing []string
+	err     error
+}
+
+func (e *incompleteUploadError) Error() string {
+	return fmt.Sprintf("%v (%d objects not uploaded)", e.err, len(e.Missing))
+}
+
+func (e *incompleteUploadError) Unwrap() error {
+	return e.err
+}
+
+// missingObjects returns the objects an incomplete upload left out, or nil
+// when err isn't one.
+func missingObjects(err error) []string {
+	var incomplete *incompleteUploadError
+	if errors.As(err, &incomplete) {
+		return incomplete.Missing
+	}
+	return nil
+}
+
+// uploadToMinio uploads every file under folder and returns what was
+// uploaded, in upload order: see compareUploadOrder. With resume, objects
+// already stored under objectPrefix with the local file's size, and its
+// MD5 where the ETag is one, are left as they are, so retrying an
+// incomplete upload only sends what's missing. A put only ever leaves a
+// whole object behind; the ETag catches a re-encode that came out the
+// same size but different.
+func (t *storageTarget) uploadToMinio(ctx context.Context, folder string, objectPrefix string, objOpts objectOptions, resume bool) ([]uploadedObject, error) {
+	client, err := t.client()
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := client.BucketExists(ctx, t.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if !createBucketIfMissing {
+			return nil, withCode(codeStorageUnavailable, withStatus(http.StatusServiceUnavailable, fmt.Errorf("bucket %q does not exist and CREATE_BUCKET_IF_MISSING is false", t.Bucket)))
+		}
+		log.Println("Creating missing bucket:", t.Bucket)
+		err = client.MakeBucket(ctx, t.Bucket, minio.MakeBucketOptions{})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Ensure folder structure
+	if !strings.HasSuffix(objectPrefix, "/") {
+		objectPrefix = objectPrefix + "/"
+	}
+
+	var files []string
+	err = filepath.WalkDir(folder, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() && !isPartialFile(entry.Name()) {
+			files = append(files, filePath)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(files, compareUploadOrder)
+
+	// Two local files mapping to one key would silently overwrite each
+	// other, so every name is settled before anything is uploaded
+	names := make([]string, len(files))
+	sources := make(map[string]string, len(files))
+	for i, filePath := range files {
+		name, err := uploadObjectName(folder, objectPrefix, filePath)
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := sources[name]; ok {
+			return nil, fmt.Errorf("%s and %s would both be uploaded as %s", other, filePath, name)
+		}
+		sources[name] = filePath
+		names[i] = name
+	}
+
+	stored := map[string]minio.ObjectInfo{}
+	if resume {
+		for obj := range client.ListObjects(ctx, t.Bucket, minio.ListObjectsOptions{Prefix: objectPrefix, Recursive: true}) {
+			if obj.Err != nil {
+				return nil, obj.Err
+			}
+			stored[obj.Key] = obj
+		}
+	}
+
+	var uploaded []uploadedObject
+	for i, filePath := range files {
+		objectName := names[i]
+		if obj, ok := stored[objectName]; ok && alreadyUploaded(filePath, obj) {
+			log.Println("Already uploaded:", objectName)
+			uploaded = append(uploaded, uploadedObject{Name: objectName, URL: t.objectURL(objectName), Size: obj.Size, LocalPath: filePath})
+			continue
+		}
+
+		if err := uploadSlots.acquireContext(ctx); err != nil {
+			return uploaded, &incompleteUploadError{Missing: names[i:], err: err}
+		}
+		info, err := client.FPutObject(ctx, t.Bucket, objectName, filePath, objOpts.putOptions(objectName))
+		uploadSlots.release()
+		if err != nil {
+			log.Println("Upload failed for:", filePath, err)
+			return uploaded, &incompleteUploadError{Missing: names[i:], err: err}
+		}
+		log.Println("Uploaded:", objectName)
+		uploaded = append(uploaded, uploadedObject{Name: objectName, URL: t.objectURL(objectName), Size: info.Size, LocalPath: filePath})
+	}
+	return uploaded, nil
+}
+
+// md5ETag matches the ETag of an object put in one part, which is the hex
+// MD5 of its content. Multipart ETags carry a -count suffix and encrypted
+// objects' aren't an MD5 at all; for those the size has to do.
+var md5ETag = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// alreadyUploaded reports whether obj holds what filePath would upload.
+func alreadyUploaded(filePath string, obj minio.ObjectInfo) bool {
+	stat, err := os.Stat(filePath)
+	if err != nil || stat.Size() != obj.Size {
+		return false
+	}
+	etag := strings.ToLower(strings.Trim(obj.ETag, `"`))
+	if !md5ETag.MatchString(etag) {
+		return true
+	}
+	sum, err := fileMD5(filePath)
+	return err == nil && sum == etag
+}
+
+func fileMD5(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// uploadObjectName is the key a file under folder is uploaded as. Files in
+// a subdirectory keep it as a subfolder, which is how chapters (and any
+// other output set with its own segment_000.ts onwards) stay apart under
+// one prefix.
+func uploadObjectName(folder string, objectPrefix string, filePath string) (string, error) {
+	name := filepath.Base(filePath)
+
+	relPath, err := filepath.Rel(folder, filePath)
+	if err != nil {
+		return "", err
+	}
+	relDir := filepath.ToSlash(filepath.Dir(relPath))
+	if relDir == "." {
+		relDir = ""
+	} else {
+		relDir += "/"
+	}
+
+	switch {
+	case relDir != "":
+		return objectPrefix + relDir + name, nil
+	case strings.Contains(name, "input") && slices.Contains(inputFormats, filepath.Ext(name)):
+		return objectPrefix + "input.wav", nil
+	case strings.Contains(name, "input"):
+		// Not the downloaded source but a remux of it, such as input.mka from
+		// input_options; calling it .wav would mislabel its content
+		return objectPrefix + "input" + filepath.Ext(name), nil
+	case strings.Contains(name, "output") && strings.HasSuffix(name, ".m3u8"):
+		return objectPrefix + "output.m3u8", nil
+	case strings.Contains(name, "segment"):
+		return objectPrefix + name, nil
+	default:
+		return objectPrefix + name, nil
+	}
+}
+
+// compareUploadOrder sorts local output files into upload order. Playlists
+// go last so a player can never fetch one that lists a segment not yet
+// uploaded, output.m3u8 goes after any part playlists and the master
+// playlists after the media playlists they list. Everything else
+// is in natural order, so segment_1000.ts follows segment_999.ts rather
+// than landing between segment_100.ts and segment_101.ts.
+func compareUploadOrder(a, b string) int {
+	if rank := cmp.Compare(uploadRank(a), uploadRank(b)); rank != 0 {
+		return rank
+	}
+	return compareNatural(filepath.ToSlash(a), filepath.ToSlash(b))
+}
+
+func uploadRank(filePath string) int {
+	switch name := filepath.Base(filePath); {
+	case isMasterPlaylist(name):
+		return 3
+	case name == hlsPlaylistName:
+		return 2
+	case strings.HasSuffix(name, ".m3u8"):
+		return 1
+	default:
+		return 0
+	}
+}
+
+// compareNatural compares strings with runs of digits ordered by their
+// numeric value.
+func compareNatural(a, b string) int {
+	for a != "" && b != "" {
+		da, db := leadingDigits(a), leadingDigits(b)
+		if da != "" && db != "" {
+			na, nb := strings.TrimLeft(da, "0"), strings.TrimLeft(db, "0")
+			if c := cmp.Compare(len(na), len(nb)); c != 0 {
+				return c
+			}
+			if c := strings.Compare(na, nb); c != 0 {
+				return c
+			}
+			a, b = a[len(da):], b[len(db):]
+			continue
+		}
+		if a[0] != b[0] {
+			return cmp.Compare(a[0], b[0])
+		}
+		a, b = a[1:], b[1:]
+	}
+	return cmp.Compare(len(a), len(b))
+}
+
+func leadingDigits(s string) string {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	return s[:i]
+}
+
+func putObjectBytes(objectName string, data []byte, objOpts objectOptions) error {
+	return primaryStorage.putObjectBytes(objectName, data, objOpts)
+}
+
+func (t *storageTarget) putObjectBytes(objectName string, data []byte, objOpts objectOptions) error {
+	client, err := t.client()
+	if err != nil {
+		return err
+	}
+
+	uploadSlots.acquire()
+	_, err = client.PutObject(context.Background(), t.Bucket, objectName, bytes.NewReader(data), int64(len(data)), objOpts.putOptions(objectName))
+	uploadSlots.release()
+	if err != nil {
+		return err
+	}
+	log.Println("Uploaded:", objectName)
+	return nil
+}
+
+func getObjectBytes(objectName string) ([]byte, error) {
+	client, err := newMinioClient()
+	if err != nil {
+		return nil, err
+	}
+
+	obj, err := client.GetObject(context.Background(), minioBucket, objectName, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	return io.ReadAll(obj)
+}
+
+// listObjects returns the names of the objects under prefix.
+func listObjects(prefix string, recursive bool) ([]string, error) {
+	client, err := newMinioClient()
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for obj := range client.ListObjects(context.Background(), minioBucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: recursive}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		names = append(names, obj.Key)
+	}
+	return names, nil
+}
+
+func removeObject(objectName string) error {
+	return primaryStorage.removeObject(objectName)
+}
+
+func (t *storageTarget) removeObject(objectName string) error {
+	client, err := t.client()
+	if err != nil {
+		return err
+	}
+	return client.RemoveObject(context.Background(), t.Bucket, objectName, minio.RemoveObjectOptions{})
+}
+
+// removeUploaded takes down objects an unfinished upload already wrote.
+// Failures are logged; there is nobody left to report them to.
+func (t *storageTarget) removeUploaded(uploaded []uploadedObject) {
+	for _, obj := range uploaded {
+		if err := t.removeObject(obj.Name); err != nil {
+			log.Println("Failed to remove partial upload:", obj.Name, err)
+		}
+	}
+}
+
+// removeObjectsUnder removes every object under prefix.
+func removeObjectsUnder(prefix string) {
+	names, err := listObjects(prefix, true)
+	if err != nil {
+		log.Println("Failed to list objects under", prefix, err)
+		return
+	}
+	for _, name := range names {
+		if err := removeObject(name); err != nil {
+			log.Println("Failed to remove object:", name, err)
+		}
+	}
+}
+
+// objectKeyMode is OBJECT_KEY_MODE. "ascii" (the default) reduces key
+// segments derived from user input to [A-Za-z0-9._-]; "unicode" also keeps
+// letters and digits from any script, plus spaces, and relies on
+// publicObjectURL escaping them.
+var objectKeyMode = "ascii"
+
+// safeKeySegment makes one path segment of a user-derived object key safe to
+// store and to put in a URL. Anything not kept is replaced with '_', runs
+// collapsing to one.
+func safeKeySegment(segment string) string {
+	var b strings.Builder
+	replaced := false
+	for _, r := range segment {
+		keep := r < utf8.RuneSelf && (r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-')
+		if objectKeyMode == "unicode" && !keep {
+			keep = r == ' ' || (r >= utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r)))
+		}
+		if keep {
+			b.WriteRune(r)
+			replaced = false
+		} else if !replaced {
+			b.WriteByte('_')
+			replaced = true
+		}
+	}
+
+	// Edge spaces are invisible in listings and easy to lose in URLs
+	if safe := strings.TrimSpace(b.String()); safe != "" {
+		return safe
+	}
+	return "_"
+}
+
+// contentTypes maps an object's extension to the Content-Type it is stored
+// with. CONTENT_TYPES entries are layered on top, since CDNs disagree on
+// the right type for segments in particular.
+var contentTypes = map[string]string{
+	".m3u8": "application/vnd.apple.mpegurl",
+	".ts":   "video/MP2T",
+	".wav":  "audio/wav",
+	".m4a":  "audio/mp4",
+	".mp4":  "audio/mp4",
+	".mp3":  "audio/mpeg",
+	".aac":  "audio/aac",
+	".flac": "audio/flac",
+	".json": "application/json",
+}
+
+// isSegmentObject reports whether name is HLS media, a .ts segment or the
+// fragmented MP4 of a single-file playlist.
+func isSegmentObject(name string) bool {
+	return strings.HasSuffix(name, ".ts") || filepath.Base(name) == singleFileMediaName
+}
+
+// parseContentTypes merges CONTENT_TYPES, a JSON object of extension to
+// type, into contentTypes. Extensions may be given with or without the dot.
+func parseContentTypes(raw string) error {
+	if raw == "" {
+		return nil
+	}
+
+	var overrides map[string]string
+	if err := json.Unmarshal([]byte(raw), &overrides); err != nil {
+		return err
+	}
+	for ext, contentType := range overrides {
+		ext = strings.ToLower(ext)
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		contentTypes[ext] = contentType
+	}
+	return nil
+}
+
+const (
+	maxMetadataEntries = 20
+	maxMetadataKey     = 64
+	maxMetadataValue   = 256
+
+	// maxMetadataBytes is S3's limit on the user metadata of one object
+	maxMetadataBytes = 2 << 10
+)
+
+var metadataKeyPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9-]*$`)
+
+// parseUserMetadata reads the 'metadata' parameter, a JSON object of
+// user metadata sent as x-amz-meta-<key> on every uploaded object. Keys
+// are limited to letters, digits and dashes since they become header
+// names; values to printable ASCII since not every S3 implementation
+// round-trips anything else in headers.
+func parseUserMetadata(raw string) (map[string]string, error) {
+	if raw == "" {
+		return nil, nil
+	}
+
+	var metadata map[string]string
+	if err := json.Unmarshal([]byte(raw), &metadata); err != nil {
+		return nil, errors.New("Invalid 'metadata', expected a JSON object of strings")
+	}
+	if len(metadata) > maxMetadataEntries {
+		return nil, fmt.Errorf("Invalid 'metadata': at most %d entries are allowed", maxMetadataEntries)
+	}
+
+	total := 0
+	for key, value := range metadata {
+		if len(key) > maxMetadataKey || !metadataKeyPattern.MatchString(key) {
+			return nil, fmt.Errorf("Invalid 'metadata' key %q: expected up to %d letters, digits and dashes", key, maxMetadataKey)
+		}
+		if len(value) > maxMetadataValue {
+			return nil, fmt.Errorf("Invalid 'metadata' value for %q: at most %d characters are allowed", key, maxMetadataValue)
+		}
+		for _, c := range value {
+			if c < 0x20 || c > 0x7e {
+				return nil, fmt.Errorf("Invalid 'metadata' value for %q: only printable ASCII is allowed", key)
+			}
+		}
+		total += len(key) + len(value)
+	}
+	if total > maxMetadataBytes {
+		return nil, fmt.Errorf("Invalid 'metadata': keys and values may total at most %d bytes", maxMetadataBytes)
+	}
+	return metadata, nil
+}
+
+// contentTypeFor returns the Content-Type for objectName, or "" to let
+// MinIO pick its default.
+func contentTypeFor(objectName string) string {
+	return contentTypes[strings.ToLower(path.Ext(objectName))]
+}
+
+// ffmpeg writes playlists and segments to a temporary name before renaming
+// them into place, so those must never be published.
+func isPartialFile(name string) bool {
+	return strings.HasPrefix(name, ".") ||
+		strings.HasSuffix(name, ".tmp") ||
+		strings.HasSuffix(name, ".part")
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is just enough of the S3 API for uploads to primaryStorage: one
+// bucket whose objects are kept in memory, with a count of how often each
+// key was written.
+type fakeS3 struct {
+	*httptest.Server
+	bucket string
+
+	mu      sync.Mutex
+	objects map[string][]byte
+	puts    map[string]int
+}
+
+// useFakeStorage points primaryStorage at a fresh fakeS3 until the test
+// ends.
+func useFakeStorage(t *testing.T) *fakeS3 {
+	t.Helper()
+	s := &fakeS3{bucket: "test-bucket", objects: map[string][]byte{}, puts: map[string]int{}}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+
+	previousPrimary, previousFallback := primaryStorage, fallbackStorage
+	previousBucket, previousTransport := minioBucket, minioTransport
+	primaryStorage = &storageTarget{
+		Name:      "primary",
+		Endpoint:  strings.TrimPrefix(s.URL, "https://"),
+		AccessKey: "test-access-key",
+		SecretKey: "test-secret-key",
+		Bucket:    s.bucket,
+		UseSSL:    true,
+	}
+	fallbackStorage = nil
+	minioBucket, minioTransport = s.bucket, s.Client().Transport
+	t.Cleanup(func() {
+		primaryStorage, fallbackStorage = previousPrimary, previousFallback
+		minioBucket, minioTransport = previousBucket, previousTransport
+	})
+	return s
+}
+
+// object returns the stored content of key.
+func (s *fakeS3) object(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	body, ok := s.objects[key]
+	return string(body), ok
+}
+
+// keys returns every stored key, sorted.
+func (s *fakeS3) keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// overwritten returns the keys that were written more than once.
+func (s *fakeS3) overwritten() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for key, n := range s.puts {
+		if n > 1 {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func (s *fakeS3) serve(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != s.bucket {
+		s.error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	query := r.URL.Query()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case query.Has("location"):
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ LocationConstraint"`
+			Region  string   `xml:",chardata"`
+		}{Region: "us-east-1"})
+	case key == "" && r.Method == http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	case key == "" && r.Method == http.MethodGet:
+		s.list(w, query)
+	case r.Method == http.MethodPut:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			s.error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		s.objects[key] = body
+		s.puts[key]++
+		w.Header().Set("ETag", etagOf(body))
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		body, ok := s.objects[key]
+		if !ok {
+			s.error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", etagOf(body))
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		if r.Method == http.MethodGet {
+			w.Write(body)
+		}
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s.error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+type fakeS3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int
+}
+
+// list answers a ListObjectsV2 request in one page.
+func (s *fakeS3) list(w http.ResponseWriter, query url.Values) {
+	result := struct {
+		XMLName     xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+		Name        string
+		Prefix      string
+		KeyCount    int
+		MaxKeys     int
+		IsTruncated bool
+		Contents    []fakeS3Object
+	}{Name: s.bucket, Prefix: query.Get("prefix"), MaxKeys: 1000}
+	for key, body := range s.objects {
+		if strings.HasPrefix(key, result.Prefix) {
+			result.Contents = append(result.Contents, fakeS3Object{
+				Key:          key,
+				LastModified: time.Now().UTC().Format(time.RFC3339),
+				ETag:         etagOf(body),
+				Size:         len(body),
+			})
+		}
+	}
+	slices.SortFunc(result.Contents, func(a, b fakeS3Object) int { return strings.Compare(a.Key, b.Key) })
+	result.KeyCount = len(result.Contents)
+	writeXML(w, result)
+}
+
+func (s *fakeS3) error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+	}{Code: code})
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(v)
+}
+
+func etagOf(body []byte) string {
+	sum := md5.Sum(body)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func TestSafeKeySegment(t *testing.T) {
+	tests := []struct {
+		mode    string
+		segment string
+		want    string
+	}{
+		{"ascii", "track-01_final.wav", "track-01_final.wav"},
+		{"ascii", "My Song.wav", "My_Song.wav"},
+		{"ascii", "Beyoncé – Halo.mp3", "Beyonc_Halo.mp3"},
+		{"ascii", "a?b#c&d=e+f%g", "a_b_c_d_e_f_g"},
+		{"ascii", "日本語", "_"},
+		{"ascii", "   ", "_"},
+		{"unicode", "My Song.wav", "My Song.wav"},
+		{"unicode", "Beyoncé – Halo.mp3", "Beyoncé _ Halo.mp3"},
+		{"unicode", "日本語のうた", "日本語のうた"},
+		{"unicode", " edge ", "edge"},
+		{"unicode", "a?b#c", "a_b_c"},
+		{"unicode", "🎵 tune", "_ tune"},
+	}
+	previous := objectKeyMode
+	t.Cleanup(func() { objectKeyMode = previous })
+	for _, tt := range tests {
+		objectKeyMode = tt.mode
+		if got := safeKeySegment(tt.segment); got != tt.want {
+			t.Errorf("%s: safeKeySegment(%q) = %q, want %q", tt.mode, tt.segment, got, tt.want)
+		}
+	}
+}
+
+func TestSourceObjectPrefixEscaping(t *testing.T) {
+	tests := []struct {
+		source  string
+		want    string
+		wantErr bool
+	}{
+		{source: "https://cdn.example/albums/My%20Album/Track%201.wav", want: "albums/My_Album/Track_1/"},
+		{source: "https://cdn.example/albums/Beyonc%C3%A9/halo.mp3", want: "albums/Beyonc_/halo/"},
+		{source: "https://cdn.example/a%3Fb/c%23d.wav?x=1#frag", want: "a_b/c_d/"},
+		{source: "s3://bucket/in/Album One/track.flac", want: "in/Album_One/track/"},
+		{source: "https://cdn.example/a/../b.wav", wantErr: true},
+		{source: "https://cdn.example/", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := sourceObjectPrefix(tt.source)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("sourceObjectPrefix(%q) = %q, want an error", tt.source, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("sourceObjectPrefix(%q) = %q, %v, want %q", tt.source, got, err, tt.want)
+		}
+	}
+}
+
+// Keys kept by OBJECT_KEY_MODE=unicode, and any other a prefix can hold,
+// have to come back out of their public URL unchanged.
+func TestObjectURLEscaping(t *testing.T) {
+	target := &storageTarget{Endpoint: "minio.example:9000", Bucket: "audio"}
+	for _, key := range []string{
+		"converted-audio/job/output.m3u8",
+		"albums/My Album/Track 1/segment_000.ts",
+		"albums/Beyoncé _ Halo/output.m3u8",
+		"日本語のうた/output.m3u8",
+		"odd/a+b&c=d;e/100%/why?/#1/output.m3u8",
+	} {
+		raw := target.objectURL(key)
+		u, err := url.Parse(raw)
+		if err != nil {
+			t.Errorf("objectURL(%q) = %q, which doesn't parse: %v", key, raw, err)
+			continue
+		}
+		if u.Path != "/audio/"+key || u.RawQuery != "" || u.Fragment != "" {
+			t.Errorf("objectURL(%q) = %q, which resolves to path %q, query %q, fragment %q", key, raw, u.Path, u.RawQuery, u.Fragment)
+		}
+		if strings.ContainsAny(raw, " ?#") {
+			t.Errorf("objectURL(%q) = %q, leaving characters unescaped", key, raw)
+		}
+	}
+}
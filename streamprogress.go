@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// streamConversion runs a sync conversion for stream_progress=true. The
+// 200 and headers go out straight away and a progress line follows every
+// STREAM_PROGRESS_INTERVAL, so proxies that drop idle connections keep
+// this one open; the usual result text ends the body. Since the status is
+// already sent, a failure is reported in the last line instead.
+func streamConversion(w http.ResponseWriter, r *http.Request, j *job, req convertRequest) {
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	// nginx buffers proxied responses unless told not to
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	writeLine := func(line string) {
+		io.WriteString(w, line+"\n")
+		if err := rc.Flush(); err != nil {
+			log.Println("Could not flush progress for job", j.ID, err)
+		}
+	}
+	writeLine(progressLine(j.view()))
+
+	var result conversionResult
+	var err error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		result, err = runJob(r.Context(), j, req)
+	}()
+
+	ticker := time.NewTicker(streamProgressInterval)
+	defer ticker.Stop()
+	for running := true; running; {
+		select {
+		case <-ticker.C:
+			writeLine(progressLine(j.view()))
+		case <-done:
+			running = false
+		}
+	}
+
+	switch {
+	case errors.Is(err, errUploadSpooled):
+		io.WriteString(w, fmt.Sprintf("⏳ Conversion successful, upload deferred until storage recovers\nStream: %s", result.URL))
+	case err != nil:
+		io.WriteString(w, fmt.Sprintf("❌ Conversion failed (%s): %v", errorCode(err), err))
+	default:
+		io.WriteString(w, resultBody(req, result))
+	}
+}
+
+// progressLine describes where the job is, for the progress stream.
+func progressLine(v jobView) string {
+	switch {
+	case v.Status == jobPending && v.QueuePosition > 0:
+		return fmt.Sprintf("⏳ Queued, position %d", v.QueuePosition)
+	case v.Status == jobPending:
+		return "⏳ Queued"
+	case v.Progress != nil:
+		return fmt.Sprintf("⏳ Converting: %.0f%%", *v.Progress)
+	default:
+		return "⏳ Converting"
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Tracing follows W3C Trace Context for propagation and exports spans as
+// OTLP/HTTP JSON, configured by the standard OTEL_* variables. The
+// OpenTelemetry SDK isn't a dependency; the subset here is the span
+// lifecycle and the exporter wire format, which is all the pipeline needs.
+var (
+	traceEndpoint    string
+	traceHeaders     map[string]string
+	traceServiceName = "encoder-go"
+	traceQueue       chan *span
+	traceFlush       chan chan struct{}
+)
+
+const (
+	traceBatchSize     = 512
+	traceFlushInterval = 5 * time.Second
+)
+
+// OTLP span kinds and status codes.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+
+	spanStatusError = 2
+)
+
+type spanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+func (c spanContext) valid() bool {
+	return c.TraceID != [16]byte{}
+}
+
+func (c spanContext) traceID() string {
+	return hex.EncodeToString(c.TraceID[:])
+}
+
+// traceParent reads the caller's context from the traceparent header, if
+// it sent a well-formed one.
+func traceParent(r *http.Request) spanContext {
+	// version-traceid-spanid-flags
+	parts := strings.Split(strings.TrimSpace(r.Header.Get("traceparent")), "-")
+	if len(parts) != 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return spanContext{}
+	}
+	var c spanContext
+	traceID, err1 := hex.DecodeString(parts[1])
+	spanID, err2 := hex.DecodeString(parts[2])
+	flags, err3 := strconv.ParseUint(parts[3], 16, 8)
+	if err1 != nil || err2 != nil || err3 != nil || len(traceID) != 16 || len(spanID) != 8 {
+		return spanContext{}
+	}
+	copy(c.TraceID[:], traceID)
+	copy(c.SpanID[:], spanID)
+	c.Sampled = flags&1 == 1
+	if !c.valid() || c.SpanID == [8]byte{} {
+		return spanContext{}
+	}
+	return c
+}
+
+type span struct {
+	ctx      spanContext
+	parent   [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	finish   time.Time
+	attrs    map[string]any
+	errorMsg string
+}
+
+// startSpan begins a span under parent, or a new trace when parent is
+// unset. Spans are cheap to create even with tracing off; they just
+// aren't exported.
+func startSpan(parent spanContext, name string, kind int) *span {
+	s := &span{name: name, kind: kind, start: time.Now(), attrs: map[string]any{}}
+	if parent.valid() {
+		s.ctx.TraceID = parent.TraceID
+		s.ctx.Sampled = parent.Sampled
+		s.parent = parent.SpanID
+	} else {
+		rand.Read(s.ctx.TraceID[:])
+		s.ctx.Sampled = true
+	}
+	rand.Read(s.ctx.SpanID[:])
+	return s
+}
+
+func (s *span) context() spanContext {
+	return s.ctx
+}
+
+func (s *span) setAttr(key string, value any) {
+	s.attrs[key] = value
+}
+
+// end finishes the span, marking it failed when err is set, and queues it
+// for export.
+func (s *span) end(err error) {
+	if err != nil {
+		s.errorMsg = err.Error()
+	}
+	if traceQueue == nil || !s.ctx.Sampled {
+		return
+	}
+	s.finish = time.Now()
+	select {
+	case traceQueue <- s:
+	default:
+		// Never hold up a conversion for telemetry
+	}
+}
+
+// configureTracing reads the OTEL_* variables. Tracing is off unless an
+// OTLP endpoint is set.
+func configureTracing() {
+	if os.Getenv("OTEL_SDK_DISABLED") == "true" || os.Getenv("OTEL_TRACES_EXPORTER") == "none" {
+		return
+	}
+
+	traceEndpoint = os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if traceEndpoint == "" {
+		if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); base != "" {
+			traceEndpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+		}
+	}
+	if traceEndpoint == "" {
+		return
+	}
+
+	protocol := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL")
+	if protocol == "" {
+		protocol = os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL")
+	}
+	if protocol != "" && protocol != "http/json" {
+		log.Printf("Warning: OTLP protocol %q isn't supported, exporting traces as http/json", protocol)
+	}
+
+	traceHeaders = parseOTLPHeaders(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"))
+	for key, value := range parseOTLPHeaders(os.Getenv("OTEL_EXPORTER_OTLP_TRACES_HEADERS")) {
+		traceHeaders[key] = value
+	}
+	if name := os.Getenv("OTEL_SERVICE_NAME"); name != "" {
+		traceServiceName = name
+	}
+
+	traceQueue = make(chan *span, 4*traceBatchSize)
+	traceFlush = make(chan chan struct{})
+	go runTraceExporter()
+	log.Println("Exporting traces to", traceEndpoint)
+}
+
+// parseOTLPHeaders reads the key=value,key=value form with URL-encoded
+// values that the OTEL_EXPORTER_OTLP_*HEADERS variables use.
+func parseOTLPHeaders(raw string) map[string]string {
+	headers := make(map[string]string)
+	for _, pair := range strings.Split(raw, ",") {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			continue
+		}
+		if decoded, err := url.QueryUnescape(strings.TrimSpace(value)); err == nil {
+			value = decoded
+		}
+		headers[strings.TrimSpace(key)] = value
+	}
+	return headers
+}
+
+func runTraceExporter() {
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+
+	var batch []*span
+	for {
+		var flushed chan struct{}
+		select {
+		case s := <-traceQueue:
+			batch = append(batch, s)
+			if len(batch) < traceBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case flushed = <-traceFlush:
+			// Everything queued so far goes out with this export
+			for len(traceQueue) > 0 {
+				batch = append(batch, <-traceQueue)
+			}
+		}
+		for len(batch) > 0 {
+			n := min(len(batch), traceBatchSize)
+			if err := exportSpans(batch[:n]); err != nil {
+				log.Println("Trace export failed:", err)
+			}
+			batch = batch[n:]
+		}
+		batch = nil
+		if flushed != nil {
+			close(flushed)
+		}
+	}
+}
+
+// flushTraces exports the spans still waiting for a batch, so those of the
+// last requests before a shutdown aren't lost. It gives up when ctx ends.
+func flushTraces(ctx context.Context) {
+	if traceFlush == nil {
+		return
+	}
+	flushed := make(chan struct{})
+	select {
+	case traceFlush <- flushed:
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case <-flushed:
+	case <-ctx.Done():
+		log.Println("Gave up flushing traces:", context.Cause(ctx))
+	}
+}
+
+type otlpAttribute struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+func otlpAttributes(attrs map[string]any) []otlpAttribute {
+	out := make([]otlpAttribute, 0, len(attrs))
+	for key, value := range attrs {
+		var v map[string]any
+		switch value := value.(type) {
+		case string:
+			v = map[string]any{"stringValue": value}
+		case int:
+			v = map[string]any{"intValue": strconv.Itoa(value)}
+		case int64:
+			v = map[string]any{"intValue": strconv.FormatInt(value, 10)}
+		case float64:
+			v = map[string]any{"doubleValue": value}
+		case bool:
+			v = map[string]any{"boolValue": value}
+		default:
+			continue
+		}
+		out = append(out, otlpAttribute{Key: key, Value: v})
+	}
+	return out
+}
+
+func exportSpans(batch []*span) error {
+	spans := make([]map[string]any, 0, len(batch))
+	for _, s := range batch {
+		record := map[string]any{
+			"traceId":           s.ctx.traceID(),
+			"spanId":            hex.EncodeToString(s.ctx.SpanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.finish.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attrs),
+		}
+		if s.parent != [8]byte{} {
+			record["parentSpanId"] = hex.EncodeToString(s.parent[:])
+		}
+		if s.errorMsg != "" {
+			record["status"] = map[string]any{"code": spanStatusError, "message": s.errorMsg}
+		}
+		spans = append(spans, record)
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": otlpAttributes(map[string]any{"service.name": traceServiceName, "service.version": version}),
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "encoder-go"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, traceEndpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range traceHeaders {
+		req.Header.Set(key, value)
+	}
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestTranscodeHLSArgs(t *testing.T) {
+	calls := fakeTranscoder(t)
+	dir := t.TempDir()
+	opts := hlsOptions{SegmentDuration: 4, KeyframeInterval: 4, StartNumber: 5, Flags: []string{"independent_segments"}}
+
+	if _, err := transcodeHLS(context.Background(), filepath.Join(dir, "input.wav"), dir, encodeOptions{Bitrate: "96k"}, opts, nil); err != nil {
+		t.Fatal(err)
+	}
+	args := strings.Join(calls.ffmpeg()[0], " ")
+	for _, want := range []string{
+		"-progress pipe:1",
+		"-c:a aac -b:a 96k",
+		"-f hls -hls_playlist_type vod -hls_time 4",
+		"-start_number 5",
+		"-hls_flags independent_segments",
+		"-hls_segment_filename " + filepath.Join(dir, "segment_%03d.ts") + " " + filepath.Join(dir, hlsPlaylistName),
+	} {
+		if !strings.Contains(args, want) {
+			t.Errorf("ffmpeg args %q don't contain %q", args, want)
+		}
+	}
+}
+
+func TestTranscodeHLSSingleFileArgs(t *testing.T) {
+	calls := fakeTranscoder(t)
+	dir := t.TempDir()
+
+	output, err := transcodeHLS(context.Background(), filepath.Join(dir, "input.wav"), dir, encodeOptions{Bitrate: "128k"}, hlsOptions{SegmentDuration: 6, SingleFile: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := strings.Join(calls.ffmpeg()[0], " ")
+	for _, want := range []string{"-hls_segment_type fmp4", "-hls_flags single_file", "-hls_segment_filename " + filepath.Join(dir, singleFileMediaName)} {
+		if !strings.Contains(args, want) {
+			t.Errorf("ffmpeg args %q don't contain %q", args, want)
+		}
+	}
+	if !strings.Contains(readFile(t, output.Path), singleFileMediaName) {
+		t.Errorf("playlist doesn't reference %s", singleFileMediaName)
+	}
+}
+
+func TestTranscodeHLSWarnings(t *testing.T) {
+	fakeTranscoder(t, "FAKE_FFMPEG_STDERR=[aac @ 0x1] [warning] Audio clipped 3 times\n")
+	dir := t.TempDir()
+
+	output, err := transcodeHLS(context.Background(), filepath.Join(dir, "input.wav"), dir, encodeOptions{Bitrate: "128k"}, hlsOptions{SegmentDuration: 6}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(output.Warnings) != 1 || !strings.HasPrefix(output.Warnings[0], "Audio clipped during encoding") {
+		t.Errorf("warnings %q, want the clipping ffmpeg reported", output.Warnings)
+	}
+}
+
+func TestTranscodeHLSExitError(t *testing.T) {
+	fakeTranscoder(t, "FAKE_FFMPEG_EXIT=1", "FAKE_FFMPEG_STDERR=[error] Invalid data found when processing input\n")
+	dir := t.TempDir()
+
+	_, err := transcodeHLS(context.Background(), filepath.Join(dir, "input.wav"), dir, encodeOptions{Bitrate: "128k"}, hlsOptions{SegmentDuration: 6}, nil)
+	if err == nil || !strings.Contains(err.Error(), "FFmpeg conversion failed") {
+		t.Fatalf("transcodeHLS = %v, want the ffmpeg failure", err)
+	}
+	if !errors.As(err, new(*exec.ExitError)) {
+		t.Errorf("error %v doesn't carry ffmpeg's exit status", err)
+	}
+	if errorStatus(err) == http.StatusServiceUnavailable {
+		t.Errorf("an ffmpeg exit is reported as the transcoder being unavailable")
+	}
+}
+
+func TestTranscodeHLSMissingTranscoder(t *testing.T) {
+	previousFFmpeg, previousFFprobe := ffmpegPath, ffprobePath
+	ffmpegPath, ffprobePath = filepath.Join(t.TempDir(), "ffmpeg"), filepath.Join(t.TempDir(), "ffprobe")
+	t.Cleanup(func() { ffmpegPath, ffprobePath = previousFFmpeg, previousFFprobe })
+	dir := t.TempDir()
+
+	_, err := transcodeHLS(context.Background(), filepath.Join(dir, "input.wav"), dir, encodeOptions{Bitrate: "128k"}, hlsOptions{SegmentDuration: 6}, nil)
+	if status := errorStatus(err); status != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want 503 for a missing ffmpeg (%v)", status, err)
+	}
+	if code := errorCode(err); code != codeTranscoderUnavailable {
+		t.Errorf("code %q, want %q", code, codeTranscoderUnavailable)
+	}
+}
+
+func TestApplyInputOptions(t *testing.T) {
+	calls := fakeTranscoder(t)
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.raw")
+	writeFile(t, input, "pcm")
+
+	remuxed, err := applyInputOptions(context.Background(), input, []string{"-f", "s16le", "-ar", "44100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remuxed != filepath.Join(dir, "input.mka") {
+		t.Errorf("remuxed to %s, want input.mka", remuxed)
+	}
+	if _, err := os.Stat(input); !os.IsNotExist(err) {
+		t.Error("original input was kept after remuxing")
+	}
+	want := "-f s16le -ar 44100 -i " + input + " -map 0:a:0 -c copy " + remuxed
+	if args := strings.Join(calls.ffmpeg()[0], " "); !strings.HasSuffix(args, want) {
+		t.Errorf("ffmpeg args %q, want them to end in %q", args, want)
+	}
+}
+
+func TestApplyInputOptionsRejected(t *testing.T) {
+	fakeTranscoder(t, "FAKE_FFMPEG_EXIT=1")
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.raw")
+	writeFile(t, input, "pcm")
+
+	_, err := applyInputOptions(context.Background(), input, []string{"-f", "s16le"})
+	if status := errorStatus(err); status != http.StatusBadRequest {
+		t.Errorf("status %d, want 400 for options ffmpeg rejects (%v)", status, err)
+	}
+	if code := errorCode(err); code != codeBadInput {
+		t.Errorf("code %q, want %q", code, codeBadInput)
+	}
+}
+
+// fakeProbe is what the fake ffprobe reports: a stereo WAV lasting
+// FAKE_PROBE_DURATION, 10s unless set.
+const fakeProbe = `{"streams":[{"codec_name":"pcm_s16le","channels":2,"sample_rate":"44100","bit_rate":"1411200"}],"format":{"duration":"DURATION","bit_rate":"1411200"}}`
+
+// fakeCalls reads back the invocations the fake transcoder recorded.
+type fakeCalls string
+
+func (c fakeCalls) ffmpeg() [][]string {
+	raw, err := os.ReadFile(string(c))
+	if err != nil {
+		return nil
+	}
+	var runs [][]string
+	for _, line := range strings.Split(strings.TrimSuffix(string(raw), "\n"), "\n") {
+		args := strings.Split(line, "\x00")
+		if filepath.Base(args[0]) == filepath.Base(ffmpegPath) {
+			runs = append(runs, args[1:])
+		}
+	}
+	return runs
+}
+
+// fakeTranscoder swaps execCommand for this test binary acting as ffprobe
+// and ffmpeg, see TestHelperProcess, until the test ends. env adds to the
+// fake's environment:
+//   - FAKE_PROBE_DURATION sets the duration it probes and encodes
+//   - FAKE_FFMPEG_STDERR is written to ffmpeg's stderr
+//   - FAKE_FFMPEG_EXIT makes ffmpeg exit with that status, writing nothing
+func fakeTranscoder(t *testing.T, env ...string) fakeCalls {
+	t.Helper()
+	calls := filepath.Join(t.TempDir(), "calls")
+	previous := execCommand
+	execCommand = func(name string, args ...string) *exec.Cmd {
+		cmd := exec.Command(os.Args[0], append([]string{"-test.run=TestHelperProcess", "--", name}, args...)...)
+		cmd.Env = append(append(os.Environ(), "GO_WANT_HELPER_PROCESS=1", "FAKE_TRANSCODER_CALLS="+calls), env...)
+		return cmd
+	}
+	t.Cleanup(func() { execCommand = previous })
+	return fakeCalls(calls)
+}
+
+// TestHelperProcess isn't a real test: it is the fake transcoder. As
+// ffprobe it prints fakeProbe. As ffmpeg it writes a one-segment playlist
+// wherever the HLS output goes, once per -var_stream_map rendition, or an
+// empty file to any other output.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	args := os.Args[slices.Index(os.Args, "--")+1:]
+	log, err := os.OpenFile(os.Getenv("FAKE_TRANSCODER_CALLS"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		os.Exit(2)
+	}
+	log.WriteString(strings.Join(args, "\x00") + "\n")
+	log.Close()
+
+	duration := cmp.Or(os.Getenv("FAKE_PROBE_DURATION"), "10.000000")
+	if filepath.Base(args[0]) == filepath.Base(ffprobePath) {
+		os.Stdout.WriteString(strings.Replace(fakeProbe, "DURATION", duration, 1))
+		os.Exit(0)
+	}
+
+	os.Stderr.WriteString(os.Getenv("FAKE_FFMPEG_STDERR"))
+	if status, err := strconv.Atoi(os.Getenv("FAKE_FFMPEG_EXIT")); err == nil {
+		os.Exit(status)
+	}
+
+	output := args[len(args)-1]
+	i := slices.Index(args, "-hls_segment_filename")
+	if i < 0 {
+		if os.WriteFile(output, nil, 0644) != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	segmentPattern := args[i+1]
+
+	names := []string{""}
+	if i := slices.Index(args, "-var_stream_map"); i >= 0 {
+		names = nil
+		for _, stream := range strings.Fields(args[i+1]) {
+			_, name, _ := strings.Cut(stream, "name:")
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		segment := strings.ReplaceAll(strings.ReplaceAll(segmentPattern, "%v", name), "%03d", "000")
+		playlist := strings.ReplaceAll(output, "%v", name)
+		content := "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:10\n#EXTINF:" + duration + ",\n" + filepath.Base(segment) + "\n#EXT-X-ENDLIST\n"
+		if os.WriteFile(segment, []byte(strings.Repeat("x", 1000)), 0644) != nil || os.WriteFile(playlist, []byte(content), 0644) != nil {
+			os.Exit(1)
+		}
+	}
+	os.Stdout.WriteString("progress=end\n")
+	os.Exit(0)
+}
+
+// An input shorter than segment_duration comes out as one segment, which
+// is the whole stream rather than a short tail.
+func TestTranscodeHLSShorterThanOneSegment(t *testing.T) {
+	tests := []struct {
+		duration   string
+		target     int64
+		wantTarget string
+	}{
+		{duration: "2.400000", wantTarget: "#EXT-X-TARGETDURATION:2\n"},
+		{duration: "0.600000", wantTarget: "#EXT-X-TARGETDURATION:1\n"},
+		{duration: "0.600000", target: 6, wantTarget: "#EXT-X-TARGETDURATION:6\n"},
+	}
+	for _, tt := range tests {
+		fakeTranscoder(t, "FAKE_PROBE_DURATION="+tt.duration)
+		dir := t.TempDir()
+		opts := hlsOptions{SegmentDuration: 6, TargetDuration: tt.target}
+
+		output, err := transcodeHLS(context.Background(), filepath.Join(dir, "input.wav"), dir, encodeOptions{Bitrate: "128k"}, opts, nil)
+		if err != nil {
+			t.Fatalf("%ss input: %v", tt.duration, err)
+		}
+		playlist := readFile(t, output.Path)
+		if !strings.Contains(playlist, tt.wantTarget) {
+			t.Errorf("%ss input with target_duration %d: playlist\n%s\nwant %q", tt.duration, tt.target, playlist, tt.wantTarget)
+		}
+		if n := len(playlistSegments(playlist)); n != 1 {
+			t.Errorf("%ss input: %d segments, want 1", tt.duration, n)
+		}
+		if len(output.Warnings) > 0 {
+			t.Errorf("%ss input: warned %q about a complete single segment", tt.duration, output.Warnings)
+		}
+	}
+}
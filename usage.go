@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+)
+
+var usageAllowedPrefixes []string
+
+type usageReport struct {
+	Prefix  string `json:"prefix"`
+	Objects int64  `json:"objects"`
+	Bytes   int64  `json:"bytes"`
+}
+
+// prefixAllowed reports whether prefix falls under one of the configured
+// prefixes and can't climb out of it.
+func prefixAllowed(prefix string) bool {
+	if strings.Contains(prefix, "..") {
+		return false
+	}
+	for _, allowed := range usageAllowedPrefixes {
+		if strings.HasPrefix(prefix, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// storageUsage sums object sizes under prefix. ListObjects pages through
+// large prefixes internally, so this streams rather than loading everything.
+func storageUsage(ctx context.Context, prefix string) (usageReport, error) {
+	report := usageReport{Prefix: prefix}
+
+	client, err := newMinioClient()
+	if err != nil {
+		return report, err
+	}
+
+	for obj := range client.ListObjects(ctx, minioBucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return report, obj.Err
+		}
+		report.Objects++
+		report.Bytes += obj.Size
+	}
+	return report, nil
+}
+
+func handleUsage(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	if !prefixAllowed(prefix) {
+		writeError(w, http.StatusForbidden, codeForbidden, "Prefix is not allowed")
+		return
+	}
+
+	report, err := storageUsage(r.Context(), prefix)
+	if err != nil {
+		log.Println("Storage usage listing failed:", err)
+		writeError(w, http.StatusBadGateway, codeStorageError, "Failed to list objects: "+err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// version and commit are set at build time:
+//
+//	go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse HEAD)"
+var (
+	version = "dev"
+	commit  = ""
+)
+
+type versionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	GoVersion string `json:"goVersion"`
+	FFmpeg    string `json:"ffmpeg"`
+}
+
+// buildCommit falls back to the VCS revision Go stamps into the binary when
+// commit wasn't injected.
+func buildCommit() string {
+	if commit != "" {
+		return commit
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				return setting.Value
+			}
+		}
+	}
+	return ""
+}
+
+// ffmpegVersion returns the first line of ffmpeg -version. It runs on every
+// call since the binary can be swapped under a running service.
+func ffmpegVersion() string {
+	out, err := execCommand(ffmpegPath, "-version").Output()
+	if err != nil {
+		return "unavailable: " + err.Error()
+	}
+	line, _, _ := strings.Cut(string(out), "\n")
+	return strings.TrimSpace(line)
+}
+
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(versionInfo{
+		Version:   version,
+		Commit:    buildCommit(),
+		GoVersion: runtime.Version(),
+		FFmpeg:    ffmpegVersion(),
+	})
+}
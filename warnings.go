@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// ffmpegWarningPatterns are the ffmpeg messages a successful encode passes
+// on to the caller as warnings: signs the output may sound wrong even
+// though nothing failed.
+var ffmpegWarningPatterns = []struct {
+	pattern *regexp.Regexp
+	warning string
+}{
+	{regexp.MustCompile(`(?i)clipp`), "Audio clipped during encoding"},
+	{regexp.MustCompile(`(?i)resampl`), "Audio was resampled"},
+	{regexp.MustCompile(`(?i)non[- ]?monoton|backward in time`), "Input timestamps were out of order"},
+	{regexp.MustCompile(`(?i)error while decoding|invalid data found|header missing|corrupt`), "Parts of the input couldn't be decoded"},
+	{regexp.MustCompile(`(?i)estimating duration from bitrate`), "Input duration was estimated from its bitrate and may be inaccurate"},
+}
+
+// ffmpegLevelPattern finds the [level] that -loglevel level+... puts after
+// a line's [component @ address] context.
+var ffmpegLevelPattern = regexp.MustCompile(`\[(panic|fatal|error|warning|info|verbose|debug|trace)\] `)
+
+// ffmpegWarnings reads an encode's stderr. It collects the warnings
+// matching ffmpegWarningPatterns and passes on to the server's stderr what
+// FFMPEG_LOGLEVEL asks for, so capturing warnings doesn't make the log
+// noisier.
+type ffmpegWarnings struct {
+	mu      sync.Mutex
+	partial []byte
+	// first and counts are by index into ffmpegWarningPatterns
+	first  map[int]string
+	counts map[int]int
+}
+
+// ffmpegEncodeCommand is ffmpegCommand for the main encode, logging at
+// warning level at least so the warnings returned with the result can be
+// collected.
+func ffmpegEncodeCommand(args ...string) (*exec.Cmd, *ffmpegWarnings) {
+	level := ffmpegLogLevel
+	if slices.Index(ffmpegLogLevels, level) < slices.Index(ffmpegLogLevels, "warning") {
+		level = "warning"
+	}
+	cmd := execCommand(ffmpegPath, append([]string{"-hide_banner", "-nostats", "-loglevel", "level+" + level}, args...)...)
+	w := &ffmpegWarnings{first: map[int]string{}, counts: map[int]int{}}
+	cmd.Stderr = w
+	return cmd, w
+}
+
+func (w *ffmpegWarnings) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.line(string(w.partial[:i]))
+		w.partial = w.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+func (w *ffmpegWarnings) line(line string) {
+	m := ffmpegLevelPattern.FindStringSubmatchIndex(line)
+	if m == nil {
+		// Continuation lines carry no level of their own
+		fmt.Fprintln(os.Stderr, line)
+		return
+	}
+	level := line[m[2]:m[3]]
+	message := line[:m[0]] + line[m[1]:]
+	if slices.Index(ffmpegLogLevels, level) <= slices.Index(ffmpegLogLevels, ffmpegLogLevel) {
+		fmt.Fprintln(os.Stderr, message)
+	}
+	if level != "warning" && level != "error" {
+		return
+	}
+	for i, p := range ffmpegWarningPatterns {
+		if p.pattern.MatchString(message) {
+			if w.counts[i] == 0 {
+				w.first[i] = strings.TrimSpace(message)
+			}
+			w.counts[i]++
+			break
+		}
+	}
+}
+
+// list returns one warning per kind of problem seen, in pattern order,
+// quoting the first message of each.
+func (w *ffmpegWarnings) list() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.partial) > 0 {
+		w.line(string(w.partial))
+		w.partial = nil
+	}
+	var warnings []string
+	for i, p := range ffmpegWarningPatterns {
+		switch n := w.counts[i]; {
+		case n == 1:
+			warnings = append(warnings, fmt.Sprintf("%s: ffmpeg reported %q", p.warning, w.first[i]))
+		case n > 1:
+			warnings = append(warnings, fmt.Sprintf("%s: ffmpeg reported %q, %d times in all", p.warning, w.first[i], n))
+		}
+	}
+	return warnings
+}